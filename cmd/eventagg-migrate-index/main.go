@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+
+	"github.com/go-kit/kit/log"
+)
+
+// converts text indexes of persisted segments into binary ones,
+// should be run while eventagg is stopped
+func main() {
+	logger := log.NewJSONLogger(log.NewSyncWriter(os.Stdout))
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+
+	dir := flag.String("dir", "", "persistence data dir")
+	flag.Parse()
+	if *dir == "" {
+		logger.Log("event", "persistence data dir is not given")
+		os.Exit(1)
+	}
+
+	workerDirs, err := pfile.WorkerDirs(*dir)
+	if err != nil {
+		logger.Log("event", "failed to list workers", "error", err)
+		os.Exit(1)
+	}
+
+	migrated := 0
+	for _, workerDir := range workerDirs {
+		segments, err := pfile.Segments(workerDir)
+		if err != nil {
+			logger.Log("event", "failed to list segments", "dir", workerDir, "error", err)
+			os.Exit(1)
+		}
+
+		for _, segment := range segments {
+			ok, err := pfile.MigrateIndex(segment)
+			if err != nil {
+				logger.Log("event", "failed to migrate index", "index", segment.IndexPath(), "error", err)
+				os.Exit(1)
+			}
+			if ok {
+				logger.Log("event", "index migrated", "index", segment.IndexPath())
+				migrated++
+			}
+		}
+	}
+	logger.Log("event", "migration finished", "migrated", migrated)
+}
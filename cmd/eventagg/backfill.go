@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/config"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+	"github.com/iahmedov/eventagg/pkg/snapshot"
+
+	"github.com/go-kit/kit/log"
+)
+
+// DefaultSnapshotInterval is used when snapshot interval is not configured
+const DefaultSnapshotInterval = 5 * time.Minute
+
+// addAll feeds event into every aggregator until ctx is done
+func addAll(ctx context.Context, aggregators map[string]aggregator.Aggregator) func(ev *eventagg.Event) error {
+	return func(ev *eventagg.Event) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, agg := range aggregators {
+			if err := agg.Add(ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// backfill restores aggregators from the latest snapshot and replays events
+// written after it, without usable snapshot events are replayed from
+// configured since when replay is enabled. Replay is stopped when ctx is done
+func backfill(ctx context.Context, cfg config.Config, snapshots *snapshot.Store, aggregators map[string]aggregator.Aggregator, logger log.Logger) error {
+	if snapshots != nil {
+		latest, err := snapshots.Latest()
+		if err != nil {
+			return err
+		}
+		if latest != nil {
+			err = latest.Restore(aggregators)
+			if err == nil {
+				logger.Log("event", "snapshot restored", "created_at", time.Unix(0, latest.CreatedAt))
+				started := time.Now()
+				count, err := pfile.ReplayFrom(cfg.Persistence.Dir, latest.Positions, logger, addAll(ctx, aggregators))
+				if err != nil {
+					return err
+				}
+				logger.Log("event", "replay finished", "events", count, "duration", time.Since(started))
+				return nil
+			}
+			if err != snapshot.ErrIncomplete {
+				return err
+			}
+			logger.Log("event", "snapshot is not used", "error", err)
+		}
+	}
+
+	if !cfg.Replay.Enabled {
+		return nil
+	}
+	var since int64
+	if cfg.Replay.Since != "" {
+		t, err := time.Parse(time.RFC3339, cfg.Replay.Since)
+		if err != nil {
+			return fmt.Errorf("invalid replay since: %s", err)
+		}
+		since = t.Unix()
+	}
+
+	logger.Log("event", "replay started", "since", since)
+	started := time.Now()
+	count, err := pfile.Replay(cfg.Persistence.Dir, since, logger, addAll(ctx, aggregators))
+	if err != nil {
+		return err
+	}
+	logger.Log("event", "replay finished", "events", count, "duration", time.Since(started))
+	return nil
+}
+
+// runSnapshots takes snapshot every interval until context is done
+func runSnapshots(ctx context.Context, interval time.Duration, take func(ctx context.Context) error, logger log.Logger) error {
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := take(ctx); err != nil {
+				logger.Log("event", "failed to write snapshot", "error", err)
+			}
+		}
+	}
+}
@@ -2,22 +2,32 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/iahmedov/eventagg"
 	"github.com/iahmedov/eventagg/config"
 	"github.com/iahmedov/eventagg/pkg/aggregator"
+	cold "github.com/iahmedov/eventagg/pkg/aggregator/lazy"
+	"github.com/iahmedov/eventagg/pkg/mq"
+	"github.com/iahmedov/eventagg/pkg/mq/deadletter"
 	localmq "github.com/iahmedov/eventagg/pkg/mq/local"
+	walmq "github.com/iahmedov/eventagg/pkg/mq/wal"
 	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+	"github.com/iahmedov/eventagg/pkg/schema"
 	"github.com/iahmedov/eventagg/pkg/server"
+	"github.com/iahmedov/eventagg/pkg/snapshot"
 
 	// plugin registrations
-	_ "github.com/iahmedov/eventagg/pkg/aggregator/lazy"
 	_ "github.com/iahmedov/eventagg/pkg/aggregator/realtime"
 
 	"github.com/go-kit/kit/log"
@@ -36,7 +46,7 @@ func init() {
 
 func main() {
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
@@ -60,6 +70,96 @@ func runInGroup(ctx context.Context, g *errgroup.Group, fnc func(context.Context
 	g.Go(func() error { return fnc(ctx) })
 }
 
+// waitQueue waits until queue accepts events, nil event is not queued
+func waitQueue(ctx context.Context, queue mq.Queue) error {
+	for queue.Insert(nil) != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	return nil
+}
+
+func newQueue(cfg config.Queue, deadLetters *deadletter.Store) (mq.Queue, func() error, error) {
+	switch cfg.Type {
+	case config.QueueWAL:
+		if cfg.Dir == "" {
+			return nil, nil, errors.New("queue dir is required for wal queue")
+		}
+		queue, err := walmq.New(walmq.Config{
+			Dir:            cfg.Dir,
+			MaxAttempts:    cfg.Default.Retry.MaxAttempts,
+			InitialBackoff: cfg.Default.Retry.InitialBackoff,
+			MaxBackoff:     cfg.Default.Retry.MaxBackoff,
+			DeadLetters:    deadLetters,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return queue, queue.Close, nil
+	default:
+		subscribers := make(map[string]localmq.SubscriberConfig, len(cfg.Subscribers))
+		for name, sub := range cfg.Subscribers {
+			subscribers[name] = localSubscriberConfig(sub, cfg.SpillDir)
+		}
+		return localmq.NewWithConfig(localmq.Config{
+			Default:      localSubscriberConfig(cfg.Default, cfg.SpillDir),
+			Subscribers:  subscribers,
+			DeadLetters:  deadLetters,
+			DrainTimeout: cfg.DrainTimeout,
+		}), func() error { return nil }, nil
+	}
+}
+
+func localSubscriberConfig(cfg config.QueueSubscriber, spillDir string) localmq.SubscriberConfig {
+	return localmq.SubscriberConfig{
+		BufferSize: cfg.BufferSize,
+		Overflow:   localmq.OverflowPolicy(cfg.Overflow),
+		SpillDir:   spillDir,
+		Retry: localmq.RetryConfig{
+			MaxAttempts:    cfg.Retry.MaxAttempts,
+			InitialBackoff: cfg.Retry.InitialBackoff,
+			MaxBackoff:     cfg.Retry.MaxBackoff,
+		},
+	}
+}
+
+func subscribe(queue mq.Queue, name string, f func(*eventagg.Event) error) error {
+	if named, ok := queue.(mq.NamedQueue); ok {
+		return named.SubscribeNamed(name, f)
+	}
+	return queue.Subscribe(f)
+}
+
+func newSchemaRegistry(cfg config.Schemas) (*schema.Registry, error) {
+	events := make([]schema.Event, len(cfg.Events))
+	for i, ev := range cfg.Events {
+		params := make([]schema.Param, len(ev.Params))
+		for j, p := range ev.Params {
+			params[j] = schema.Param{
+				Name:     p.Name,
+				Type:     schema.ParamType(p.Type),
+				Required: p.Required,
+				Enum:     p.Enum,
+				Min:      p.Min,
+				Max:      p.Max,
+			}
+		}
+		events[i] = schema.Event{
+			Type:               ev.Type,
+			Params:             params,
+			AllowUnknownParams: ev.AllowUnknownParams,
+		}
+	}
+
+	return schema.New(schema.Config{
+		Events:             events,
+		RejectUnknownTypes: cfg.RejectUnknownTypes,
+	})
+}
+
 func Run(ctx context.Context) {
 	logger := log.NewJSONLogger(log.NewSyncWriter(os.Stdout))
 	logger = log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller, "version", version)
@@ -74,24 +174,55 @@ func Run(ctx context.Context) {
 	}
 
 	filePersistence, err := pfile.New(pfile.Config{
-		DataDir: cfg.Persistence.Dir,
-		Count:   cfg.Persistence.Count,
-	})
+		DataDir:           cfg.Persistence.Dir,
+		Count:             cfg.Persistence.Count,
+		SegmentMaxBytes:   cfg.Persistence.SegmentMaxBytes,
+		SegmentMaxAge:     cfg.Persistence.SegmentMaxAge,
+		RetentionMaxAge:   cfg.Persistence.RetentionMaxAge,
+		RetentionMaxBytes: cfg.Persistence.RetentionMaxBytes,
+		JanitorInterval:   cfg.Persistence.JanitorInterval,
+		Sync:              pfile.SyncPolicy(cfg.Persistence.Sync),
+		SyncInterval:      cfg.Persistence.SyncInterval,
+		SyncEvery:         cfg.Persistence.SyncEvery,
+		Compression:       cfg.Persistence.Compression,
+		BlockSize:         cfg.Persistence.BlockSize,
+		Partition:         cfg.Persistence.Partition,
+	}, logger)
 	if err != nil {
 		logger.Log("event", "failed to setup persistence", "error", err)
 		os.Exit(1)
 	}
-	queue := localmq.New()
-	queue.Subscribe(filePersistence.Add)
+	deadLetterDir := cfg.Queue.DeadLetterDir
+	if deadLetterDir == "" {
+		deadLetterDir = filepath.Join(cfg.Persistence.Dir, "deadletter")
+	}
+	deadLetters, err := deadletter.New(deadLetterDir)
+	if err != nil {
+		logger.Log("event", "failed to setup dead letter store", "error", err)
+		os.Exit(1)
+	}
+
+	queue, closeQueue, err := newQueue(cfg.Queue, deadLetters)
+	if err != nil {
+		logger.Log("event", "failed to setup queue", "error", err)
+		os.Exit(1)
+	}
+	defer closeQueue() // queue is stopped before Run() returns
+	subscribe(queue, "persistence", filePersistence.Add)
 
 	views := map[string]aggregator.View{}
+	aggregators := map[string]aggregator.Aggregator{}
+	closers := []aggregator.Collector{}
 	for _, aggCfg := range cfg.Aggregators {
 		agg, err := aggregator.New(aggCfg.Name, aggCfg.Params)
 		if err != nil {
 			logger.Log("event", "failed to create aggregator", "error", err)
 			os.Exit(1)
 		}
-		queue.Subscribe(agg.Add)
+		if err := subscribe(queue, aggCfg.Alias, agg.Add); err != nil {
+			logger.Log("event", "failed to subscribe aggregator", "error", err)
+			os.Exit(1)
+		}
 
 		if _, ok := views[aggCfg.Alias]; ok {
 			logger.Log("event", "failed to register view",
@@ -99,21 +230,133 @@ func Run(ctx context.Context) {
 			os.Exit(1)
 		}
 		views[aggCfg.Alias] = agg
-		defer agg.Close() // will be closed at the end of Run() method
+		aggregators[aggCfg.Alias] = agg
+		closers = append(closers, agg) // closed in order after queue is drained
+	}
+
+	schemas, err := newSchemaRegistry(cfg.Schemas)
+	if err != nil {
+		logger.Log("event", "failed to setup schema registry", "error", err)
+		os.Exit(1)
+	}
+	var quarantine schema.Quarantine
+	if cfg.Schemas.QuarantineFile != "" {
+		quarantine, err = schema.NewFileQuarantine(cfg.Schemas.QuarantineFile)
+		if err != nil {
+			logger.Log("event", "failed to setup quarantine", "error", err)
+			os.Exit(1)
+		}
+		defer quarantine.Close()
 	}
 
 	srv := server.New(server.Config{
 		Port:        cfg.Server.Port,
+		MaxBodySize: cfg.Server.MaxBodySize,
+		DedupWindow: cfg.Server.DedupWindow,
+		DedupSize:   cfg.Server.DedupSize,
 		Queue:       queue,
 		Aggregators: views,
+		Schemas:     schemas,
+		Quarantine:  quarantine,
+		DeadLetters: deadLetters,
+		Events:      cold.NewExporter(cfg.Persistence.Dir),
 	}, log.With(logger, "service", "api"))
-	logger.Log("event", "service initialization finished, starting...")
+
+	var snapshots *snapshot.Store
+	if cfg.Snapshots.Enabled {
+		snapshotDir := cfg.Snapshots.Dir
+		if snapshotDir == "" {
+			snapshotDir = filepath.Join(cfg.Persistence.Dir, "snapshots")
+		}
+		if snapshots, err = snapshot.New(snapshotDir, cfg.Snapshots.Keep); err != nil {
+			logger.Log("event", "failed to setup snapshot store", "error", err)
+			os.Exit(1)
+		}
+	}
+	takeSnapshot := func() error {
+		s, err := snapshot.Take(filePersistence.Positions(), aggregators)
+		if err != nil {
+			return err
+		}
+		return snapshots.Write(s)
+	}
+	// periodic snapshot is taken while queue delivery is paused, so positions
+	// and state of aggregators cover the same events
+	takePeriodicSnapshot := func(ctx context.Context) error {
+		pauser, ok := queue.(mq.Pauser)
+		if !ok {
+			return takeSnapshot()
+		}
+		return pauser.WhilePaused(ctx, func() error {
+			if err := filePersistence.WaitWritten(ctx); err != nil {
+				return err
+			}
+			return takeSnapshot()
+		})
+	}
+
+	// server answers readiness probes and rejects events while
+	// aggregators are backfilled
 	runner, groupCtx := errgroup.WithContext(ctx)
-	runInGroup(groupCtx, runner, queue.Start)
 	runInGroup(groupCtx, runner, srv.Run)
+
+	// aggregators are backfilled before events are accepted
+	replayLogger := log.With(logger, "service", "replay")
+	err = backfill(groupCtx, cfg, snapshots, aggregators, replayLogger)
+	if err != nil && groupCtx.Err() == nil {
+		logger.Log("event", "failed to replay persisted events", "error", err)
+		os.Exit(1)
+	}
+	// aggregators of cancelled replay are incomplete, they are not snapshotted
+	backfilled := err == nil
+	if !backfilled {
+		logger.Log("event", "replay cancelled")
+	}
+	if snapshots != nil && backfilled {
+		// positions of restored snapshot may point beyond data lost in crash
+		if err := takeSnapshot(); err != nil {
+			logger.Log("event", "failed to write snapshot", "error", err)
+		}
+	}
+
+	logger.Log("event", "service initialization finished, starting...")
+	runInGroup(groupCtx, runner, func(ctx context.Context) error {
+		err := queue.Start(ctx)
+		if err != nil {
+			logger.Log("event", "queue stopped", "error", err)
+		}
+		return err
+	})
+	if waitQueue(groupCtx, queue) == nil {
+		srv.SetReady()
+	}
+	if snapshots != nil {
+		runInGroup(groupCtx, runner, func(ctx context.Context) error {
+			return runSnapshots(ctx, cfg.Snapshots.Interval, takePeriodicSnapshot, logger)
+		})
+	}
 	if err := runner.Wait(); err != nil {
 		logger.Log("event", "error", "cause", err)
 	}
 
+	// queue is drained, aggregators are closed before persistence,
+	// final snapshot has all events aggregated and persisted
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			logger.Log("event", "failed to close aggregator", "error", err)
+		}
+	}
+	if err := filePersistence.Close(); err != nil {
+		logger.Log("event", "failed to close persistence", "error", err)
+	}
+	if lost := filePersistence.Lost(); lost > 0 {
+		logger.Log("event", "persisted events lost", "count", lost)
+	}
+	if snapshots != nil && backfilled {
+		if err := takeSnapshot(); err != nil {
+			logger.Log("event", "failed to write snapshot", "error", err)
+		}
+	}
+
 	return
 }
@@ -3,6 +3,7 @@ package config
 import (
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/go-playground/validator.v9"
@@ -14,16 +15,104 @@ type (
 		Version     string          `yaml:"-"`
 		Server      Server          `yaml:"server" validate:"required,dive"`
 		Persistence FilePersistence `yaml:"persistence" validate:"required,dive"`
+		Queue       Queue           `yaml:"queue"`
 		Aggregators []Aggregator    `yaml:"aggregators" validate:"dive"`
+		Schemas     Schemas         `yaml:"schemas"`
+		Replay      Replay          `yaml:"replay"`
+		Snapshots   Snapshots       `yaml:"snapshots"`
 	}
 
 	Server struct {
 		Port int `yaml:"port" validate:"required,min=80,max=65535"`
+		// MaxBodySize limits request body size after decompression, in bytes
+		MaxBodySize int64 `yaml:"max_body_size" validate:"gte=0"`
+		// DedupWindow is how long accepted event ids are remembered
+		DedupWindow time.Duration `yaml:"dedup_window" validate:"gte=0"`
+		// DedupSize limits number of remembered event ids
+		DedupSize int `yaml:"dedup_size" validate:"gte=0"`
+	}
+
+	Queue struct {
+		// Type is either "local" (in memory) or "wal" (durable, on disk)
+		Type string `yaml:"type" validate:"omitempty,oneof=local wal"`
+		Dir  string `yaml:"dir"`
+		// SpillDir keeps overflowed events of subscribers with "spill" policy
+		SpillDir string `yaml:"spill_dir"`
+		// DeadLetterDir keeps events failed after all retries,
+		// "deadletter" folder inside of persistence dir is used when empty
+		DeadLetterDir string `yaml:"dead_letter_dir"`
+		// DrainTimeout limits delivery of buffered events on shutdown
+		DrainTimeout time.Duration              `yaml:"drain_timeout" validate:"gte=0"`
+		Default      QueueSubscriber            `yaml:"default"`
+		Subscribers  map[string]QueueSubscriber `yaml:"subscribers" validate:"dive"`
+	}
+
+	// QueueSubscriber configures delivery buffer of local queue subscriber,
+	// subscribers are named "persistence" and by aggregator alias
+	QueueSubscriber struct {
+		BufferSize int    `yaml:"buffer_size" validate:"gte=0"`
+		Overflow   string `yaml:"overflow" validate:"omitempty,oneof=block drop_oldest drop_newest spill"`
+		Retry      Retry  `yaml:"retry"`
+	}
+
+	Retry struct {
+		MaxAttempts    int           `yaml:"max_attempts" validate:"gte=0"`
+		InitialBackoff time.Duration `yaml:"initial_backoff" validate:"gte=0"`
+		MaxBackoff     time.Duration `yaml:"max_backoff" validate:"gte=0"`
 	}
 
 	FilePersistence struct {
-		Dir   string `yaml:"dir"`
-		Count int    `yaml:"worker_count" validate:"gte=1"`
+		Dir               string        `yaml:"dir"`
+		Count             int           `yaml:"worker_count" validate:"gte=1"`
+		SegmentMaxBytes   int64         `yaml:"segment_max_bytes" validate:"gte=0"`
+		SegmentMaxAge     time.Duration `yaml:"segment_max_age" validate:"gte=0"`
+		RetentionMaxAge   time.Duration `yaml:"retention_max_age" validate:"gte=0"`
+		RetentionMaxBytes int64         `yaml:"retention_max_bytes" validate:"gte=0"`
+		JanitorInterval   time.Duration `yaml:"janitor_interval" validate:"gte=0"`
+		Sync              string        `yaml:"sync" validate:"omitempty,oneof=none interval every_n always"`
+		SyncInterval      time.Duration `yaml:"sync_interval" validate:"gte=0"`
+		SyncEvery         int           `yaml:"sync_every" validate:"gte=0"`
+		Compression       string        `yaml:"compression" validate:"omitempty,oneof=none zstd"`
+		BlockSize         int           `yaml:"block_size" validate:"gte=0"`
+		Partition         string        `yaml:"partition"`
+	}
+
+	// Replay feeds persisted events into aggregators on startup
+	Replay struct {
+		Enabled bool `yaml:"enabled"`
+		// Since is RFC3339 time, events before it are not replayed
+		Since string `yaml:"since"`
+	}
+
+	// Snapshots periodically save state of aggregators, on startup the latest
+	// snapshot is restored and only events written after it are replayed
+	Snapshots struct {
+		Enabled bool `yaml:"enabled"`
+		// Dir keeps snapshots, "snapshots" folder inside of persistence dir is used when empty
+		Dir      string        `yaml:"dir"`
+		Interval time.Duration `yaml:"interval" validate:"gte=0"`
+		Keep     int           `yaml:"keep" validate:"gte=0"`
+	}
+
+	Schemas struct {
+		RejectUnknownTypes bool          `yaml:"reject_unknown_types"`
+		QuarantineFile     string        `yaml:"quarantine_file"`
+		Events             []EventSchema `yaml:"events" validate:"dive"`
+	}
+
+	EventSchema struct {
+		Type               string        `yaml:"event_type" validate:"required"`
+		AllowUnknownParams bool          `yaml:"allow_unknown_params"`
+		Params             []ParamSchema `yaml:"params" validate:"dive"`
+	}
+
+	ParamSchema struct {
+		Name     string   `yaml:"name" validate:"required"`
+		Type     string   `yaml:"type" validate:"omitempty,oneof=string number integer boolean object array"`
+		Required bool     `yaml:"required"`
+		Enum     []string `yaml:"enum"`
+		Min      *float64 `yaml:"min"`
+		Max      *float64 `yaml:"max"`
 	}
 
 	Aggregator struct {
@@ -35,6 +124,9 @@ type (
 
 const (
 	Version = "VERSION"
+
+	QueueLocal = "local"
+	QueueWAL   = "wal"
 )
 
 func ReadFile(configPath string) (Config, error) {
@@ -1,6 +1,7 @@
 package eventagg
 
 type Event struct {
+	ID     string                 `json:"id,omitempty"`
 	Type   string                 `json:"event_type"`
 	Time   int64                  `json:"ts"`
 	Params map[string]interface{} `json:"params"`
@@ -1,21 +1,30 @@
 module github.com/iahmedov/eventagg
 
+go 1.22
+
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-kit/kit v0.8.0
+	github.com/julienschmidt/httprouter v1.2.0
+	github.com/klauspost/compress v1.18.0
+	github.com/oklog/ulid v1.3.1
+	github.com/pkg/errors v0.8.1
+	github.com/spf13/afero v1.2.2
+	github.com/stretchr/testify v1.3.0
+	golang.org/x/sync v0.0.0-20190227155943-e225da77a7e6
+	gopkg.in/go-playground/validator.v9 v9.26.0
+	gopkg.in/yaml.v2 v2.2.2
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-logfmt/logfmt v0.4.0 // indirect
 	github.com/go-playground/locales v0.12.1 // indirect
 	github.com/go-playground/universal-translator v0.16.0 // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
-	github.com/julienschmidt/httprouter v1.2.0
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/leodido/go-urn v1.1.0 // indirect
-	github.com/pkg/errors v0.8.1
-	github.com/spf13/afero v1.2.2
-	github.com/stretchr/testify v1.3.0
-	golang.org/x/sync v0.0.0-20190227155943-e225da77a7e6
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/text v0.3.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
-	gopkg.in/go-playground/validator.v9 v9.26.0
-	gopkg.in/yaml.v2 v2.2.2
 )
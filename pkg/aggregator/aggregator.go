@@ -2,6 +2,7 @@ package aggregator
 
 import (
 	"fmt"
+	"io"
 	"sync"
 
 	"github.com/iahmedov/eventagg"
@@ -24,6 +25,16 @@ type (
 		View
 	}
 
+	// Snapshotter is optionally implemented by aggregators keeping state
+	// in memory, restored state is continued with events after snapshot.
+	// CheckState reports ErrStateMismatch when state was taken with config
+	// it could not be continued with
+	Snapshotter interface {
+		Snapshot(w io.Writer) error
+		CheckState(r io.Reader) error
+		Restore(r io.Reader) error
+	}
+
 	Config map[string]interface{}
 	Param  struct {
 		Key, Value string
@@ -33,6 +44,17 @@ type (
 	factory func(Config) (Aggregator, error)
 )
 
+const (
+	// KeyAfter and KeyBefore are view params of time range in TimeFormat
+	KeyAfter   = "after"
+	KeyBefore  = "before"
+	TimeFormat = "2006-01-02T15:04:05"
+)
+
+// ErrStateMismatch is returned when snapshot state does not match config
+// of aggregator, such aggregator is backfilled from scratch
+var ErrStateMismatch = errors.New("state does not match aggregator config")
+
 var (
 	mtxAggregators sync.Mutex
 	aggregators    = map[string]factory{}
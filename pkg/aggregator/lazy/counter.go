@@ -2,13 +2,12 @@ package cold
 
 import (
 	"encoding/json"
-	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/iahmedov/eventagg"
 	"github.com/iahmedov/eventagg/pkg/aggregator"
 	"github.com/iahmedov/eventagg/pkg/aggregator/realtime"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
 
 	"github.com/pkg/errors"
 )
@@ -18,41 +17,52 @@ func init() {
 }
 
 const (
-	KeyTimeRangeBefore = "before"
-	KeyTimeRangeAfter  = "after"
-	TimeFormat         = "2006-01-02T15:04:05"
+	KeyTimeRangeBefore = aggregator.KeyBefore
+	KeyTimeRangeAfter  = aggregator.KeyAfter
+	TimeFormat         = aggregator.TimeFormat
 )
 
 type persistenceRangeCountAggregator struct {
-	workerDirs []string
+	dataDir      string
+	workerDirs   []string
+	partitioning *pfile.Partitioning
 }
 
 func newPersistenceRangeCountAggregator(cfg aggregator.Config) (aggregator.Aggregator, error) {
+	dir, folders, partitioning, err := readDataDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &persistenceRangeCountAggregator{
+		dataDir:      dir,
+		workerDirs:   folders,
+		partitioning: partitioning,
+	}, nil
+}
+
+// readDataDir returns data_dir of config with its worker directories and partitioning
+func readDataDir(cfg aggregator.Config) (string, []string, *pfile.Partitioning, error) {
 	dirIfc, ok := cfg["data_dir"]
 	if !ok {
-		return nil, errors.New("data directory not given for persistence based aggregator")
+		return "", nil, nil, errors.New("data directory not given for persistence based aggregator")
 	}
 
 	dir, ok := dirIfc.(string)
 	if !ok {
-		return nil, errors.New("data directory should be string type")
+		return "", nil, nil, errors.New("data directory should be string type")
 	}
 
-	fl, err := os.Open(dir)
+	folders, err := pfile.WorkerDirs(dir)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to open file")
+		return "", nil, nil, errors.Wrap(err, "failed to list worker directories")
 	}
-	folders, err := fl.Readdirnames(0)
+
+	partitioning, err := pfile.ReadPartitioning(dir)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read child directories")
-	}
-	for i := range folders {
-		folders[i] = filepath.Join(dir, folders[i])
+		return "", nil, nil, errors.Wrap(err, "failed to read partitioning")
 	}
-
-	return &persistenceRangeCountAggregator{
-		workerDirs: folders,
-	}, nil
+	return dir, folders, partitioning, nil
 }
 
 func (p *persistenceRangeCountAggregator) Add(ev *eventagg.Event) error {
@@ -63,64 +73,120 @@ func unixToTime(since int64) time.Time {
 	return time.Unix(since, 0)
 }
 
-func (p *persistenceRangeCountAggregator) View(params ...aggregator.Param) (aggregator.Result, error) {
-
-	// range, event type
-	var begin, end *time.Time
+// parseViewRange returns time range and event type of view params,
+// range defaults to everything till now
+func parseViewRange(params []aggregator.Param) (begin, end time.Time, eventType *string, err error) {
+	begin, end = unixToTime(0), time.Now().UTC()
 	for i := range params {
 		switch params[i].Key {
+		case realtime.KeyEventType:
+			eventType = &params[i].Value
 		case KeyTimeRangeAfter:
-			b, err := time.Parse(TimeFormat, params[i].Value)
+			begin, err = time.Parse(TimeFormat, params[i].Value)
 			if err != nil {
-				return nil, errors.Wrap(err, "failed to parse `after` time")
+				return begin, end, nil, errors.Wrap(err, "failed to parse `after` time")
 			}
-			begin = &b
 		case KeyTimeRangeBefore:
-			e, err := time.Parse(TimeFormat, params[i].Value)
+			end, err = time.Parse(TimeFormat, params[i].Value)
 			if err != nil {
-				return nil, errors.Wrap(err, "failed to parse `before` time")
+				return begin, end, nil, errors.Wrap(err, "failed to parse `before` time")
 			}
-			end = &e
 		}
 	}
+	return begin, end, eventType, nil
+}
 
-	if begin == nil {
-		b := unixToTime(0)
-		begin = &b
-	}
-	if end == nil {
-		now := time.Now().UTC()
-		end = &now
+func (p *persistenceRangeCountAggregator) View(params ...aggregator.Param) (aggregator.Result, error) {
+	begin, end, eventType, err := parseViewRange(params)
+	if err != nil {
+		return nil, err
 	}
 
 	results, errs := doParallel(func(dir string) (aggregator.Result, error) {
-		reader, err := newTimeRangeReader(dir, *begin, *end)
+		segments, err := pfile.Segments(dir)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to create time range reader")
+			return nil, errors.Wrap(err, "failed to list segments")
 		}
-		defer reader.Close()
 
-		decoder := json.NewDecoder(reader)
 		agg, err := realtime.NewCountAggregator(nil)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to create count aggregator")
 		}
 
-		count := 0
-		for decoder.More() {
-			var ev eventagg.Event
-			err = decoder.Decode(&ev)
-			if err != nil {
-				return nil, errors.Wrap(err, "failed to decode data")
+		results := []aggregator.Result{}
+		for _, segment := range segments {
+			// segments fully covered by range are answered by summary
+			summary, _ := pfile.ReadSummary(segment)
+			if summary != nil && !summary.Overlaps(begin.Unix(), end.Unix()) {
+				continue
+			}
+			if summary != nil && summary.Covered(begin.Unix(), end.Unix()) {
+				results = append(results, summary.Types)
+				continue
+			}
+
+			if !segmentOverlaps(segment, begin.Unix(), end.Unix()) {
+				continue
+			}
+			if err = addSegmentEvents(segment, begin, end, agg); err != nil {
+				return nil, err
 			}
-			agg.Add(&ev) // tolerate errors here
-			count++
 		}
 
-		return agg.View()
-	}, p.workerDirs...)
+		res, err := agg.View()
+		if err != nil {
+			return nil, err
+		}
+		return mergeCountResult(append(results, res)...), nil
+	}, queryDirs(p.dataDir, p.workerDirs, p.partitioning, eventType)...)
 	_ = errs // skip errors for the sake of results
-	return mergeCountResult(results...), nil
+
+	counts := mergeCountResult(results...)
+	if eventType != nil {
+		return counts.(map[string]int64)[*eventType], nil
+	}
+	return counts, nil
+}
+
+// queryDirs returns directories which could contain events of given type,
+// only matching partition is used when events are partitioned by type
+func queryDirs(dataDir string, workerDirs []string, partitioning *pfile.Partitioning, eventType *string) []string {
+	if eventType == nil || partitioning == nil || partitioning.Key != pfile.PartitionEventType {
+		return workerDirs
+	}
+
+	partitionDir := partitioning.PartitionDir(dataDir, *eventType)
+	dirs := []string{}
+	for _, dir := range workerDirs {
+		if !pfile.IsPartitionDir(dir) || dir == partitionDir {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// addSegmentEvents feeds events of segment within time range to collector,
+// reader of unsorted segment returns events out of range as well
+func addSegmentEvents(segment pfile.Segment, begin, end time.Time, agg aggregator.Collector) error {
+	reader, err := newTimeRangeReader(segment, begin, end)
+	if err != nil {
+		return errors.Wrap(err, "failed to create time range reader")
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	for decoder.More() {
+		var ev eventagg.Event
+		err = decoder.Decode(&ev)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode data")
+		}
+		if ev.Time < begin.Unix() || ev.Time > end.Unix() {
+			continue
+		}
+		agg.Add(&ev) // tolerate errors here
+	}
+	return nil
 }
 
 func mergeCountResult(results ...aggregator.Result) aggregator.Result {
@@ -161,6 +227,9 @@ func doParallel(f func(dir string) (aggregator.Result, error), workerDirs ...str
 
 	results := []aggregator.Result{}
 	errs := []error{}
+	if workers == 0 {
+		return results, errs
+	}
 
 	for {
 		select {
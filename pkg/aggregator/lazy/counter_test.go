@@ -0,0 +1,184 @@
+package cold
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+	"github.com/iahmedov/eventagg/pkg/aggregator/realtime"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSegment writes framed segment with text index
+func writeSegment(t *testing.T, segment pfile.Segment, types []string, ts []int64) {
+	data := []byte("EVAG\x00\x00\x00\x01")
+	index := ""
+	for i := range ts {
+		begin := len(data)
+		data = append(data, record.Encode([]byte(fmt.Sprintf(`{"event_type":"%s","ts":%d}`, types[i], ts[i])))...)
+		index += fmt.Sprintf("%d,%d,%d\n", begin, len(data), ts[i])
+	}
+	require.NoError(t, ioutil.WriteFile(segment.DataPath(), data, 0666))
+	require.NoError(t, ioutil.WriteFile(segment.IndexPath(), []byte(index), 0666))
+}
+
+func TestRangeCountSummaries(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "eventagg-counter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	workerDir := filepath.Join(dataDir, "worker-000000")
+	require.NoError(t, os.Mkdir(workerDir, 0777))
+
+	closed := pfile.Segment{Dir: workerDir, Name: "segment-00000000000000000001"}
+	writeSegment(t, closed, []string{"a", "b"}, []int64{100, 101})
+	// summary differs from events to see which one is used
+	summary, err := json.Marshal(pfile.Summary{MinTs: 100, MaxTs: 101, Count: 2, Types: map[string]int64{"a": 5}})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(closed.SummaryPath(), summary, 0666))
+
+	active := pfile.Segment{Dir: workerDir, Name: "segment-00000000000000000002"}
+	writeSegment(t, active, []string{"c"}, []int64{200})
+
+	agg, err := newPersistenceRangeCountAggregator(aggregator.Config{"data_dir": dataDir})
+	require.NoError(t, err)
+
+	tests := []struct {
+		after, before int64
+		expected      map[string]int64
+	}{
+		// closed segment is covered
+		{50, 150, map[string]int64{"a": 5}},
+		{50, 300, map[string]int64{"a": 5, "c": 1}},
+		// closed segment overlaps partially and is scanned
+		{101, 300, map[string]int64{"b": 1, "c": 1}},
+		{150, 300, map[string]int64{"c": 1}},
+	}
+	for _, tt := range tests {
+		res, err := agg.View(
+			aggregator.Param{Key: KeyTimeRangeAfter, Value: unixToTime(tt.after).UTC().Format(TimeFormat)},
+			aggregator.Param{Key: KeyTimeRangeBefore, Value: unixToTime(tt.before).UTC().Format(TimeFormat)},
+		)
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, res, "range %d-%d", tt.after, tt.before)
+	}
+}
+
+func TestRangeCountShuffled(t *testing.T) {
+	configs := []struct {
+		name string
+		cfg  pfile.Config
+	}{
+		{"framed", pfile.Config{Count: 2, SegmentMaxBytes: 2048}},
+		{"compressed", pfile.Config{Count: 2, SegmentMaxBytes: 2048, Compression: pfile.CompressionZstd, BlockSize: 512}},
+		{"single segment", pfile.Config{Count: 1}},
+	}
+	types := []string{"a", "b", "c"}
+
+	for _, tt := range configs {
+		for seed := int64(1); seed <= 3; seed++ {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, seed), func(t *testing.T) {
+				dataDir, err := ioutil.TempDir("", "eventagg-counter")
+				require.NoError(t, err)
+				defer os.RemoveAll(dataDir)
+
+				// mostly ordered events with late ones
+				rnd := rand.New(rand.NewSource(seed))
+				events := make([]*eventagg.Event, 500)
+				for i := range events {
+					ts := int64(1000 + i)
+					if rnd.Intn(5) == 0 {
+						ts -= int64(rnd.Intn(200))
+					}
+					events[i] = &eventagg.Event{Type: types[rnd.Intn(len(types))], Time: ts}
+				}
+
+				cfg := tt.cfg
+				cfg.DataDir = dataDir
+				persistence, err := pfile.New(cfg, log.NewNopLogger())
+				require.NoError(t, err)
+				for _, ev := range events {
+					require.NoError(t, persistence.Add(ev))
+				}
+				require.NoError(t, persistence.Close())
+
+				agg, err := newPersistenceRangeCountAggregator(aggregator.Config{"data_dir": dataDir})
+				require.NoError(t, err)
+				for i := 0; i < 50; i++ {
+					after := int64(800 + rnd.Intn(800))
+					before := after + int64(rnd.Intn(300))
+
+					expected := map[string]int64{}
+					for _, ev := range events {
+						if ev.Time >= after && ev.Time <= before {
+							expected[ev.Type]++
+						}
+					}
+
+					res, err := agg.View(
+						aggregator.Param{Key: KeyTimeRangeAfter, Value: unixToTime(after).UTC().Format(TimeFormat)},
+						aggregator.Param{Key: KeyTimeRangeBefore, Value: unixToTime(before).UTC().Format(TimeFormat)},
+					)
+					require.NoError(t, err)
+					require.Equal(t, expected, res, "range %d-%d", after, before)
+				}
+			})
+		}
+	}
+}
+
+func TestRangeCountPartitioned(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "eventagg-counter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	// events written before partitioning was enabled
+	workerDir := filepath.Join(dataDir, "worker-000000")
+	require.NoError(t, os.Mkdir(workerDir, 0777))
+	writeSegment(t, pfile.Segment{Dir: workerDir, Name: "segment-1"}, []string{"a", "b"}, []int64{100, 101})
+
+	persistence, err := pfile.New(pfile.Config{DataDir: dataDir, Count: 4, Partition: pfile.PartitionEventType}, log.NewNopLogger())
+	require.NoError(t, err)
+	types := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 100; i++ {
+		require.NoError(t, persistence.Add(&eventagg.Event{Type: types[i%len(types)], Time: int64(200 + i)}))
+	}
+	require.NoError(t, persistence.Close())
+
+	agg, err := newPersistenceRangeCountAggregator(aggregator.Config{"data_dir": dataDir})
+	require.NoError(t, err)
+	rangeCount := agg.(*persistenceRangeCountAggregator)
+	require.Len(t, rangeCount.workerDirs, 5)
+
+	eventType := "a"
+	dirs := queryDirs(dataDir, rangeCount.workerDirs, rangeCount.partitioning, &eventType)
+	require.Len(t, dirs, 2, "round robin dir and single partition")
+
+	tests := []struct {
+		eventType string
+		expected  int64
+	}{
+		{"a", 21},
+		{"b", 21},
+		{"e", 20},
+		{"x", 0},
+	}
+	for _, tt := range tests {
+		res, err := agg.View(
+			aggregator.Param{Key: KeyTimeRangeAfter, Value: unixToTime(0).UTC().Format(TimeFormat)},
+			aggregator.Param{Key: realtime.KeyEventType, Value: tt.eventType},
+		)
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, res, tt.eventType)
+	}
+}
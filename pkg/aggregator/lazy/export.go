@@ -0,0 +1,392 @@
+package cold
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidCursor is returned when export cursor could not be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Exporter reads persisted events of all worker directories
+// merged in ts order
+type Exporter struct {
+	dataDir string
+}
+
+type ExportQuery struct {
+	After, Before time.Time
+	// EventType filters events by type when not empty
+	EventType string
+	// Cursor is returned by previous export, events after it are exported
+	Cursor string
+	Limit  int
+}
+
+func NewExporter(dataDir string) *Exporter {
+	return &Exporter{dataDir: dataDir}
+}
+
+// exportKey orders events, events with the same ts are ordered
+// by their location
+type exportKey struct {
+	Ts      int64  `json:"ts"`
+	Dir     string `json:"dir"`
+	Segment string `json:"segment"`
+	Begin   int64  `json:"begin"`
+	End     int64  `json:"end"`
+}
+
+func (k exportKey) less(o exportKey) bool {
+	switch {
+	case k.Ts != o.Ts:
+		return k.Ts < o.Ts
+	case k.Dir != o.Dir:
+		return k.Dir < o.Dir
+	case k.Segment != o.Segment:
+		return k.Segment < o.Segment
+	case k.Begin != o.Begin:
+		return k.Begin < o.Begin
+	}
+	return k.End < o.End
+}
+
+func encodeCursor(key exportKey) string {
+	content, _ := json.Marshal(key)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func decodeCursor(cursor string) (*exportKey, error) {
+	content, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var key exportKey
+	if err = json.Unmarshal(content, &key); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &key, nil
+}
+
+type exportEvent struct {
+	ev  *eventagg.Event
+	key exportKey
+}
+
+// Export calls f for up to query.Limit events within range in ts order,
+// returns cursor of the next page, empty when there are no more events
+func (e *Exporter) Export(q ExportQuery, f func(ev *eventagg.Event) error) (string, error) {
+	after, before := q.After.Unix(), q.Before.Unix()
+	var cursor *exportKey
+	if q.Cursor != "" {
+		var err error
+		if cursor, err = decodeCursor(q.Cursor); err != nil {
+			return "", err
+		}
+		after = max(after, cursor.Ts)
+	}
+
+	candidates, err := e.candidates(after, before, q.EventType)
+	if err != nil {
+		return "", err
+	}
+
+	streams := &streamHeap{}
+	defer streams.close()
+
+	var last *exportKey
+	exported := 0
+	for {
+		// segments are opened only when their events could be the next ones
+		for len(candidates) > 0 && (streams.Len() == 0 || candidates[0].lower <= (*streams)[0].head.key.Ts) {
+			stream, err := openSegmentStream(candidates[0].segment, after, before, q.EventType)
+			if err != nil {
+				return "", err
+			}
+			candidates = candidates[1:]
+			if stream != nil {
+				heap.Push(streams, stream)
+			}
+		}
+		if streams.Len() == 0 {
+			return "", nil
+		}
+
+		stream := (*streams)[0]
+		current := stream.head
+		if ok, err := stream.advance(); err != nil {
+			return "", err
+		} else if ok {
+			heap.Fix(streams, 0)
+		} else {
+			heap.Pop(streams).(*segmentStream).close()
+		}
+
+		if cursor != nil && !cursor.less(current.key) {
+			continue
+		}
+		if q.Limit > 0 && exported == q.Limit {
+			// there is at least one more event
+			return encodeCursor(*last), nil
+		}
+		if err = f(current.ev); err != nil {
+			return "", err
+		}
+		exported++
+		last = &current.key
+	}
+}
+
+type exportCandidate struct {
+	segment pfile.Segment
+	// lower is the smallest ts segment could have within range
+	lower int64
+}
+
+// candidates returns segments which could contain matching events
+// ordered by the smallest ts they could have
+func (e *Exporter) candidates(after, before int64, eventType string) ([]exportCandidate, error) {
+	workerDirs, err := pfile.WorkerDirs(e.dataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list worker directories")
+	}
+	partitioning, err := pfile.ReadPartitioning(e.dataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read partitioning")
+	}
+	var typeFilter *string
+	if eventType != "" {
+		typeFilter = &eventType
+	}
+
+	candidates := []exportCandidate{}
+	for _, dir := range queryDirs(e.dataDir, workerDirs, partitioning, typeFilter) {
+		segments, err := pfile.Segments(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list segments")
+		}
+
+		for _, segment := range segments {
+			summary, _ := pfile.ReadSummary(segment)
+			if summary != nil {
+				if !summary.Overlaps(after, before) || (eventType != "" && summary.Types[eventType] == 0) {
+					continue
+				}
+				candidates = append(candidates, exportCandidate{segment, max(summary.MinTs, after)})
+				continue
+			}
+			if segmentOverlaps(segment, after, before) {
+				candidates = append(candidates, exportCandidate{segment, after})
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].lower < candidates[j].lower
+	})
+	return candidates, nil
+}
+
+// segmentStream returns matching events of segment in ts order, index
+// entries of unsorted segments are sorted and events are read one by one
+type segmentStream struct {
+	reader    *timeRangeReader
+	key       exportKey
+	after     int64
+	before    int64
+	eventType string
+
+	unsorted bool
+	entries  []pfile.IndexEntry
+	head     exportEvent
+}
+
+// openSegmentStream returns stream positioned at the first matching event,
+// nil when segment has no such events
+func openSegmentStream(segment pfile.Segment, after, before int64, eventType string) (*segmentStream, error) {
+	reader, err := newTimeRangeReader(segment, unixToTime(after), unixToTime(before))
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &segmentStream{
+		reader:    reader,
+		key:       exportKey{Dir: filepath.Base(segment.Dir), Segment: segment.Name},
+		after:     after,
+		before:    before,
+		eventType: eventType,
+	}
+	if segment.Unsorted() {
+		stream.unsorted = true
+		if stream.entries, err = sortedEntries(segment, after, before); err != nil {
+			stream.close()
+			return nil, err
+		}
+	}
+
+	ok, err := stream.advance()
+	if err != nil || !ok {
+		stream.close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// sortedEntries returns index entries of segment within range ordered
+// the same way as export keys, so only positions of events are kept
+// in memory instead of events
+func sortedEntries(segment pfile.Segment, after, before int64) ([]pfile.IndexEntry, error) {
+	content, err := ioutil.ReadFile(segment.IndexPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read index file")
+	}
+
+	entries := []pfile.IndexEntry{}
+	add := func(entry pfile.IndexEntry) {
+		if entry.Ts >= after && entry.Ts <= before {
+			entries = append(entries, entry)
+		}
+	}
+	binaryIndex, err := pfile.IsBinaryIndex(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if binaryIndex {
+		index := pfile.NewIndex(bytes.NewReader(content), int64(len(content)))
+		for i := 0; i < index.Len(); i++ {
+			entry, err := index.Entry(i)
+			if err != nil {
+				return nil, err
+			}
+			add(entry)
+		}
+	} else {
+		// partially written line is skipped
+		for _, line := range bytes.Split(content, []byte{'\n'}) {
+			if entry, err := pfile.ParseTextIndexEntry(line); err == nil {
+				add(entry)
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch {
+		case a.Ts != b.Ts:
+			return a.Ts < b.Ts
+		case a.Begin != b.Begin:
+			return a.Begin < b.Begin
+		}
+		return a.End < b.End
+	})
+	return entries, nil
+}
+
+// read returns the next matching event of reader
+func (s *segmentStream) read() (exportEvent, bool, error) {
+	for {
+		payload, begin, end, err := s.reader.next()
+		if err == io.EOF {
+			return exportEvent{}, false, nil
+		}
+		if err != nil {
+			return exportEvent{}, false, err
+		}
+
+		ev, ok, err := s.decode(payload, begin, end)
+		if err != nil || ok {
+			return ev, ok, err
+		}
+	}
+}
+
+// readSorted returns the next matching event of sorted index entries,
+// corrupted records are skipped
+func (s *segmentStream) readSorted() (exportEvent, bool, error) {
+	for len(s.entries) > 0 {
+		entry := s.entries[0]
+		s.entries = s.entries[1:]
+
+		payload, err := s.reader.readAt(entry)
+		if err == record.ErrChecksum || err == record.ErrTorn {
+			continue
+		}
+		if err != nil {
+			return exportEvent{}, false, err
+		}
+
+		ev, ok, err := s.decode(payload, entry.Begin, entry.End)
+		if err != nil || ok {
+			return ev, ok, err
+		}
+	}
+	return exportEvent{}, false, nil
+}
+
+// decode returns event at position, false when it does not match query
+func (s *segmentStream) decode(payload []byte, begin, end int64) (exportEvent, bool, error) {
+	var ev eventagg.Event
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return exportEvent{}, false, errors.Wrap(err, "failed to decode event")
+	}
+	if ev.Time < s.after || ev.Time > s.before || (s.eventType != "" && ev.Type != s.eventType) {
+		return exportEvent{}, false, nil
+	}
+
+	key := s.key
+	key.Ts, key.Begin, key.End = ev.Time, begin, end
+	return exportEvent{ev: &ev, key: key}, true, nil
+}
+
+// advance moves head to the next event, returns false at the end
+func (s *segmentStream) advance() (bool, error) {
+	var (
+		ev  exportEvent
+		ok  bool
+		err error
+	)
+	if s.unsorted {
+		ev, ok, err = s.readSorted()
+	} else {
+		ev, ok, err = s.read()
+	}
+	s.head = ev
+	return ok, err
+}
+
+func (s *segmentStream) close() {
+	s.reader.Close()
+}
+
+// streamHeap orders streams by their head events
+type streamHeap []*segmentStream
+
+func (h streamHeap) Len() int            { return len(h) }
+func (h streamHeap) Less(i, j int) bool  { return h[i].head.key.less(h[j].head.key) }
+func (h streamHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *streamHeap) Push(x interface{}) { *h = append(*h, x.(*segmentStream)) }
+func (h *streamHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (h *streamHeap) close() {
+	for _, stream := range *h {
+		stream.close()
+	}
+}
@@ -0,0 +1,155 @@
+package cold
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "eventagg-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	for _, dir := range []string{"worker-000000", "worker-000001"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dataDir, dir), 0777))
+	}
+	first := filepath.Join(dataDir, "worker-000000")
+	second := filepath.Join(dataDir, "worker-000001")
+	writeSegment(t, pfile.Segment{Dir: first, Name: "segment-00000000000000000001"},
+		[]string{"a", "b", "a"}, []int64{100, 103, 105})
+	writeSegment(t, pfile.Segment{Dir: first, Name: "segment-00000000000000000002"},
+		[]string{"b", "a"}, []int64{106, 110})
+	writeSegment(t, pfile.Segment{Dir: second, Name: "segment-00000000000000000001"},
+		[]string{"b", "a", "a"}, []int64{101, 103, 108})
+	unsorted := pfile.Segment{Dir: second, Name: "segment-00000000000000000002"}
+	writeSegment(t, unsorted, []string{"b", "a", "b"}, []int64{109, 104, 111})
+	require.NoError(t, ioutil.WriteFile(unsorted.UnsortedPath(), nil, 0666))
+
+	exporter := NewExporter(dataDir)
+	exportAll := func(q ExportQuery) ([]int64, int) {
+		ts := []int64{}
+		pages := 0
+		for {
+			cursor, err := exporter.Export(q, func(ev *eventagg.Event) error {
+				ts = append(ts, ev.Time)
+				return nil
+			})
+			require.NoError(t, err)
+			pages++
+			if cursor == "" {
+				return ts, pages
+			}
+			q.Cursor = cursor
+		}
+	}
+
+	cases := []struct {
+		name      string
+		query     ExportQuery
+		expected  []int64
+		pageCount int
+	}{
+		{
+			name:      "all events",
+			query:     ExportQuery{After: time.Unix(0, 0), Before: time.Unix(200, 0)},
+			expected:  []int64{100, 101, 103, 103, 104, 105, 106, 108, 109, 110, 111},
+			pageCount: 1,
+		},
+		{
+			name:      "range",
+			query:     ExportQuery{After: time.Unix(103, 0), Before: time.Unix(108, 0)},
+			expected:  []int64{103, 103, 104, 105, 106, 108},
+			pageCount: 1,
+		},
+		{
+			name:      "event type",
+			query:     ExportQuery{After: time.Unix(0, 0), Before: time.Unix(200, 0), EventType: "b"},
+			expected:  []int64{101, 103, 106, 109, 111},
+			pageCount: 1,
+		},
+		{
+			name:      "pages with equal ts",
+			query:     ExportQuery{After: time.Unix(0, 0), Before: time.Unix(200, 0), Limit: 3},
+			expected:  []int64{100, 101, 103, 103, 104, 105, 106, 108, 109, 110, 111},
+			pageCount: 4,
+		},
+		{
+			name:      "page per event",
+			query:     ExportQuery{After: time.Unix(0, 0), Before: time.Unix(200, 0), Limit: 1},
+			expected:  []int64{100, 101, 103, 103, 104, 105, 106, 108, 109, 110, 111},
+			pageCount: 11,
+		},
+		{
+			name:      "exact last page",
+			query:     ExportQuery{After: time.Unix(0, 0), Before: time.Unix(200, 0), EventType: "b", Limit: 5},
+			expected:  []int64{101, 103, 106, 109, 111},
+			pageCount: 1,
+		},
+		{
+			name:      "empty",
+			query:     ExportQuery{After: time.Unix(300, 0), Before: time.Unix(400, 0)},
+			expected:  []int64{},
+			pageCount: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ts, pages := exportAll(c.query)
+			require.Equal(t, c.expected, ts)
+			require.Equal(t, c.pageCount, pages)
+		})
+	}
+
+	_, err = exporter.Export(ExportQuery{Cursor: "not a cursor"}, func(*eventagg.Event) error { return nil })
+	require.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestExportUnsortedCompressed(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "eventagg-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	// small blocks, so late events are in earlier blocks
+	persistence, err := pfile.New(pfile.Config{
+		DataDir:     dataDir,
+		Count:       1,
+		Compression: pfile.CompressionZstd,
+		BlockSize:   64,
+	}, log.NewNopLogger())
+	require.NoError(t, err)
+	for _, ts := range []int64{105, 101, 110, 100, 103, 108, 102} {
+		require.NoError(t, persistence.Add(&eventagg.Event{Type: "a", Time: ts}))
+	}
+	require.NoError(t, persistence.Close())
+	dirs, err := pfile.WorkerDirs(dataDir)
+	require.NoError(t, err)
+	segments, err := pfile.Segments(dirs[0])
+	require.NoError(t, err)
+	require.True(t, segments[0].Unsorted())
+
+	exporter := NewExporter(dataDir)
+	ts := []int64{}
+	q := ExportQuery{After: time.Unix(101, 0), Before: time.Unix(108, 0), Limit: 2}
+	for {
+		cursor, err := exporter.Export(q, func(ev *eventagg.Event) error {
+			ts = append(ts, ev.Time)
+			return nil
+		})
+		require.NoError(t, err)
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	require.Equal(t, []int64{101, 102, 103, 105, 108}, ts)
+}
@@ -0,0 +1,108 @@
+package cold
+
+import (
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+	"github.com/iahmedov/eventagg/pkg/aggregator/realtime"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	aggregator.RegisterAggregator("lazy_persistence_range_quantile", newPersistenceRangeQuantileAggregator)
+}
+
+// persistenceRangeQuantileAggregator computes quantiles of persisted events
+// within range the same way realtime_quantile does, sketches of every
+// worker directory are merged
+type persistenceRangeQuantileAggregator struct {
+	cfg          aggregator.Config
+	dataDir      string
+	workerDirs   []string
+	partitioning *pfile.Partitioning
+}
+
+func newPersistenceRangeQuantileAggregator(cfg aggregator.Config) (aggregator.Aggregator, error) {
+	// config is validated before data directory is read
+	if _, err := realtime.NewQuantileAggregator(cfg); err != nil {
+		return nil, err
+	}
+
+	dir, folders, partitioning, err := readDataDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &persistenceRangeQuantileAggregator{
+		cfg:          cfg,
+		dataDir:      dir,
+		workerDirs:   folders,
+		partitioning: partitioning,
+	}, nil
+}
+
+func (p *persistenceRangeQuantileAggregator) Add(ev *eventagg.Event) error {
+	return nil
+}
+
+// View accepts after/before range and params of realtime_quantile view
+func (p *persistenceRangeQuantileAggregator) View(params ...aggregator.Param) (aggregator.Result, error) {
+	begin, end, eventType, err := parseViewRange(params)
+	if err != nil {
+		return nil, err
+	}
+	for _, param := range params {
+		if param.Key != realtime.KeyQuantiles {
+			continue
+		}
+		if _, err = realtime.ParseQuantiles(param.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	results, errs := doParallel(func(dir string) (aggregator.Result, error) {
+		segments, err := pfile.Segments(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list segments")
+		}
+
+		agg, err := realtime.NewQuantileAggregator(p.cfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create quantile aggregator")
+		}
+		for _, segment := range segments {
+			// summaries have no values, overlapping segments are scanned
+			summary, _ := pfile.ReadSummary(segment)
+			if summary != nil && !summary.Overlaps(begin.Unix(), end.Unix()) {
+				continue
+			}
+			if !segmentOverlaps(segment, begin.Unix(), end.Unix()) {
+				continue
+			}
+			if err = addSegmentEvents(segment, begin, end, agg); err != nil {
+				return nil, err
+			}
+		}
+		return agg, nil
+	}, queryDirs(p.dataDir, p.workerDirs, p.partitioning, eventType)...)
+	// quantiles of part of directories would be misleading
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	merged, err := realtime.NewQuantileAggregator(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range results {
+		if err = merged.Merge(res.(*realtime.QuantileAggregator)); err != nil {
+			return nil, errors.Wrap(err, "failed to merge sketches")
+		}
+	}
+	return merged.View(params...)
+}
+
+func (p *persistenceRangeQuantileAggregator) Close() error {
+	return nil
+}
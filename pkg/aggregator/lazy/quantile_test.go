@@ -0,0 +1,80 @@
+package cold
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+	"github.com/iahmedov/eventagg/pkg/aggregator/realtime"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeQuantile(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "eventagg-quantile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	rnd := rand.New(rand.NewSource(1))
+	types := []string{"a", "b"}
+	events := make([]*eventagg.Event, 1000)
+	for i := range events {
+		events[i] = &eventagg.Event{
+			Type:   types[rnd.Intn(len(types))],
+			Time:   int64(1000 + i),
+			Params: map[string]interface{}{"duration_ms": float64(rnd.Intn(5000))},
+		}
+	}
+
+	persistence, err := pfile.New(pfile.Config{DataDir: dataDir, Count: 3, SegmentMaxBytes: 4096}, log.NewNopLogger())
+	require.NoError(t, err)
+	for _, ev := range events {
+		require.NoError(t, persistence.Add(ev))
+	}
+	require.NoError(t, persistence.Close())
+
+	cfg := aggregator.Config{"data_dir": dataDir, realtime.KeyParam: "duration_ms"}
+	agg, err := aggregator.New("lazy_persistence_range_quantile", cfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		after, before int64
+		params        []aggregator.Param
+	}{
+		{900, 3000, nil},
+		{1200, 1500, []aggregator.Param{{Key: realtime.KeyQuantiles, Value: "0.1,0.5,0.99"}}},
+		{1500, 1600, []aggregator.Param{{Key: realtime.KeyEventType, Value: "b"}}},
+		{5000, 6000, nil},
+	}
+	for _, tt := range tests {
+		// realtime aggregator fed with events within range is expected
+		expected, err := realtime.NewQuantileAggregator(cfg)
+		require.NoError(t, err)
+		for _, ev := range events {
+			if ev.Time >= tt.after && ev.Time <= tt.before {
+				require.NoError(t, expected.Add(ev))
+			}
+		}
+		expectedRes, err := expected.View(tt.params...)
+		require.NoError(t, err)
+
+		params := append([]aggregator.Param{
+			{Key: KeyTimeRangeAfter, Value: unixToTime(tt.after).UTC().Format(TimeFormat)},
+			{Key: KeyTimeRangeBefore, Value: unixToTime(tt.before).UTC().Format(TimeFormat)},
+		}, tt.params...)
+		res, err := agg.View(params...)
+		require.NoError(t, err)
+		require.Equal(t, expectedRes, res, "range %d-%d", tt.after, tt.before)
+	}
+
+	_, err = agg.View(aggregator.Param{Key: realtime.KeyQuantiles, Value: "2"})
+	require.Error(t, err)
+
+	_, err = aggregator.New("lazy_persistence_range_quantile", aggregator.Config{"data_dir": dataDir})
+	require.Error(t, err, "param is required")
+}
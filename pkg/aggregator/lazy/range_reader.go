@@ -2,26 +2,50 @@ package cold
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"io"
 	"math"
 	"os"
 	"time"
 
 	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+	"github.com/iahmedov/eventagg/pkg/record"
 
 	"github.com/pkg/errors"
 )
 
-// timeRangeReader implements io.ReadCloser
+// timeRangeReader implements io.ReadCloser, for framed data files
+// it returns payloads of records separated by newline
 type timeRangeReader struct {
 	data *os.File
+	// dataEnd is size of data file when reader was opened
+	dataEnd int64
 
 	begin, end int64
+	framed     bool
+	pending    []byte
+
+	// compressed segments are read block by block, begin and end are
+	// positions of the first and the last blocks, intra positions are
+	// positions of events inside of them
+	compressed           bool
+	done                 bool
+	block                []byte
+	blockSize            int64
+	intraBegin, intraEnd int64
+
+	// events of legacy segments are decoded by next
+	decoder *json.Decoder
+
+	// the last block decompressed by readAt
+	cachedBlock    []byte
+	cachedBlockPos int64
 }
 
-func newTimeRangeReader(dataDir string, start, end time.Time) (*timeRangeReader, error) {
-	dataPath := pfile.DataFilePath(dataDir)
-	indexPath := pfile.IndexFilePath(dataDir)
+func newTimeRangeReader(segment pfile.Segment, start, end time.Time) (*timeRangeReader, error) {
+	dataPath := segment.DataPath()
+	indexPath := segment.IndexPath()
 
 	// data file
 	dataFile, err := os.Open(dataPath)
@@ -43,22 +67,134 @@ func newTimeRangeReader(dataDir string, start, end time.Time) (*timeRangeReader,
 		return nil, errors.Wrap(err, "failed to read index file info")
 	}
 
-	// find range
-	dataFileBegin, dataFileEnd, err := findTimeRange(indexFile,
-		start.Unix(), end.Unix(), indexFileInfo.Size())
+	// find range, unsorted segment is read fully
+	var first, last *triplet
+	if segment.Unsorted() {
+		first, last, err = indexBounds(indexFile, indexFileInfo.Size())
+	} else {
+		first, last, err = findIndexRange(indexFile, start.Unix(), end.Unix(), indexFileInfo.Size())
+	}
 	if err != nil {
 		dataFile.Close()
 		return nil, errors.Wrap(err, "failed to find timed range")
 	}
 
-	if dataFileBegin < dataFileEnd {
-		dataFile.Seek(dataFileBegin, os.SEEK_SET)
+	format, err := pfile.ReadFormat(dataFile)
+	if err != nil {
+		dataFile.Close()
+		return nil, errors.Wrap(err, "failed to read data format")
+	}
+	// data of indexed events is written before index
+	dataFileInfo, err := dataFile.Stat()
+	if err != nil {
+		dataFile.Close()
+		return nil, errors.Wrap(err, "failed to read data file info")
+	}
+
+	tr := &timeRangeReader{
+		data:       dataFile,
+		dataEnd:    dataFileInfo.Size(),
+		framed:     format == pfile.FormatFramed,
+		compressed: format == pfile.FormatCompressed,
 	}
-	return &timeRangeReader{
-		data:  dataFile,
-		begin: dataFileBegin,
-		end:   dataFileEnd,
-	}, nil
+	if first == nil || last == nil {
+		tr.done = true
+		return tr, nil
+	}
+
+	tr.begin, tr.end = first.begin, last.end
+	if tr.compressed {
+		// blocks are read including the last one
+		tr.intraBegin, tr.end, tr.intraEnd = first.end, last.begin, last.end
+		return tr, nil
+	}
+	if tr.begin < tr.end {
+		dataFile.Seek(tr.begin, os.SEEK_SET)
+	}
+	return tr, nil
+}
+
+// tailSize is enough to contain several index lines
+const tailSize = 4096
+
+// segmentOverlaps checks if segment could contain events within time range
+// by first and last entries of its index, segment is not skipped when
+// its bounds could not be read or it is unsorted
+func segmentOverlaps(segment pfile.Segment, bTime, eTime int64) bool {
+	if segment.Unsorted() {
+		return true
+	}
+
+	indexFile, err := os.Open(segment.IndexPath())
+	if err != nil {
+		return true
+	}
+	defer indexFile.Close()
+
+	info, err := indexFile.Stat()
+	if err != nil {
+		return true
+	}
+	if info.Size() == 0 {
+		return false
+	}
+
+	first, last, err := indexBounds(indexFile, info.Size())
+	if err != nil {
+		return true
+	}
+	if first == nil || last == nil {
+		// binary index without entries is empty, text one is unreadable
+		binaryIndex, _ := pfile.IsBinaryIndex(indexFile)
+		return !binaryIndex
+	}
+	return last.ts >= bTime && first.ts <= eTime
+}
+
+// indexBounds returns the first and the last entries of index,
+// nil when there are no such entries
+func indexBounds(indexFile *os.File, size int64) (first, last *triplet, err error) {
+	binaryIndex, err := pfile.IsBinaryIndex(indexFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if binaryIndex {
+		index := pfile.NewIndex(indexFile, size)
+		if index.Len() == 0 {
+			return nil, nil, nil
+		}
+		firstEntry, err := index.Entry(0)
+		if err != nil {
+			return nil, nil, err
+		}
+		lastEntry, err := index.Entry(index.Len() - 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &triplet{firstEntry.Begin, firstEntry.End, firstEntry.Ts},
+			&triplet{lastEntry.Begin, lastEntry.End, lastEntry.Ts}, nil
+	}
+
+	head := make([]byte, min(tailSize, size))
+	if _, err = indexFile.ReadAt(head, 0); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read index head")
+	}
+	tail := make([]byte, min(tailSize, size))
+	if _, err = indexFile.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read index tail")
+	}
+
+	lines := bytes.Split(head, []byte{'\n'})
+	for i := 0; i < len(lines) && first == nil; i++ {
+		first, _ = parseTriplet(lines[i])
+	}
+	// last line without newline could be partially written
+	lines = bytes.Split(tail, []byte{'\n'})
+	lines = lines[:len(lines)-1]
+	for i := len(lines) - 1; i >= 0 && last == nil; i-- {
+		last, _ = parseTriplet(lines[i])
+	}
+	return first, last, nil
 }
 
 func abs(a int64) int64 {
@@ -69,7 +205,56 @@ func abs(a int64) int64 {
 	return a
 }
 
+// findIndexRange returns the first and the last index entries within
+// time range, both binary and text indexes are supported
+func findIndexRange(indexFile *os.File, bTime, eTime int64, size int64) (first, last *triplet, err error) {
+	binaryIndex, err := pfile.IsBinaryIndex(indexFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !binaryIndex {
+		return findTimeRangeEntries(indexFile, bTime, eTime, size)
+	}
+	return findBinaryTimeRange(pfile.NewIndex(indexFile, size), bTime, eTime)
+}
+
+// findBinaryTimeRange finds range by binary search over fixed width entries
+func findBinaryTimeRange(index pfile.Index, bTime, eTime int64) (first, last *triplet, err error) {
+	begin, err := index.Search(bTime)
+	if err != nil {
+		return nil, nil, err
+	}
+	end, err := index.Search(eTime + 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if begin >= end {
+		return nil, nil, nil
+	}
+
+	firstEntry, err := index.Entry(begin)
+	if err != nil {
+		return nil, nil, err
+	}
+	lastEntry, err := index.Entry(end - 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &triplet{firstEntry.Begin, firstEntry.End, firstEntry.Ts},
+		&triplet{lastEntry.Begin, lastEntry.End, lastEntry.Ts}, nil
+}
+
 func findTimeRange(reader io.ReadSeeker, bTime, eTime int64, endPos int64) (beginIdx, endIdx int64, err error) {
+	first, last, err := findTimeRangeEntries(reader, bTime, eTime, endPos)
+	if err != nil || first == nil || last == nil {
+		return 0, 0, err
+	}
+	return first.begin, last.end, nil
+}
+
+// findTimeRangeEntries returns the first and the last index entries within
+// time range, nil when there are no such entries
+func findTimeRangeEntries(reader io.ReadSeeker, bTime, eTime int64, endPos int64) (first, last *triplet, err error) {
 	var smallestTriplet, biggestTriplet *triplet
 	var smallestDiff int64 = math.MaxInt64
 
@@ -79,7 +264,7 @@ func findTimeRange(reader io.ReadSeeker, bTime, eTime int64, endPos int64) (begi
 		mid := begin + (end-begin)/2
 		line, err := getLine(reader, mid)
 		if err != nil {
-			return 0, 0, errors.Wrap(err, "failed to get line")
+			return nil, nil, errors.Wrap(err, "failed to get line")
 		}
 
 		t, err := parseTriplet(line)
@@ -89,7 +274,7 @@ func findTimeRange(reader io.ReadSeeker, bTime, eTime int64, endPos int64) (begi
 			end = end - 1
 			continue
 		case err != nil && err == errInvalidTriplet:
-			return 0, 0, errors.Wrap(err, "failed to read line")
+			return nil, nil, errors.Wrap(err, "failed to read line")
 		}
 
 		if t.ts < bTime {
@@ -109,7 +294,7 @@ func findTimeRange(reader io.ReadSeeker, bTime, eTime int64, endPos int64) (begi
 	}
 	if smallestTriplet == nil {
 		// smallest item in file is bigger than given interval range
-		return 0, 0, nil
+		return nil, nil, nil
 	}
 
 	// find biggest value <= eTime
@@ -119,7 +304,7 @@ func findTimeRange(reader io.ReadSeeker, bTime, eTime int64, endPos int64) (begi
 		mid := begin + (end-begin)/2
 		line, err := getLine(reader, mid)
 		if err != nil {
-			return 0, 0, errors.Wrap(err, "failed to get line")
+			return nil, nil, errors.Wrap(err, "failed to get line")
 		}
 
 		t, err := parseTriplet(line)
@@ -129,7 +314,7 @@ func findTimeRange(reader io.ReadSeeker, bTime, eTime int64, endPos int64) (begi
 			end = end - 1
 			continue
 		case err != nil && err == errInvalidTriplet:
-			return 0, 0, errors.Wrap(err, "failed to read line")
+			return nil, nil, errors.Wrap(err, "failed to read line")
 		}
 
 		if t.ts > eTime {
@@ -149,10 +334,10 @@ func findTimeRange(reader io.ReadSeeker, bTime, eTime int64, endPos int64) (begi
 	}
 	if biggestTriplet == nil {
 		// biggest item in file is less than given interval range
-		return 0, 0, nil
+		return nil, nil, nil
 	}
 
-	return smallestTriplet.begin, biggestTriplet.end, nil
+	return smallestTriplet, biggestTriplet, nil
 }
 
 // getLine reads line where pos belongs to
@@ -212,6 +397,9 @@ func (tr *timeRangeReader) Read(p []byte) (n int, err error) {
 	if tr.data == nil {
 		return 0, io.ErrClosedPipe
 	}
+	if tr.framed || tr.compressed {
+		return tr.readRecords(p)
+	}
 	if tr.begin >= tr.end {
 		return 0, io.EOF
 	}
@@ -225,6 +413,153 @@ func (tr *timeRangeReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+func (tr *timeRangeReader) readRecords(p []byte) (int, error) {
+	if len(tr.pending) == 0 {
+		payload, _, _, err := tr.next()
+		if err != nil {
+			return 0, err
+		}
+		tr.pending = append(payload, '\n')
+	}
+
+	n := copy(p, tr.pending)
+	tr.pending = tr.pending[n:]
+	return n, nil
+}
+
+// next returns the next event within range and its position, parts of
+// position have the same meaning as begin and end of index entries,
+// io.EOF is returned at the end of range
+func (tr *timeRangeReader) next() ([]byte, int64, int64, error) {
+	switch {
+	case tr.data == nil:
+		return nil, 0, 0, io.ErrClosedPipe
+	case tr.framed:
+		return tr.nextFramed()
+	case tr.compressed:
+		return tr.nextCompressed()
+	}
+	return tr.nextLegacy()
+}
+
+func (tr *timeRangeReader) nextFramed() ([]byte, int64, int64, error) {
+	if tr.begin >= tr.end {
+		return nil, 0, 0, io.EOF
+	}
+
+	payload, size, err := record.Read(tr.data, tr.begin, tr.end)
+	if err == record.ErrTorn {
+		// record is being written or torn by crash
+		tr.begin = tr.end
+		return nil, 0, 0, io.EOF
+	}
+	if err == record.ErrChecksum {
+		// corrupted record in the middle of segment is skipped
+		tr.begin += size
+		return tr.nextFramed()
+	}
+	if err != nil {
+		return nil, 0, 0, errors.Wrap(err, "failed to read record")
+	}
+	begin := tr.begin
+	tr.begin += size
+	return payload, begin, tr.begin, nil
+}
+
+// nextCompressed decompresses blocks within range one at a time
+func (tr *timeRangeReader) nextCompressed() ([]byte, int64, int64, error) {
+	for {
+		if tr.done || tr.begin > tr.end || (tr.begin == tr.end && tr.intraBegin > tr.intraEnd) {
+			tr.done = true
+			return nil, 0, 0, io.EOF
+		}
+
+		if tr.block == nil {
+			block, size, err := pfile.ReadBlock(tr.data, tr.begin, tr.dataEnd)
+			if err == record.ErrTorn {
+				// block is being written or torn by crash
+				tr.done = true
+				return nil, 0, 0, io.EOF
+			}
+			if err == record.ErrChecksum {
+				// corrupted block in the middle of segment is skipped
+				tr.begin += size
+				tr.intraBegin = 0
+				continue
+			}
+			if err != nil {
+				return nil, 0, 0, errors.Wrap(err, "failed to read block")
+			}
+			tr.block, tr.blockSize = block, size
+		}
+
+		if tr.intraBegin >= int64(len(tr.block)) {
+			tr.begin += tr.blockSize
+			tr.intraBegin = 0
+			tr.block = nil
+			continue
+		}
+
+		payload, size, err := record.Read(bytes.NewReader(tr.block), tr.intraBegin, int64(len(tr.block)))
+		if err != nil {
+			return nil, 0, 0, errors.Wrap(err, "failed to read record of block")
+		}
+		intraBegin := tr.intraBegin
+		tr.intraBegin += size
+		return payload, tr.begin, intraBegin, nil
+	}
+}
+
+// nextLegacy decodes json events written back to back
+func (tr *timeRangeReader) nextLegacy() ([]byte, int64, int64, error) {
+	if tr.decoder == nil {
+		tr.decoder = json.NewDecoder(io.NewSectionReader(tr.data, tr.begin, max(tr.end-tr.begin, 0)))
+	}
+	if !tr.decoder.More() {
+		return nil, 0, 0, io.EOF
+	}
+
+	begin := tr.begin + tr.decoder.InputOffset()
+	var payload json.RawMessage
+	if err := tr.decoder.Decode(&payload); err != nil {
+		return nil, 0, 0, errors.Wrap(err, "failed to decode event")
+	}
+	return payload, begin, tr.begin + tr.decoder.InputOffset(), nil
+}
+
+// readAt returns event at position of index entry, it is used to read
+// unsorted segments in ts order. Decompressed block is kept until event
+// of another block is read. Corrupted records are reported with
+// record.ErrChecksum
+func (tr *timeRangeReader) readAt(entry pfile.IndexEntry) ([]byte, error) {
+	switch {
+	case tr.data == nil:
+		return nil, io.ErrClosedPipe
+	case tr.framed:
+		payload, _, err := record.Read(tr.data, entry.Begin, tr.dataEnd)
+		return payload, err
+	case tr.compressed:
+		if tr.cachedBlock == nil || tr.cachedBlockPos != entry.Begin {
+			block, _, err := pfile.ReadBlock(tr.data, entry.Begin, tr.dataEnd)
+			if err != nil {
+				return nil, err
+			}
+			tr.cachedBlock, tr.cachedBlockPos = block, entry.Begin
+		}
+		payload, _, err := record.Read(bytes.NewReader(tr.cachedBlock), entry.End, int64(len(tr.cachedBlock)))
+		return payload, err
+	}
+
+	if entry.End < entry.Begin {
+		return nil, pfile.ErrInvalidIndexEntry
+	}
+	payload := make([]byte, entry.End-entry.Begin)
+	if _, err := tr.data.ReadAt(payload, entry.Begin); err != nil {
+		return nil, errors.Wrap(err, "failed to read event")
+	}
+	return payload, nil
+}
+
 func (tr *timeRangeReader) Close() error {
 	if tr.data != nil {
 		tr.data.Close()
@@ -1,6 +1,8 @@
 package cold
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -8,6 +10,7 @@ import (
 	"time"
 
 	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+	"github.com/iahmedov/eventagg/pkg/record"
 
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
@@ -97,10 +100,13 @@ func TestRangeReader(t *testing.T) {
 		"18,20,106",
 	}
 	content := []byte("abcdefghijklmnopqrstuvwxyz")
-	dataDir := "/tmp"
-	dataFile := pfile.DataFilePath(dataDir)
+	dataDir, err := ioutil.TempDir("", "eventagg-range-reader")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	segment := pfile.Segment{Dir: dataDir, Name: "segment-1"}
+	dataFile := segment.DataPath()
 	indexData := []byte(strings.Join(ranges, "\n"))
-	indexFile := pfile.IndexFilePath(dataDir)
+	indexFile := segment.IndexPath()
 
 	require.NoError(t, afero.WriteFile(appFS, indexFile, indexData, 0777))
 	require.NoError(t, afero.WriteFile(appFS, dataFile, content, 0777))
@@ -108,7 +114,7 @@ func TestRangeReader(t *testing.T) {
 	time.Now().Unix()
 
 	// time
-	readCloser, err := newTimeRangeReader(dataDir, unixToTime(90), unixToTime(105))
+	readCloser, err := newTimeRangeReader(segment, unixToTime(90), unixToTime(105))
 	require.NoError(t, err)
 	defer readCloser.Close()
 
@@ -117,3 +123,149 @@ func TestRangeReader(t *testing.T) {
 	// range to read: 1-18
 	require.Equal(t, []byte("bcdefghijklmnopqr"), content)
 }
+
+func TestSegmentOverlaps(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "eventagg-range-reader")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	segment := pfile.Segment{Dir: dataDir, Name: "segment-1"}
+	index := "0,10,100\n10,20,105\n20,30,110\n30,40,12"
+	require.NoError(t, ioutil.WriteFile(segment.IndexPath(), []byte(index), 0666))
+
+	cases := []struct {
+		begin, end int64
+		overlaps   bool
+	}{
+		{90, 99, false},
+		{90, 100, true},
+		{101, 104, true},
+		{110, 120, true},
+		{111, 120, false},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.overlaps, segmentOverlaps(segment, c.begin, c.end), "%d-%d", c.begin, c.end)
+	}
+
+	empty := pfile.Segment{Dir: dataDir, Name: "segment-2"}
+	require.NoError(t, ioutil.WriteFile(empty.IndexPath(), nil, 0666))
+	require.False(t, segmentOverlaps(empty, 0, 1000))
+
+	missing := pfile.Segment{Dir: dataDir, Name: "segment-3"}
+	require.True(t, segmentOverlaps(missing, 0, 1000))
+}
+
+func TestFramedRangeReader(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "eventagg-range-reader")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	// header, then records of 3 events and torn record
+	data := []byte("EVAG\x00\x00\x00\x01")
+	index := ""
+	for i, ts := range []int64{100, 101, 102} {
+		begin := len(data)
+		data = append(data, record.Encode([]byte(fmt.Sprintf(`{"event_type":"e%d","ts":%d}`, i, ts)))...)
+		index += fmt.Sprintf("%d,%d,%d\n", begin, len(data), ts)
+	}
+	data = append(data, record.Encode([]byte(`{"ts":103}`))[:5]...)
+
+	segment := pfile.Segment{Dir: dataDir, Name: "segment-1"}
+	require.NoError(t, ioutil.WriteFile(segment.DataPath(), data, 0666))
+	require.NoError(t, ioutil.WriteFile(segment.IndexPath(), []byte(index), 0666))
+
+	// the same range is read with text and binary index
+	for _, migrate := range []bool{false, true} {
+		if migrate {
+			migrated, err := pfile.MigrateIndex(segment)
+			require.NoError(t, err)
+			require.True(t, migrated)
+		}
+
+		reader, err := newTimeRangeReader(segment, unixToTime(101), unixToTime(110))
+		require.NoError(t, err)
+
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "{\"event_type\":\"e1\",\"ts\":101}\n{\"event_type\":\"e2\",\"ts\":102}\n", string(content))
+		reader.Close()
+	}
+}
+
+func TestCompressedRangeReader(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "eventagg-range-reader")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	// header, then blocks of [100, 101], [102, 103] and [104]
+	data := []byte("EVAG\x00\x00\x00\x02")
+	index := ""
+	for _, blockTs := range [][]int64{{100, 101}, {102, 103}, {104}} {
+		blockPos := len(data)
+		block := []byte{}
+		for _, ts := range blockTs {
+			index += fmt.Sprintf("%d,%d,%d\n", blockPos, len(block), ts)
+			block = append(block, record.Encode([]byte(fmt.Sprintf(`{"ts":%d}`, ts)))...)
+		}
+		data = append(data, pfile.EncodeBlock(block)...)
+	}
+
+	segment := pfile.Segment{Dir: dataDir, Name: "segment-1"}
+	require.NoError(t, ioutil.WriteFile(segment.DataPath(), data, 0666))
+	require.NoError(t, ioutil.WriteFile(segment.IndexPath(), []byte(index), 0666))
+
+	tests := []struct {
+		start, end int64
+		expected   string
+	}{
+		{101, 103, "{\"ts\":101}\n{\"ts\":102}\n{\"ts\":103}\n"},
+		{100, 100, "{\"ts\":100}\n"},
+		{103, 110, "{\"ts\":103}\n{\"ts\":104}\n"},
+		{105, 110, ""},
+	}
+	for _, tt := range tests {
+		reader, err := newTimeRangeReader(segment, unixToTime(tt.start), unixToTime(tt.end))
+		require.NoError(t, err)
+
+		content, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, string(content))
+		reader.Close()
+	}
+}
+
+func BenchmarkFindTimeRange(b *testing.B) {
+	dataDir, err := ioutil.TempDir("", "eventagg-range-reader")
+	require.NoError(b, err)
+	defer os.RemoveAll(dataDir)
+
+	const entries = 100000
+	index := bytes.Buffer{}
+	for i := 0; i < entries; i++ {
+		fmt.Fprintf(&index, "%d,%d,%d\n", 8+i*40, 8+(i+1)*40, 1000000+i)
+	}
+	segment := pfile.Segment{Dir: dataDir, Name: "segment-1"}
+	require.NoError(b, ioutil.WriteFile(segment.IndexPath(), index.Bytes(), 0666))
+
+	run := func(b *testing.B) {
+		indexFile, err := os.Open(segment.IndexPath())
+		require.NoError(b, err)
+		defer indexFile.Close()
+		info, err := indexFile.Stat()
+		require.NoError(b, err)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			start := int64(1000000 + i%entries)
+			first, last, err := findIndexRange(indexFile, start, start+100, info.Size())
+			if err != nil || first == nil || last == nil {
+				b.Fatal("range not found", err)
+			}
+		}
+	}
+
+	b.Run("text", run)
+	_, err = pfile.MigrateIndex(segment)
+	require.NoError(b, err)
+	b.Run("binary", run)
+}
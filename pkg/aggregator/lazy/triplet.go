@@ -1,10 +1,7 @@
 package cold
 
 import (
-	"strconv"
-	"strings"
-
-	"github.com/pkg/errors"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
 )
 
 type triplet struct {
@@ -12,33 +9,17 @@ type triplet struct {
 }
 
 var (
-	errNotATriplet    = errors.New("not a triplet")
-	errInvalidTriplet = errors.New("invalid triplet format")
+	errNotATriplet    = pfile.ErrNotIndexEntry
+	errInvalidTriplet = pfile.ErrInvalidIndexEntry
 )
 
+// parseTriplet parses line of text index, see pfile.ParseTextIndexEntry
 func parseTriplet(data []byte) (*triplet, error) {
-	str := string(data)
-	splitted := strings.Split(str, ",")
-	if len(splitted) != 3 {
-		return nil, errNotATriplet
-	}
-
-	begin, err := strconv.ParseInt(splitted[0], 10, 64)
-	if err != nil {
-		return nil, errInvalidTriplet
-	}
-
-	end, err := strconv.ParseInt(splitted[1], 10, 64)
+	entry, err := pfile.ParseTextIndexEntry(data)
 	if err != nil {
-		return nil, errInvalidTriplet
+		return nil, err
 	}
-
-	ts, err := strconv.ParseInt(splitted[2], 10, 64)
-	if err != nil {
-		return nil, errInvalidTriplet
-	}
-
-	return &triplet{begin, end, ts}, nil
+	return &triplet{entry.Begin, entry.End, entry.Ts}, nil
 }
 
 func (t1 *triplet) isSmaller(t2 *triplet) bool {
@@ -1,6 +1,7 @@
 package realtime
 
 import (
+	"io"
 	"sync"
 
 	"github.com/iahmedov/eventagg"
@@ -9,8 +10,9 @@ import (
 
 type (
 	countAggregator struct {
-		mtx    sync.Mutex
-		counts map[string]int64
+		mtx      sync.Mutex
+		grouping *grouping
+		counts   map[string]int64
 	}
 )
 
@@ -20,30 +22,79 @@ func init() {
 	aggregator.RegisterAggregator("realtime_count", NewCountAggregator)
 }
 
-func NewCountAggregator(aggregator.Config) (aggregator.Aggregator, error) {
+func NewCountAggregator(cfg aggregator.Config) (aggregator.Aggregator, error) {
+	grouping, err := newGrouping(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &countAggregator{
-		counts: map[string]int64{},
+		grouping: grouping,
+		counts:   map[string]int64{},
 	}, nil
 }
 
 func (c *countAggregator) Add(ev *eventagg.Event) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	c.counts[ev.Type] = c.counts[ev.Type] + 1
+	key := c.grouping.key(ev.Type, ev.Params)
+	c.counts[key] = c.counts[key] + 1
 	return nil
 }
 
+// View returns counts by event type, or count of single event type given as
+// event_type param. Counts of groups matching params are returned with group_by
 func (c *countAggregator) View(params ...aggregator.Param) (aggregator.Result, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.grouping.grouped() {
+		return c.grouping.groups(c.grouping.filters(params), func(key string) (interface{}, bool) {
+			count, ok := c.counts[key]
+			return count, ok
+		}), nil
+	}
+
 	for _, p := range params {
 		if p.Key == KeyEventType {
-			c.mtx.Lock()
-			return func() (aggregator.Result, error) {
-				defer c.mtx.Unlock()
-				return c.counts[p.Value], nil
-			}()
+			return c.counts[p.Value], nil
 		}
 	}
-	return c.counts, nil
+	counts := make(map[string]int64, len(c.counts))
+	for t, count := range c.counts {
+		counts[t] = count
+	}
+	return counts, nil
+}
+
+func (c *countAggregator) Snapshot(w io.Writer) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.grouping.snapshot(w, c.counts)
+}
+
+func (c *countAggregator) CheckState(r io.Reader) error {
+	return c.grouping.unwrap(r, nil)
+}
+
+func (c *countAggregator) Restore(r io.Reader) error {
+	counts := map[string]int64{}
+	if err := c.grouping.unwrap(r, &counts); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.grouping.restore(keys); err != nil {
+		return err
+	}
+	c.counts = counts
+	return nil
 }
 
 func (c *countAggregator) Close() error {
@@ -1,6 +1,7 @@
 package realtime
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 
@@ -11,7 +12,7 @@ import (
 )
 
 func TestCountAgg(t *testing.T) {
-	agg, err := newCountAggregator(aggregator.Config{})
+	agg, err := NewCountAggregator(aggregator.Config{})
 	require.NoError(t, err)
 
 	for i := 0; i < 105; i++ {
@@ -41,3 +42,24 @@ func TestCountAgg(t *testing.T) {
 		})
 	}
 }
+
+func TestCountSnapshot(t *testing.T) {
+	agg, err := NewCountAggregator(aggregator.Config{})
+	require.NoError(t, err)
+	for _, eventType := range []string{"a", "b", "a"} {
+		require.NoError(t, agg.Add(&eventagg.Event{Type: eventType}))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, agg.(aggregator.Snapshotter).Snapshot(&buf))
+
+	restored, err := NewCountAggregator(aggregator.Config{})
+	require.NoError(t, err)
+	require.NoError(t, restored.Add(&eventagg.Event{Type: "c"}))
+	require.NoError(t, restored.(aggregator.Snapshotter).Restore(&buf))
+	require.NoError(t, restored.Add(&eventagg.Event{Type: "a"}))
+
+	res, err := restored.View()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"a": 3, "b": 1}, res)
+}
@@ -0,0 +1,220 @@
+package realtime
+
+import (
+	"io"
+	"math"
+	"sync"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+	"github.com/iahmedov/eventagg/pkg/sketch"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// distinctAggregator estimates count of distinct values of param
+	// with hyperloglog sketch per group
+	distinctAggregator struct {
+		param     string
+		precision uint8
+
+		mtx      sync.Mutex
+		grouping *grouping
+		sketches map[string]*sketch.HyperLogLog
+	}
+
+	// distinctEstimate is estimated count with its standard error,
+	// actual count is within estimate±error_bound in ~68% of cases
+	distinctEstimate struct {
+		Estimate   uint64  `json:"estimate"`
+		ErrorBound float64 `json:"error_bound"`
+	}
+
+	// groupedDistinctResult has estimate of every group and of all of
+	// them together, values seen in several groups are counted once in total
+	groupedDistinctResult struct {
+		Groups []groupValue      `json:"groups"`
+		Total  *distinctEstimate `json:"total"`
+	}
+)
+
+// KeyPrecision is config key of hyperloglog precision
+const KeyPrecision = "precision"
+
+func init() {
+	aggregator.RegisterAggregator("realtime_distinct", NewDistinctAggregator)
+}
+
+func NewDistinctAggregator(cfg aggregator.Config) (aggregator.Aggregator, error) {
+	param, ok := cfg[KeyParam].(string)
+	if !ok || param == "" {
+		return nil, errors.New("param should be non empty string")
+	}
+
+	precision := sketch.DefaultPrecision
+	switch p := cfg[KeyPrecision].(type) {
+	case nil:
+	case int:
+		precision = p
+	case float64:
+		precision = int(p)
+	default:
+		return nil, errors.New("precision should be number")
+	}
+	if precision < sketch.MinPrecision || precision > sketch.MaxPrecision {
+		return nil, errors.Errorf("precision should be in range [%d, %d]", sketch.MinPrecision, sketch.MaxPrecision)
+	}
+
+	grouping, err := newGrouping(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &distinctAggregator{
+		param:     param,
+		precision: uint8(precision),
+		grouping:  grouping,
+		sketches:  map[string]*sketch.HyperLogLog{},
+	}, nil
+}
+
+func newDistinctEstimate(h *sketch.HyperLogLog) distinctEstimate {
+	estimate := h.Estimate()
+	return distinctEstimate{
+		Estimate:   estimate,
+		ErrorBound: math.Ceil(float64(estimate) * h.RelativeError()),
+	}
+}
+
+// Add adds param value of event to sketch, events without param are ignored
+func (a *distinctAggregator) Add(ev *eventagg.Event) error {
+	raw, ok := ev.Params[a.param]
+	if !ok || raw == nil {
+		return nil
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	key := a.grouping.key(ev.Type, ev.Params)
+	h, ok := a.sketches[key]
+	if !ok {
+		h, _ = sketch.NewHyperLogLog(a.precision)
+		a.sketches[key] = h
+	}
+	h.Add([]byte(paramString(raw)))
+	return nil
+}
+
+// View returns estimates by event type, or estimate of single event type
+// given as event_type param. Estimates of groups matching params and their
+// total are returned with group_by
+func (a *distinctAggregator) View(params ...aggregator.Param) (aggregator.Result, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.grouping.grouped() {
+		return a.viewGroups(params), nil
+	}
+
+	for _, p := range params {
+		if p.Key != KeyEventType {
+			continue
+		}
+		h, ok := a.sketches[p.Value]
+		if !ok {
+			return distinctEstimate{}, nil
+		}
+		return newDistinctEstimate(h), nil
+	}
+
+	res := make(map[string]distinctEstimate, len(a.sketches))
+	for t, h := range a.sketches {
+		res[t] = newDistinctEstimate(h)
+	}
+	return res, nil
+}
+
+func (a *distinctAggregator) viewGroups(params []aggregator.Param) groupedDistinctResult {
+	total, _ := sketch.NewHyperLogLog(a.precision)
+	res := groupedDistinctResult{}
+	res.Groups = a.grouping.groups(a.grouping.filters(params), func(key string) (interface{}, bool) {
+		h, ok := a.sketches[key]
+		if !ok {
+			return nil, false
+		}
+		total.Merge(h)
+		return newDistinctEstimate(h), true
+	})
+	estimate := newDistinctEstimate(total)
+	res.Total = &estimate
+	return res
+}
+
+// Snapshot encodes sketches by group
+func (a *distinctAggregator) Snapshot(w io.Writer) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	state := make(map[string][]byte, len(a.sketches))
+	for key, h := range a.sketches {
+		content, err := h.MarshalBinary()
+		if err != nil {
+			return errors.Wrap(err, "failed to encode sketch")
+		}
+		state[key] = content
+	}
+	return a.grouping.snapshot(w, state)
+}
+
+// decodeState returns sketches by group, sketches of different
+// precision are ErrStateMismatch
+func (a *distinctAggregator) decodeState(r io.Reader) (map[string]*sketch.HyperLogLog, error) {
+	state := map[string][]byte{}
+	if err := a.grouping.unwrap(r, &state); err != nil {
+		return nil, err
+	}
+
+	sketches := make(map[string]*sketch.HyperLogLog, len(state))
+	for key, content := range state {
+		h := &sketch.HyperLogLog{}
+		if err := h.UnmarshalBinary(content); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode sketch of %s", key)
+		}
+		if h.Precision() != a.precision {
+			return nil, aggregator.ErrStateMismatch
+		}
+		sketches[key] = h
+	}
+	return sketches, nil
+}
+
+func (a *distinctAggregator) CheckState(r io.Reader) error {
+	_, err := a.decodeState(r)
+	return err
+}
+
+// Restore replaces sketches with snapshot ones, snapshot of aggregator
+// with different precision is rejected
+func (a *distinctAggregator) Restore(r io.Reader) error {
+	sketches, err := a.decodeState(r)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(sketches))
+	for key := range sketches {
+		keys = append(keys, key)
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if err := a.grouping.restore(keys); err != nil {
+		return err
+	}
+	a.sketches = sketches
+	return nil
+}
+
+func (a *distinctAggregator) Close() error {
+	return nil
+}
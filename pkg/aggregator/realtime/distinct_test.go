@@ -0,0 +1,99 @@
+package realtime
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistinctAggregator(t *testing.T) {
+	agg, err := aggregator.New("realtime_distinct", aggregator.Config{KeyParam: "user_id"})
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		// every user is seen several times
+		for j := 0; j < 3; j++ {
+			require.NoError(t, agg.Add(&eventagg.Event{Type: "login", Params: map[string]interface{}{"user_id": fmt.Sprintf("u%d", i)}}))
+		}
+	}
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "logout", Params: map[string]interface{}{"user_id": float64(7)}}))
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "logout", Params: map[string]interface{}{"user_id": "7"}}))
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "logout", Params: map[string]interface{}{}}))
+
+	res, err := agg.View()
+	require.NoError(t, err)
+	estimates := res.(map[string]distinctEstimate)
+	require.Len(t, estimates, 2)
+	require.InDelta(t, 1000, estimates["login"].Estimate, 3*estimates["login"].ErrorBound)
+	require.True(t, estimates["login"].ErrorBound > 0)
+	require.Equal(t, uint64(1), estimates["logout"].Estimate)
+
+	res, err = agg.View(aggregator.Param{Key: KeyEventType, Value: "unknown"})
+	require.NoError(t, err)
+	require.Equal(t, distinctEstimate{}, res)
+
+	var buf bytes.Buffer
+	require.NoError(t, agg.(aggregator.Snapshotter).Snapshot(&buf))
+	restored, err := aggregator.New("realtime_distinct", aggregator.Config{KeyParam: "user_id"})
+	require.NoError(t, err)
+	content := buf.Bytes()
+	require.NoError(t, restored.(aggregator.Snapshotter).Restore(bytes.NewReader(content)))
+	restoredRes, err := restored.View()
+	require.NoError(t, err)
+	require.Equal(t, estimates, restoredRes)
+
+	// snapshot of other precision is skipped instead of failing restore
+	other, err := aggregator.New("realtime_distinct", aggregator.Config{KeyParam: "user_id", KeyPrecision: 10})
+	require.NoError(t, err)
+	require.Equal(t, aggregator.ErrStateMismatch, other.(aggregator.Snapshotter).CheckState(bytes.NewReader(content)))
+	require.Equal(t, aggregator.ErrStateMismatch, other.(aggregator.Snapshotter).Restore(bytes.NewReader(content)))
+}
+
+func TestDistinctAggregatorGroups(t *testing.T) {
+	agg, err := aggregator.New("realtime_distinct", aggregator.Config{
+		KeyParam:   "user_id",
+		KeyGroupBy: []interface{}{"country"},
+	})
+	require.NoError(t, err)
+
+	add := func(country, user string) {
+		require.NoError(t, agg.Add(&eventagg.Event{Type: "login", Params: map[string]interface{}{"country": country, "user_id": user}}))
+	}
+	add("DE", "a")
+	add("DE", "b")
+	add("US", "b")
+	add("US", "c")
+
+	res, err := agg.View()
+	require.NoError(t, err)
+	grouped := res.(groupedDistinctResult)
+	require.Len(t, grouped.Groups, 2)
+	require.Equal(t, map[string]string{KeyEventType: "login", "country": "DE"}, grouped.Groups[0].Group)
+	require.Equal(t, uint64(2), grouped.Groups[0].Value.(distinctEstimate).Estimate)
+	// user seen in both groups is counted once
+	require.Equal(t, uint64(3), grouped.Total.Estimate)
+
+	res, err = agg.View(aggregator.Param{Key: "country", Value: "US"})
+	require.NoError(t, err)
+	grouped = res.(groupedDistinctResult)
+	require.Len(t, grouped.Groups, 1)
+	require.Equal(t, uint64(2), grouped.Total.Estimate)
+}
+
+func TestDistinctAggregatorConfig(t *testing.T) {
+	cases := []aggregator.Config{
+		{},
+		{KeyParam: ""},
+		{KeyParam: "user_id", KeyPrecision: 3},
+		{KeyParam: "user_id", KeyPrecision: "high"},
+	}
+	for _, cfg := range cases {
+		_, err := aggregator.New("realtime_distinct", cfg)
+		require.Error(t, err, "config: %v", cfg)
+	}
+}
@@ -0,0 +1,284 @@
+package realtime
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// grouping buckets events by tuple of event type and values of group_by
+	// params. Key of bucket is event type when there is no group_by, json
+	// array of tuple otherwise. New buckets over cardinality cap are
+	// collapsed into other bucket
+	grouping struct {
+		dims      []string
+		maxGroups int
+		// tuples of known buckets by key
+		tuples map[string][]string
+	}
+
+	// groupedState is snapshot state of aggregator along with dimensions
+	// it was grouped by, so state of another grouping is not restored
+	groupedState struct {
+		Dims  []string        `json:"dims"`
+		State json.RawMessage `json:"state"`
+	}
+
+	// groupValue is aggregated value of single bucket
+	groupValue struct {
+		Group map[string]string `json:"group"`
+		Value interface{}       `json:"value"`
+	}
+)
+
+const (
+	// KeyGroupBy is config key of event params events are grouped by
+	KeyGroupBy = "group_by"
+	// KeyMaxGroups is config key of cardinality cap
+	KeyMaxGroups = "max_groups"
+	// OtherGroup is value of every dimension of overflow bucket
+	OtherGroup = "__other__"
+
+	// DefaultMaxGroups limits buckets of aggregators with group_by
+	DefaultMaxGroups = 10000
+)
+
+func newGrouping(cfg aggregator.Config) (*grouping, error) {
+	g := &grouping{
+		dims:   []string{KeyEventType},
+		tuples: map[string][]string{},
+	}
+
+	switch groupBy := cfg[KeyGroupBy].(type) {
+	case nil:
+	case []string:
+		g.dims = append(g.dims, groupBy...)
+	case []interface{}:
+		for _, p := range groupBy {
+			param, ok := p.(string)
+			if !ok {
+				return nil, errors.New("group_by should be list of param names")
+			}
+			g.dims = append(g.dims, param)
+		}
+	default:
+		return nil, errors.New("group_by should be list of param names")
+	}
+	for i, dim := range g.dims {
+		if dim == "" || (i > 0 && dim == KeyEventType) {
+			return nil, errors.Errorf("invalid group_by param: %q", dim)
+		}
+	}
+
+	if g.grouped() {
+		g.maxGroups = DefaultMaxGroups
+	}
+	switch maxGroups := cfg[KeyMaxGroups].(type) {
+	case nil:
+	case int:
+		g.maxGroups = maxGroups
+	case float64:
+		g.maxGroups = int(maxGroups)
+	default:
+		return nil, errors.New("max_groups should be number")
+	}
+	if g.maxGroups < 0 {
+		return nil, errors.New("max_groups should not be negative")
+	}
+	return g, nil
+}
+
+// grouped reports if events are grouped by params besides event type
+func (g *grouping) grouped() bool {
+	return len(g.dims) > 1
+}
+
+// paramString converts json value of param to group value,
+// missing param is empty string
+func paramString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	content, _ := json.Marshal(v)
+	return string(content)
+}
+
+func (g *grouping) encode(tuple []string) string {
+	if !g.grouped() {
+		return tuple[0]
+	}
+	content, _ := json.Marshal(tuple)
+	return string(content)
+}
+
+func (g *grouping) decode(key string) ([]string, error) {
+	if !g.grouped() {
+		return []string{key}, nil
+	}
+
+	var tuple []string
+	if err := json.Unmarshal([]byte(key), &tuple); err != nil || len(tuple) != len(g.dims) {
+		return nil, errors.Errorf("invalid group key: %s", key)
+	}
+	return tuple, nil
+}
+
+// key returns bucket of event, registering it while cap is not reached
+func (g *grouping) key(eventType string, params map[string]interface{}) string {
+	tuple := make([]string, len(g.dims))
+	tuple[0] = eventType
+	for i := 1; i < len(g.dims); i++ {
+		tuple[i] = paramString(params[g.dims[i]])
+	}
+
+	return g.register(g.encode(tuple), tuple)
+}
+
+func (g *grouping) register(key string, tuple []string) string {
+	if _, ok := g.tuples[key]; ok {
+		return key
+	}
+	if g.maxGroups > 0 && len(g.tuples) >= g.maxGroups {
+		return g.otherKey()
+	}
+	g.tuples[key] = tuple
+	return key
+}
+
+// merge registers bucket of another aggregator with the same config,
+// returns key of bucket its state should be merged into
+func (g *grouping) merge(key string) (string, error) {
+	tuple, err := g.decode(key)
+	if err != nil {
+		return "", err
+	}
+	return g.register(key, tuple), nil
+}
+
+func (g *grouping) otherTuple() []string {
+	tuple := make([]string, len(g.dims))
+	for i := range tuple {
+		tuple[i] = OtherGroup
+	}
+	return tuple
+}
+
+func (g *grouping) otherKey() string {
+	tuple := g.otherTuple()
+	key := g.encode(tuple)
+	g.tuples[key] = tuple
+	return key
+}
+
+// snapshot encodes state along with dimensions of grouping
+func (g *grouping) snapshot(w io.Writer, state interface{}) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode state")
+	}
+	return errors.Wrap(json.NewEncoder(w).Encode(groupedState{Dims: g.dims, State: content}), "failed to encode state")
+}
+
+// unwrap decodes state encoded by snapshot, state of another grouping
+// or of old format without dimensions is ErrStateMismatch
+func (g *grouping) unwrap(r io.Reader, state interface{}) error {
+	var grouped groupedState
+	if err := json.NewDecoder(r).Decode(&grouped); err != nil {
+		return errors.Wrap(err, "failed to decode state")
+	}
+	if len(grouped.Dims) != len(g.dims) {
+		return aggregator.ErrStateMismatch
+	}
+	for i, dim := range g.dims {
+		if grouped.Dims[i] != dim {
+			return aggregator.ErrStateMismatch
+		}
+	}
+	if state == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(grouped.State, state), "failed to decode state")
+}
+
+// restore registers buckets of restored state
+func (g *grouping) restore(keys []string) error {
+	g.tuples = map[string][]string{}
+	for _, key := range keys {
+		tuple, err := g.decode(key)
+		if err != nil {
+			return err
+		}
+		g.tuples[key] = tuple
+	}
+	return nil
+}
+
+// filters returns view params matching dimensions
+func (g *grouping) filters(params []aggregator.Param) map[string]string {
+	filters := map[string]string{}
+	for _, p := range params {
+		for _, dim := range g.dims {
+			if p.Key == dim {
+				filters[dim] = p.Value
+			}
+		}
+	}
+	return filters
+}
+
+// match checks bucket against filters
+func (g *grouping) match(key string, filters map[string]string) bool {
+	tuple := g.tuples[key]
+	for i, dim := range g.dims {
+		if value, ok := filters[dim]; ok && tuple[i] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// groups returns buckets matching filters with their values ordered
+// by key, overflow bucket is the last one
+func (g *grouping) groups(filters map[string]string, value func(key string) (interface{}, bool)) []groupValue {
+	other := g.encode(g.otherTuple())
+	keys := make([]string, 0, len(g.tuples))
+	for key := range g.tuples {
+		if g.match(key, filters) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i] == other || keys[j] == other {
+			return keys[j] == other && keys[i] != other
+		}
+		return keys[i] < keys[j]
+	})
+
+	groups := make([]groupValue, 0, len(keys))
+	for _, key := range keys {
+		v, ok := value(key)
+		if !ok {
+			continue
+		}
+
+		group := make(map[string]string, len(g.dims))
+		for i, dim := range g.dims {
+			group[dim] = g.tuples[key][i]
+		}
+		groups = append(groups, groupValue{Group: group, Value: v})
+	}
+	return groups
+}
@@ -0,0 +1,176 @@
+package realtime
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+
+	"github.com/stretchr/testify/require"
+)
+
+func groupEvent(eventType, country, platform string) *eventagg.Event {
+	params := map[string]interface{}{"country": country, "amount": float64(len(country))}
+	if platform != "" {
+		params["platform"] = platform
+	}
+	return &eventagg.Event{Type: eventType, Params: params}
+}
+
+func TestGroupedCount(t *testing.T) {
+	agg, err := NewCountAggregator(aggregator.Config{
+		KeyGroupBy:   []interface{}{"country", "platform"},
+		KeyMaxGroups: 4,
+	})
+	require.NoError(t, err)
+
+	for _, ev := range []*eventagg.Event{
+		groupEvent("click", "DE", "ios"),
+		groupEvent("click", "DE", "ios"),
+		groupEvent("click", "DE", "android"),
+		groupEvent("click", "US", "ios"),
+		groupEvent("view", "DE", ""),
+		// cap is reached, new groups are collapsed
+		groupEvent("view", "FR", "ios"),
+		groupEvent("click", "FR", "web"),
+		groupEvent("click", "DE", "ios"),
+	} {
+		require.NoError(t, agg.Add(ev))
+	}
+
+	group := func(eventType, country, platform string, count int64) groupValue {
+		return groupValue{
+			Group: map[string]string{KeyEventType: eventType, "country": country, "platform": platform},
+			Value: count,
+		}
+	}
+	cases := []struct {
+		name     string
+		params   []aggregator.Param
+		expected []groupValue
+	}{
+		{
+			name: "all groups",
+			expected: []groupValue{
+				group("click", "DE", "android", 1),
+				group("click", "DE", "ios", 3),
+				group("click", "US", "ios", 1),
+				group("view", "DE", "", 1),
+				group(OtherGroup, OtherGroup, OtherGroup, 2),
+			},
+		},
+		{
+			name:   "single dimension",
+			params: []aggregator.Param{{Key: "country", Value: "DE"}},
+			expected: []groupValue{
+				group("click", "DE", "android", 1),
+				group("click", "DE", "ios", 3),
+				group("view", "DE", "", 1),
+			},
+		},
+		{
+			name: "every dimension",
+			params: []aggregator.Param{
+				{Key: KeyEventType, Value: "click"},
+				{Key: "country", Value: "DE"},
+				{Key: "platform", Value: "ios"},
+				{Key: "unrelated", Value: "x"},
+			},
+			expected: []groupValue{group("click", "DE", "ios", 3)},
+		},
+		{
+			name:     "no match",
+			params:   []aggregator.Param{{Key: "platform", Value: "tv"}},
+			expected: []groupValue{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res, err := agg.View(c.params...)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, res)
+		})
+	}
+
+	// groups and overflow bucket are restored from snapshot
+	var buf bytes.Buffer
+	require.NoError(t, agg.(aggregator.Snapshotter).Snapshot(&buf))
+	restored, err := NewCountAggregator(aggregator.Config{
+		KeyGroupBy:   []interface{}{"country", "platform"},
+		KeyMaxGroups: 4,
+	})
+	require.NoError(t, err)
+	require.NoError(t, restored.(aggregator.Snapshotter).Restore(&buf))
+	require.NoError(t, restored.Add(groupEvent("click", "NL", "ios")))
+	res, err := restored.View(aggregator.Param{Key: "country", Value: OtherGroup})
+	require.NoError(t, err)
+	require.Equal(t, []groupValue{group(OtherGroup, OtherGroup, OtherGroup, 3)}, res)
+}
+
+func TestGroupedSnapshotMismatch(t *testing.T) {
+	agg, err := NewCountAggregator(aggregator.Config{KeyGroupBy: []string{"country"}})
+	require.NoError(t, err)
+	require.NoError(t, agg.Add(groupEvent("click", "NL", "ios")))
+	var buf bytes.Buffer
+	require.NoError(t, agg.(aggregator.Snapshotter).Snapshot(&buf))
+	state := buf.Bytes()
+
+	// state of another grouping is not restored
+	for _, cfg := range []aggregator.Config{
+		{},
+		{KeyGroupBy: []string{"platform"}},
+		{KeyGroupBy: []string{"country", "platform"}},
+	} {
+		other, err := NewCountAggregator(cfg)
+		require.NoError(t, err)
+		snapshotter := other.(aggregator.Snapshotter)
+		require.Equal(t, aggregator.ErrStateMismatch, snapshotter.CheckState(bytes.NewReader(state)))
+		require.Equal(t, aggregator.ErrStateMismatch, snapshotter.Restore(bytes.NewReader(state)))
+	}
+
+	// state of old format has no dimensions
+	ungrouped, err := NewCountAggregator(aggregator.Config{})
+	require.NoError(t, err)
+	require.Equal(t, aggregator.ErrStateMismatch, ungrouped.(aggregator.Snapshotter).CheckState(bytes.NewReader([]byte(`{"click":1}`))))
+
+	same, err := NewCountAggregator(aggregator.Config{KeyGroupBy: []interface{}{"country"}})
+	require.NoError(t, err)
+	require.NoError(t, same.(aggregator.Snapshotter).CheckState(bytes.NewReader(state)))
+}
+
+func TestGroupedNumeric(t *testing.T) {
+	agg, err := aggregator.New("realtime_sum", aggregator.Config{
+		KeyParam:   "amount",
+		KeyGroupBy: []string{"country"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, agg.Add(groupEvent("purchase", "DE", "")))
+	require.NoError(t, agg.Add(groupEvent("purchase", "DE", "")))
+	require.NoError(t, agg.Add(groupEvent("purchase", "USA", "")))
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "purchase", Params: map[string]interface{}{"country": "DE", "amount": "n/a"}}))
+
+	res, err := agg.View(aggregator.Param{Key: "country", Value: "DE"})
+	require.NoError(t, err)
+	require.Equal(t, groupedNumericResult{
+		Groups: []groupValue{{
+			Group: map[string]string{KeyEventType: "purchase", "country": "DE"},
+			Value: float64(4),
+		}},
+		Skipped: 1,
+	}, res)
+}
+
+func TestGroupingConfig(t *testing.T) {
+	for _, cfg := range []aggregator.Config{
+		{KeyGroupBy: "country"},
+		{KeyGroupBy: []interface{}{1}},
+		{KeyGroupBy: []string{KeyEventType}},
+		{KeyMaxGroups: "10"},
+		{KeyMaxGroups: -1},
+	} {
+		_, err := NewCountAggregator(cfg)
+		require.Error(t, err, "%v", cfg)
+	}
+}
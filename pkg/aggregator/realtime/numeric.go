@@ -0,0 +1,284 @@
+package realtime
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// numericOp selects which statistic of param values is viewed
+	numericOp string
+
+	// numericStats are collected for every event type, any op
+	// could be computed from them
+	numericStats struct {
+		Count int64   `json:"count"`
+		Sum   float64 `json:"sum"`
+		Min   float64 `json:"min"`
+		Max   float64 `json:"max"`
+	}
+
+	numericAggregator struct {
+		op    numericOp
+		param string
+
+		mtx      sync.Mutex
+		grouping *grouping
+		// stats and events with non numeric param value by group
+		stats   map[string]*numericStats
+		skipped map[string]int64
+	}
+
+	numericResult struct {
+		Values  map[string]float64 `json:"values"`
+		Skipped int64              `json:"skipped"`
+	}
+
+	groupedNumericResult struct {
+		Groups  []groupValue `json:"groups"`
+		Skipped int64        `json:"skipped"`
+	}
+
+	numericState struct {
+		Stats   map[string]*numericStats `json:"stats"`
+		Skipped map[string]int64         `json:"skipped"`
+	}
+)
+
+const (
+	opCount numericOp = "count"
+	opSum   numericOp = "sum"
+	opMin   numericOp = "min"
+	opMax   numericOp = "max"
+	opMean  numericOp = "mean"
+
+	// KeyParam is config key of event param aggregated by numeric aggregators
+	KeyParam = "param"
+)
+
+func init() {
+	for _, op := range []numericOp{opSum, opMin, opMax, opMean} {
+		op := op
+		aggregator.RegisterAggregator("realtime_"+string(op), func(cfg aggregator.Config) (aggregator.Aggregator, error) {
+			return newNumericAggregator(op, cfg)
+		})
+	}
+}
+
+func newNumericAggregator(op numericOp, cfg aggregator.Config) (*numericAggregator, error) {
+	paramIfc, ok := cfg[KeyParam]
+	if !ok {
+		return nil, errors.Errorf("param not given for %s aggregator", op)
+	}
+	param, ok := paramIfc.(string)
+	if !ok || param == "" {
+		return nil, errors.New("param should be non empty string")
+	}
+	grouping, err := newGrouping(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &numericAggregator{
+		op:       op,
+		param:    param,
+		grouping: grouping,
+		stats:    map[string]*numericStats{},
+		skipped:  map[string]int64{},
+	}, nil
+}
+
+// numericValue converts json value of param to number,
+// numbers given as strings are accepted too
+func numericValue(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	return 0, false
+}
+
+func (s *numericStats) add(v float64) {
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+}
+
+func (s *numericStats) merge(o *numericStats) {
+	if o.Count == 0 {
+		return
+	}
+	if s.Count == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if s.Count == 0 || o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Count += o.Count
+	s.Sum += o.Sum
+}
+
+func (s *numericStats) value(op numericOp) float64 {
+	switch op {
+	case opCount:
+		return float64(s.Count)
+	case opMin:
+		return s.Min
+	case opMax:
+		return s.Max
+	case opMean:
+		if s.Count == 0 {
+			return 0
+		}
+		return s.Sum / float64(s.Count)
+	}
+	return s.Sum
+}
+
+// Add aggregates param of event, events without param are ignored
+// and events with non numeric value are counted as skipped
+func (a *numericAggregator) Add(ev *eventagg.Event) error {
+	raw, ok := ev.Params[a.param]
+	if !ok {
+		return nil
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	key := a.grouping.key(ev.Type, ev.Params)
+	v, ok := numericValue(raw)
+	if !ok {
+		a.skipped[key]++
+		return nil
+	}
+
+	stats, ok := a.stats[key]
+	if !ok {
+		stats = &numericStats{}
+		a.stats[key] = stats
+	}
+	stats.add(v)
+	return nil
+}
+
+// View returns values by event type, with group_by values of groups
+// matching params are returned
+func (a *numericAggregator) View(params ...aggregator.Param) (aggregator.Result, error) {
+	if a.grouping.grouped() {
+		return a.viewGroups(params), nil
+	}
+
+	var eventType *string
+	for i := range params {
+		if params[i].Key == KeyEventType {
+			eventType = &params[i].Value
+		}
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	res := numericResult{Values: map[string]float64{}}
+	for t, stats := range a.stats {
+		if eventType == nil || *eventType == t {
+			res.Values[t] = stats.value(a.op)
+		}
+	}
+	for t, skipped := range a.skipped {
+		if eventType == nil || *eventType == t {
+			res.Skipped += skipped
+		}
+	}
+	return res, nil
+}
+
+func (a *numericAggregator) viewGroups(params []aggregator.Param) groupedNumericResult {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	filters := a.grouping.filters(params)
+	res := groupedNumericResult{}
+	res.Groups = a.grouping.groups(filters, func(key string) (interface{}, bool) {
+		stats, ok := a.stats[key]
+		if !ok {
+			return nil, false
+		}
+		return stats.value(a.op), true
+	})
+	for key, skipped := range a.skipped {
+		if a.grouping.match(key, filters) {
+			res.Skipped += skipped
+		}
+	}
+	return res
+}
+
+func (a *numericAggregator) Snapshot(w io.Writer) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	state := numericState{Stats: a.stats, Skipped: a.skipped}
+	return a.grouping.snapshot(w, state)
+}
+
+func (a *numericAggregator) CheckState(r io.Reader) error {
+	return a.grouping.unwrap(r, nil)
+}
+
+func (a *numericAggregator) Restore(r io.Reader) error {
+	state := numericState{}
+	if err := a.grouping.unwrap(r, &state); err != nil {
+		return err
+	}
+	if state.Stats == nil {
+		state.Stats = map[string]*numericStats{}
+	}
+	if state.Skipped == nil {
+		state.Skipped = map[string]int64{}
+	}
+	keys := make([]string, 0, len(state.Stats)+len(state.Skipped))
+	for key := range state.Stats {
+		keys = append(keys, key)
+	}
+	for key := range state.Skipped {
+		keys = append(keys, key)
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if err := a.grouping.restore(keys); err != nil {
+		return err
+	}
+	a.stats, a.skipped = state.Stats, state.Skipped
+	return nil
+}
+
+func (a *numericAggregator) Close() error {
+	return nil
+}
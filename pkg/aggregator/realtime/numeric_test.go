@@ -0,0 +1,78 @@
+package realtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNumericAggregators(t *testing.T) {
+	events := []*eventagg.Event{
+		{Type: "purchase", Params: map[string]interface{}{"amount": float64(10)}},
+		{Type: "purchase", Params: map[string]interface{}{"amount": 2}},
+		{Type: "purchase", Params: map[string]interface{}{"amount": " 4.5"}},
+		{Type: "purchase", Params: map[string]interface{}{"amount": json.Number("-1.5")}},
+		{Type: "purchase", Params: map[string]interface{}{"amount": "ten"}},
+		{Type: "purchase", Params: map[string]interface{}{"amount": true}},
+		{Type: "purchase", Params: map[string]interface{}{}},
+		{Type: "refund", Params: map[string]interface{}{"amount": float64(3)}},
+		{Type: "refund", Params: map[string]interface{}{"amount": nil}},
+	}
+
+	cases := []struct {
+		name      string
+		eventType string
+		expected  numericResult
+	}{
+		{"realtime_sum", "", numericResult{map[string]float64{"purchase": 15, "refund": 3}, 3}},
+		{"realtime_min", "", numericResult{map[string]float64{"purchase": -1.5, "refund": 3}, 3}},
+		{"realtime_max", "", numericResult{map[string]float64{"purchase": 10, "refund": 3}, 3}},
+		{"realtime_mean", "", numericResult{map[string]float64{"purchase": 3.75, "refund": 3}, 3}},
+		{"realtime_sum", "purchase", numericResult{map[string]float64{"purchase": 15}, 2}},
+		{"realtime_mean", "unknown", numericResult{map[string]float64{}, 0}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name+"/"+c.eventType, func(t *testing.T) {
+			agg, err := aggregator.New(c.name, aggregator.Config{KeyParam: "amount"})
+			require.NoError(t, err)
+			for _, ev := range events {
+				require.NoError(t, agg.Add(ev))
+			}
+
+			params := []aggregator.Param{}
+			if c.eventType != "" {
+				params = append(params, aggregator.Param{Key: KeyEventType, Value: c.eventType})
+			}
+			res, err := agg.View(params...)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, res)
+		})
+	}
+
+	_, err := aggregator.New("realtime_sum", aggregator.Config{})
+	require.Error(t, err, "param is required")
+}
+
+func TestNumericSnapshot(t *testing.T) {
+	agg, err := aggregator.New("realtime_mean", aggregator.Config{KeyParam: "duration"})
+	require.NoError(t, err)
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Params: map[string]interface{}{"duration": float64(2)}}))
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Params: map[string]interface{}{"duration": "x"}}))
+
+	var buf bytes.Buffer
+	require.NoError(t, agg.(aggregator.Snapshotter).Snapshot(&buf))
+	restored, err := aggregator.New("realtime_mean", aggregator.Config{KeyParam: "duration"})
+	require.NoError(t, err)
+	require.NoError(t, restored.(aggregator.Snapshotter).Restore(&buf))
+	require.NoError(t, restored.Add(&eventagg.Event{Type: "a", Params: map[string]interface{}{"duration": float64(4)}}))
+
+	res, err := restored.View()
+	require.NoError(t, err)
+	require.Equal(t, numericResult{map[string]float64{"a": 3}, 1}, res)
+}
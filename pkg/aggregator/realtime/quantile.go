@@ -0,0 +1,309 @@
+package realtime
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+	"github.com/iahmedov/eventagg/pkg/sketch"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// QuantileAggregator estimates quantiles of numeric param with ddsketch
+	// per group, aggregators with the same config could be merged
+	QuantileAggregator struct {
+		param    string
+		accuracy float64
+
+		mtx      sync.Mutex
+		grouping *grouping
+		// sketches and events with non numeric param value by group
+		sketches map[string]*sketch.DDSketch
+		skipped  map[string]int64
+	}
+
+	// quantileValue has estimated quantiles keyed by q
+	quantileValue struct {
+		Count     uint64             `json:"count"`
+		Quantiles map[string]float64 `json:"quantiles"`
+	}
+
+	quantileResult struct {
+		Values  map[string]quantileValue `json:"values"`
+		Skipped int64                    `json:"skipped"`
+	}
+
+	quantileState struct {
+		Sketches map[string][]byte `json:"sketches"`
+		Skipped  map[string]int64  `json:"skipped"`
+	}
+)
+
+const (
+	// KeyQuantiles is view param of comma separated quantiles, e.g. q=0.5,0.99
+	KeyQuantiles = "q"
+	// KeyRelativeAccuracy is config key of quantile sketch accuracy
+	KeyRelativeAccuracy = "relative_accuracy"
+)
+
+// DefaultQuantiles are viewed when q is not given
+var DefaultQuantiles = []float64{0.5, 0.95, 0.99}
+
+func init() {
+	aggregator.RegisterAggregator("realtime_quantile", func(cfg aggregator.Config) (aggregator.Aggregator, error) {
+		return NewQuantileAggregator(cfg)
+	})
+}
+
+func NewQuantileAggregator(cfg aggregator.Config) (*QuantileAggregator, error) {
+	param, ok := cfg[KeyParam].(string)
+	if !ok || param == "" {
+		return nil, errors.New("param should be non empty string")
+	}
+
+	accuracy := sketch.DefaultRelativeAccuracy
+	switch a := cfg[KeyRelativeAccuracy].(type) {
+	case nil:
+	case float64:
+		accuracy = a
+	default:
+		return nil, errors.New("relative_accuracy should be number")
+	}
+	if _, err := sketch.NewDDSketch(accuracy, sketch.DefaultMaxBins); err != nil {
+		return nil, err
+	}
+
+	grouping, err := newGrouping(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QuantileAggregator{
+		param:    param,
+		accuracy: accuracy,
+		grouping: grouping,
+		sketches: map[string]*sketch.DDSketch{},
+		skipped:  map[string]int64{},
+	}, nil
+}
+
+// ParseQuantiles parses comma separated quantiles within [0, 1]
+func ParseQuantiles(value string) ([]float64, error) {
+	splitted := strings.Split(value, ",")
+	quantiles := make([]float64, 0, len(splitted))
+	for _, s := range splitted {
+		q, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || !(q >= 0 && q <= 1) {
+			return nil, errors.Errorf("invalid quantile %q, should be number within [0, 1]", s)
+		}
+		quantiles = append(quantiles, q)
+	}
+	return quantiles, nil
+}
+
+func (a *QuantileAggregator) newSketch() *sketch.DDSketch {
+	s, _ := sketch.NewDDSketch(a.accuracy, sketch.DefaultMaxBins)
+	return s
+}
+
+// Add adds param value of event to sketch, events without param are ignored
+// and events with non numeric value are counted as skipped
+func (a *QuantileAggregator) Add(ev *eventagg.Event) error {
+	raw, ok := ev.Params[a.param]
+	if !ok {
+		return nil
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	key := a.grouping.key(ev.Type, ev.Params)
+	v, ok := numericValue(raw)
+	if !ok {
+		a.skipped[key]++
+		return nil
+	}
+
+	s, ok := a.sketches[key]
+	if !ok {
+		s = a.newSketch()
+		a.sketches[key] = s
+	}
+	s.Add(v)
+	return nil
+}
+
+// Merge adds state of another aggregator with the same config,
+// other aggregator is not changed
+func (a *QuantileAggregator) Merge(o *QuantileAggregator) error {
+	if a.accuracy != o.accuracy {
+		return sketch.ErrAccuracyMismatch
+	}
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for key, s := range o.sketches {
+		key, err := a.grouping.merge(key)
+		if err != nil {
+			return err
+		}
+		if _, ok := a.sketches[key]; !ok {
+			a.sketches[key] = a.newSketch()
+		}
+		if err = a.sketches[key].Merge(s); err != nil {
+			return err
+		}
+	}
+	for key, skipped := range o.skipped {
+		key, err := a.grouping.merge(key)
+		if err != nil {
+			return err
+		}
+		a.skipped[key] += skipped
+	}
+	return nil
+}
+
+func newQuantileValue(s *sketch.DDSketch, quantiles []float64) quantileValue {
+	value := quantileValue{
+		Count:     s.Count(),
+		Quantiles: make(map[string]float64, len(quantiles)),
+	}
+	for _, q := range quantiles {
+		value.Quantiles[strconv.FormatFloat(q, 'f', -1, 64)] = s.Quantile(q)
+	}
+	return value
+}
+
+// View returns quantiles given as q param (default 0.5,0.95,0.99) by event
+// type, with group_by quantiles of groups matching params are returned
+func (a *QuantileAggregator) View(params ...aggregator.Param) (aggregator.Result, error) {
+	quantiles := DefaultQuantiles
+	var eventType *string
+	for i := range params {
+		switch params[i].Key {
+		case KeyQuantiles:
+			var err error
+			if quantiles, err = ParseQuantiles(params[i].Value); err != nil {
+				return nil, err
+			}
+		case KeyEventType:
+			eventType = &params[i].Value
+		}
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.grouping.grouped() {
+		filters := a.grouping.filters(params)
+		res := groupedNumericResult{}
+		res.Groups = a.grouping.groups(filters, func(key string) (interface{}, bool) {
+			s, ok := a.sketches[key]
+			if !ok {
+				return nil, false
+			}
+			return newQuantileValue(s, quantiles), true
+		})
+		for key, skipped := range a.skipped {
+			if a.grouping.match(key, filters) {
+				res.Skipped += skipped
+			}
+		}
+		return res, nil
+	}
+
+	res := quantileResult{Values: map[string]quantileValue{}}
+	for t, s := range a.sketches {
+		if eventType == nil || *eventType == t {
+			res.Values[t] = newQuantileValue(s, quantiles)
+		}
+	}
+	for t, skipped := range a.skipped {
+		if eventType == nil || *eventType == t {
+			res.Skipped += skipped
+		}
+	}
+	return res, nil
+}
+
+func (a *QuantileAggregator) Snapshot(w io.Writer) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	state := quantileState{
+		Sketches: make(map[string][]byte, len(a.sketches)),
+		Skipped:  a.skipped,
+	}
+	for key, s := range a.sketches {
+		content, err := s.MarshalBinary()
+		if err != nil {
+			return errors.Wrap(err, "failed to encode sketch")
+		}
+		state.Sketches[key] = content
+	}
+	return a.grouping.snapshot(w, state)
+}
+
+// decodeState returns sketches by group and skipped counts, sketches
+// of different accuracy are ErrStateMismatch
+func (a *QuantileAggregator) decodeState(r io.Reader) (map[string]*sketch.DDSketch, map[string]int64, error) {
+	state := quantileState{}
+	if err := a.grouping.unwrap(r, &state); err != nil {
+		return nil, nil, err
+	}
+	if state.Skipped == nil {
+		state.Skipped = map[string]int64{}
+	}
+
+	sketches := make(map[string]*sketch.DDSketch, len(state.Sketches))
+	for key, content := range state.Sketches {
+		s := &sketch.DDSketch{}
+		if err := s.UnmarshalBinary(content); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to decode sketch of %s", key)
+		}
+		if s.RelativeAccuracy() != a.accuracy {
+			return nil, nil, aggregator.ErrStateMismatch
+		}
+		sketches[key] = s
+	}
+	return sketches, state.Skipped, nil
+}
+
+func (a *QuantileAggregator) CheckState(r io.Reader) error {
+	_, _, err := a.decodeState(r)
+	return err
+}
+
+// Restore replaces state with snapshot one, snapshot of aggregator
+// with different accuracy is rejected
+func (a *QuantileAggregator) Restore(r io.Reader) error {
+	sketches, skipped, err := a.decodeState(r)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(sketches)+len(skipped))
+	for key := range sketches {
+		keys = append(keys, key)
+	}
+	for key := range skipped {
+		keys = append(keys, key)
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if err := a.grouping.restore(keys); err != nil {
+		return err
+	}
+	a.sketches, a.skipped = sketches, skipped
+	return nil
+}
+
+func (a *QuantileAggregator) Close() error {
+	return nil
+}
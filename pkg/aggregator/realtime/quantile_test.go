@@ -0,0 +1,109 @@
+package realtime
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuantileAggregator(t *testing.T) {
+	agg, err := aggregator.New("realtime_quantile", aggregator.Config{KeyParam: "duration_ms"})
+	require.NoError(t, err)
+
+	for i := 1; i <= 100; i++ {
+		require.NoError(t, agg.Add(&eventagg.Event{Type: "request", Params: map[string]interface{}{"duration_ms": float64(i)}}))
+	}
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "query", Params: map[string]interface{}{"duration_ms": "250"}}))
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "query", Params: map[string]interface{}{"duration_ms": "slow"}}))
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "query", Params: map[string]interface{}{}}))
+
+	res, err := agg.View(aggregator.Param{Key: KeyQuantiles, Value: "0.5, 0.99,1"})
+	require.NoError(t, err)
+	values := res.(quantileResult)
+	require.Equal(t, int64(1), values.Skipped)
+	require.Len(t, values.Values, 2)
+	request := values.Values["request"]
+	require.Equal(t, uint64(100), request.Count)
+	require.Len(t, request.Quantiles, 3)
+	require.InDelta(t, 50, request.Quantiles["0.5"], 0.5)
+	require.InDelta(t, 99, request.Quantiles["0.99"], 1)
+	require.Equal(t, float64(100), request.Quantiles["1"])
+	require.InDelta(t, 250, values.Values["query"].Quantiles["0.5"], 2.5)
+
+	// default quantiles of single event type
+	res, err = agg.View(aggregator.Param{Key: KeyEventType, Value: "query"})
+	require.NoError(t, err)
+	values = res.(quantileResult)
+	require.Len(t, values.Values, 1)
+	require.Len(t, values.Values["query"].Quantiles, len(DefaultQuantiles))
+
+	for _, q := range []string{"", "p99", "1.5", "0.5,-0.1"} {
+		_, err = agg.View(aggregator.Param{Key: KeyQuantiles, Value: q})
+		require.Error(t, err, "q=%s", q)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, agg.(aggregator.Snapshotter).Snapshot(&buf))
+	content := buf.Bytes()
+	restored, err := aggregator.New("realtime_quantile", aggregator.Config{KeyParam: "duration_ms"})
+	require.NoError(t, err)
+	require.NoError(t, restored.(aggregator.Snapshotter).Restore(bytes.NewReader(content)))
+	expected, err := agg.View()
+	require.NoError(t, err)
+	actual, err := restored.View()
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	// snapshot of other accuracy is skipped instead of failing restore
+	other, err := aggregator.New("realtime_quantile", aggregator.Config{KeyParam: "duration_ms", KeyRelativeAccuracy: 0.05})
+	require.NoError(t, err)
+	require.Equal(t, aggregator.ErrStateMismatch, other.(aggregator.Snapshotter).CheckState(bytes.NewReader(content)))
+	require.Equal(t, aggregator.ErrStateMismatch, other.(aggregator.Snapshotter).Restore(bytes.NewReader(content)))
+}
+
+func TestQuantileAggregatorMerge(t *testing.T) {
+	cfg := aggregator.Config{KeyParam: "duration_ms", KeyGroupBy: []interface{}{"region"}, KeyMaxGroups: 2}
+	all, err := NewQuantileAggregator(cfg)
+	require.NoError(t, err)
+	parts := make([]*QuantileAggregator, 3)
+	for i := range parts {
+		parts[i], err = NewQuantileAggregator(cfg)
+		require.NoError(t, err)
+	}
+
+	regions := []string{"eu", "us", "asia"}
+	for i := 0; i < 300; i++ {
+		ev := &eventagg.Event{Type: "request", Params: map[string]interface{}{
+			"duration_ms": float64(i),
+			"region":      regions[i%2],
+		}}
+		if i == 299 {
+			ev.Params["region"] = regions[2]
+		}
+		require.NoError(t, parts[i%3].Add(ev))
+		require.NoError(t, all.Add(ev))
+	}
+
+	merged, err := NewQuantileAggregator(cfg)
+	require.NoError(t, err)
+	for _, part := range parts {
+		require.NoError(t, merged.Merge(part))
+	}
+	expected, err := all.View()
+	require.NoError(t, err)
+	actual, err := merged.View()
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+	// group over cap is merged into other group
+	groups := actual.(groupedNumericResult).Groups
+	require.Len(t, groups, 3)
+	require.Equal(t, OtherGroup, groups[2].Group["region"])
+
+	incompatible, err := NewQuantileAggregator(aggregator.Config{KeyParam: "duration_ms", KeyRelativeAccuracy: 0.05})
+	require.NoError(t, err)
+	require.Error(t, merged.Merge(incompatible))
+}
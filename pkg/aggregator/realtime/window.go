@@ -0,0 +1,367 @@
+package realtime
+
+import (
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// windowAggregator buckets events by Event.Time into panes of step width,
+	// window of size is merge of its panes. Tumbling windows have step equal
+	// to size. Panes older than retention from the latest event are dropped,
+	// events later than tolerance from now are ignored
+	windowAggregator struct {
+		op        numericOp
+		param     string
+		size      int64
+		step      int64
+		retention int64
+		tolerance int64
+		now       func() time.Time
+
+		mtx      sync.Mutex
+		grouping *grouping
+		// stats of groups by pane start
+		panes map[int64]map[string]*numericStats
+		// the biggest event ts, not later than tolerance from now
+		watermark int64
+	}
+
+	windowPoint struct {
+		WindowStart string  `json:"window_start"`
+		WindowEnd   string  `json:"window_end"`
+		Value       float64 `json:"value"`
+	}
+
+	// windowState keeps config panes depend on, state of another
+	// config is not restored
+	windowState struct {
+		Op        numericOp                          `json:"op"`
+		Param     string                             `json:"param"`
+		Size      int64                              `json:"size"`
+		Step      int64                              `json:"step"`
+		Panes     map[int64]map[string]*numericStats `json:"panes"`
+		Watermark int64                              `json:"watermark"`
+	}
+)
+
+const (
+	// KeyWindow is config key of window type, tumbling or sliding
+	KeyWindow    = "window"
+	KeySize      = "size"
+	KeyStep      = "step"
+	KeyRetention = "retention"
+	// KeyTolerance is config key of how far in future event ts is accepted
+	KeyTolerance = "tolerance"
+
+	WindowTumbling = "tumbling"
+	WindowSliding  = "sliding"
+
+	DefaultWindowSize      = time.Minute
+	DefaultWindowRetention = time.Hour
+	DefaultWindowTolerance = time.Minute * 5
+
+	// MaxWindowSteps limits size/step of sliding window, every window
+	// of view merges that many panes
+	MaxWindowSteps = 100
+)
+
+func init() {
+	for _, op := range []numericOp{opCount, opSum, opMin, opMax, opMean} {
+		op := op
+		aggregator.RegisterAggregator("realtime_window_"+string(op), func(cfg aggregator.Config) (aggregator.Aggregator, error) {
+			return newWindowAggregator(op, cfg)
+		})
+	}
+}
+
+// durationParam reads duration given as string ("1m") or seconds,
+// only whole seconds are allowed as events have second precision
+func durationParam(cfg aggregator.Config, key string, def time.Duration) (int64, error) {
+	d := def
+	switch value := cfg[key].(type) {
+	case nil:
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid %s", key)
+		}
+		d = parsed
+	case int:
+		d = time.Duration(value) * time.Second
+	case float64:
+		d = time.Duration(value * float64(time.Second))
+	default:
+		return 0, errors.Errorf("%s should be duration", key)
+	}
+
+	if d < time.Second || d%time.Second != 0 {
+		return 0, errors.Errorf("%s should be whole positive count of seconds", key)
+	}
+	return int64(d / time.Second), nil
+}
+
+func newWindowAggregator(op numericOp, cfg aggregator.Config) (*windowAggregator, error) {
+	a := &windowAggregator{
+		op:        op,
+		panes:     map[int64]map[string]*numericStats{},
+		watermark: math.MinInt64,
+		now:       time.Now,
+	}
+
+	if op != opCount {
+		param, ok := cfg[KeyParam].(string)
+		if !ok || param == "" {
+			return nil, errors.Errorf("param not given for window %s aggregator", op)
+		}
+		a.param = param
+	}
+
+	var err error
+	if a.size, err = durationParam(cfg, KeySize, DefaultWindowSize); err != nil {
+		return nil, err
+	}
+	if a.retention, err = durationParam(cfg, KeyRetention, DefaultWindowRetention); err != nil {
+		return nil, err
+	}
+	if a.tolerance, err = durationParam(cfg, KeyTolerance, DefaultWindowTolerance); err != nil {
+		return nil, err
+	}
+
+	switch cfg[KeyWindow] {
+	case nil, WindowTumbling:
+		a.step = a.size
+	case WindowSliding:
+		if a.step, err = durationParam(cfg, KeyStep, time.Duration(a.size)*time.Second); err != nil {
+			return nil, err
+		}
+		if a.step > a.size || a.size%a.step != 0 {
+			return nil, errors.New("window size should be multiple of step")
+		}
+		if a.size/a.step > MaxWindowSteps {
+			return nil, errors.Errorf("window size should be at most %d steps", MaxWindowSteps)
+		}
+	default:
+		return nil, errors.Errorf("unknown window type: %v", cfg[KeyWindow])
+	}
+
+	if a.grouping, err = newGrouping(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// paneStart aligns ts to step, negative ts are rounded down too
+func (a *windowAggregator) paneStart(ts int64) int64 {
+	start := ts - ts%a.step
+	if ts%a.step < 0 {
+		start -= a.step
+	}
+	return start
+}
+
+// Add aggregates event into its pane, events older than retention, events
+// too far in future and events with missing or non numeric param are ignored
+func (a *windowAggregator) Add(ev *eventagg.Event) error {
+	if ev.Time > a.now().Unix()+a.tolerance {
+		return nil
+	}
+
+	v := float64(1)
+	if a.op != opCount {
+		var ok bool
+		if v, ok = numericValue(ev.Params[a.param]); !ok {
+			return nil
+		}
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if ev.Time > a.watermark {
+		a.watermark = ev.Time
+		a.expire()
+	}
+	start := a.paneStart(ev.Time)
+	if start+a.step <= a.watermark-a.retention {
+		return nil
+	}
+
+	pane, ok := a.panes[start]
+	if !ok {
+		pane = map[string]*numericStats{}
+		a.panes[start] = pane
+	}
+	key := a.grouping.key(ev.Type, ev.Params)
+	stats, ok := pane[key]
+	if !ok {
+		stats = &numericStats{}
+		pane[key] = stats
+	}
+	stats.add(v)
+	return nil
+}
+
+// expire drops panes ended before retention, groups
+// left only in dropped panes are released
+func (a *windowAggregator) expire() {
+	expired := false
+	for start := range a.panes {
+		if start+a.step <= a.watermark-a.retention {
+			delete(a.panes, start)
+			expired = true
+		}
+	}
+	if !expired {
+		return
+	}
+
+	keys := []string{}
+	for _, pane := range a.panes {
+		for key := range pane {
+			keys = append(keys, key)
+		}
+	}
+	a.grouping.restore(keys)
+}
+
+// View returns values of windows with data ordered by start, windows
+// are filtered by after/before params and groups by dimension params
+func (a *windowAggregator) View(params ...aggregator.Param) (aggregator.Result, error) {
+	after, before := int64(math.MinInt64), int64(math.MaxInt64)
+	for _, p := range params {
+		switch p.Key {
+		case aggregator.KeyAfter:
+			t, err := time.Parse(aggregator.TimeFormat, p.Value)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid after")
+			}
+			after = t.Unix()
+		case aggregator.KeyBefore:
+			t, err := time.Parse(aggregator.TimeFormat, p.Value)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid before")
+			}
+			before = t.Unix()
+		}
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	filters := a.grouping.filters(params)
+
+	// matching groups are merged once per pane, window merges
+	// at most size/step panes then. Every window covering a pane
+	// within requested range is returned
+	merged := make(map[int64]*numericStats, len(a.panes))
+	starts := map[int64]bool{}
+	for paneStart, pane := range a.panes {
+		stats := &numericStats{}
+		for key, groupStats := range pane {
+			if a.grouping.match(key, filters) {
+				stats.merge(groupStats)
+			}
+		}
+		if stats.Count == 0 {
+			continue
+		}
+		merged[paneStart] = stats
+
+		for start := paneStart - a.size + a.step; start <= paneStart; start += a.step {
+			if start >= after && start+a.size <= before {
+				starts[start] = true
+			}
+		}
+	}
+	sorted := make([]int64, 0, len(starts))
+	for start := range starts {
+		sorted = append(sorted, start)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	series := make([]windowPoint, 0, len(sorted))
+	for _, start := range sorted {
+		window := numericStats{}
+		for paneStart := start; paneStart < start+a.size; paneStart += a.step {
+			if stats, ok := merged[paneStart]; ok {
+				window.merge(stats)
+			}
+		}
+		if window.Count == 0 {
+			continue
+		}
+		series = append(series, windowPoint{
+			WindowStart: time.Unix(start, 0).UTC().Format(aggregator.TimeFormat),
+			WindowEnd:   time.Unix(start+a.size, 0).UTC().Format(aggregator.TimeFormat),
+			Value:       window.value(a.op),
+		})
+	}
+	return series, nil
+}
+
+func (a *windowAggregator) Snapshot(w io.Writer) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	state := windowState{
+		Op:        a.op,
+		Param:     a.param,
+		Size:      a.size,
+		Step:      a.step,
+		Panes:     a.panes,
+		Watermark: a.watermark,
+	}
+	return a.grouping.snapshot(w, state)
+}
+
+// decodeState returns ErrStateMismatch for state of another window config
+func (a *windowAggregator) decodeState(r io.Reader) (windowState, error) {
+	state := windowState{}
+	if err := a.grouping.unwrap(r, &state); err != nil {
+		return state, err
+	}
+	if state.Op != a.op || state.Param != a.param || state.Size != a.size || state.Step != a.step {
+		return state, aggregator.ErrStateMismatch
+	}
+	return state, nil
+}
+
+func (a *windowAggregator) CheckState(r io.Reader) error {
+	_, err := a.decodeState(r)
+	return err
+}
+
+func (a *windowAggregator) Restore(r io.Reader) error {
+	state, err := a.decodeState(r)
+	if err != nil {
+		return err
+	}
+	if state.Panes == nil {
+		state.Panes = map[int64]map[string]*numericStats{}
+	}
+	keys := []string{}
+	for _, pane := range state.Panes {
+		for key := range pane {
+			keys = append(keys, key)
+		}
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if err := a.grouping.restore(keys); err != nil {
+		return err
+	}
+	a.panes, a.watermark = state.Panes, state.Watermark
+	a.expire()
+	return nil
+}
+
+func (a *windowAggregator) Close() error {
+	return nil
+}
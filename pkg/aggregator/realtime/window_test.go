@@ -0,0 +1,204 @@
+package realtime
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+
+	"github.com/stretchr/testify/require"
+)
+
+func formatTs(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(aggregator.TimeFormat)
+}
+
+func point(start, end int64, value float64) windowPoint {
+	return windowPoint{WindowStart: formatTs(start), WindowEnd: formatTs(end), Value: value}
+}
+
+func TestWindowAggregator(t *testing.T) {
+	events := []*eventagg.Event{
+		{Type: "request", Time: 0, Params: map[string]interface{}{"duration": float64(10)}},
+		{Type: "request", Time: 30, Params: map[string]interface{}{"duration": float64(20)}},
+		{Type: "other", Time: 59, Params: map[string]interface{}{"duration": float64(90)}},
+		{Type: "request", Time: 60, Params: map[string]interface{}{"duration": "30"}},
+		{Type: "request", Time: 125, Params: map[string]interface{}{"duration": "slow"}},
+		{Type: "request", Time: 130, Params: map[string]interface{}{"duration": float64(40)}},
+	}
+
+	cases := []struct {
+		name     string
+		agg      string
+		cfg      aggregator.Config
+		params   []aggregator.Param
+		expected []windowPoint
+	}{
+		{
+			name:     "tumbling count",
+			agg:      "realtime_window_count",
+			cfg:      aggregator.Config{KeySize: "1m"},
+			expected: []windowPoint{point(0, 60, 3), point(60, 120, 1), point(120, 180, 2)},
+		},
+		{
+			name:     "sliding count",
+			agg:      "realtime_window_count",
+			cfg:      aggregator.Config{KeyWindow: WindowSliding, KeySize: "2m", KeyStep: 60},
+			expected: []windowPoint{point(-60, 60, 3), point(0, 120, 4), point(60, 180, 3), point(120, 240, 2)},
+		},
+		{
+			name: "sliding count within range",
+			agg:  "realtime_window_count",
+			cfg:  aggregator.Config{KeyWindow: WindowSliding, KeySize: "2m", KeyStep: "1m"},
+			params: []aggregator.Param{
+				{Key: aggregator.KeyAfter, Value: formatTs(0)},
+				{Key: aggregator.KeyBefore, Value: formatTs(180)},
+			},
+			expected: []windowPoint{point(0, 120, 4), point(60, 180, 3)},
+		},
+		{
+			name:     "tumbling mean of event type",
+			agg:      "realtime_window_mean",
+			cfg:      aggregator.Config{KeySize: "1m", KeyParam: "duration"},
+			params:   []aggregator.Param{{Key: KeyEventType, Value: "request"}},
+			expected: []windowPoint{point(0, 60, 15), point(60, 120, 30), point(120, 180, 40)},
+		},
+		{
+			name:     "sliding max",
+			agg:      "realtime_window_max",
+			cfg:      aggregator.Config{KeyWindow: WindowSliding, KeySize: "3m", KeyStep: "1m", KeyParam: "duration"},
+			params:   []aggregator.Param{{Key: aggregator.KeyAfter, Value: formatTs(0)}},
+			expected: []windowPoint{point(0, 180, 90), point(60, 240, 40), point(120, 300, 40)},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			agg, err := aggregator.New(c.agg, c.cfg)
+			require.NoError(t, err)
+			for _, ev := range events {
+				require.NoError(t, agg.Add(ev))
+			}
+
+			res, err := agg.View(c.params...)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, res)
+		})
+	}
+}
+
+func TestWindowRetention(t *testing.T) {
+	agg, err := aggregator.New("realtime_window_count", aggregator.Config{
+		KeySize:      "1m",
+		KeyRetention: "2m",
+		KeyGroupBy:   []string{"country"},
+		KeyMaxGroups: 2,
+	})
+	require.NoError(t, err)
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Time: 10, Params: map[string]interface{}{"country": "DE"}}))
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Time: 70, Params: map[string]interface{}{"country": "US"}}))
+	// panes ended 2m before the latest event are dropped with their groups
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Time: 190, Params: map[string]interface{}{"country": "FR"}}))
+	// late event
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Time: 5, Params: map[string]interface{}{"country": "DE"}}))
+
+	res, err := agg.View()
+	require.NoError(t, err)
+	require.Equal(t, []windowPoint{point(60, 120, 1), point(180, 240, 1)}, res)
+
+	res, err = agg.View(aggregator.Param{Key: "country", Value: "FR"})
+	require.NoError(t, err)
+	require.Equal(t, []windowPoint{point(180, 240, 1)}, res, "released group is not collapsed")
+
+	// panes are restored from snapshot
+	var buf bytes.Buffer
+	require.NoError(t, agg.(aggregator.Snapshotter).Snapshot(&buf))
+	restored, err := aggregator.New("realtime_window_count", aggregator.Config{
+		KeySize:      "1m",
+		KeyRetention: "2m",
+		KeyGroupBy:   []string{"country"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, restored.(aggregator.Snapshotter).Restore(&buf))
+	restoredRes, err := restored.View(aggregator.Param{Key: "country", Value: "FR"})
+	require.NoError(t, err)
+	require.Equal(t, res, restoredRes)
+}
+
+func TestWindowSnapshotMismatch(t *testing.T) {
+	cfg := aggregator.Config{KeyWindow: WindowSliding, KeySize: "2m", KeyStep: "1m", KeyParam: "amount"}
+	agg, err := aggregator.New("realtime_window_sum", cfg)
+	require.NoError(t, err)
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Time: 10, Params: map[string]interface{}{"amount": 1}}))
+	var buf bytes.Buffer
+	require.NoError(t, agg.(aggregator.Snapshotter).Snapshot(&buf))
+
+	changed := []struct {
+		name string
+		key  string
+		val  interface{}
+	}{
+		{"realtime_window_sum", KeyStep, "30s"},
+		{"realtime_window_sum", KeySize, "3m"},
+		{"realtime_window_sum", KeyParam, "price"},
+		{"realtime_window_max", KeyParam, "amount"},
+	}
+	for _, c := range changed {
+		changedCfg := aggregator.Config{}
+		for k, v := range cfg {
+			changedCfg[k] = v
+		}
+		changedCfg[c.key] = c.val
+		restored, err := aggregator.New(c.name, changedCfg)
+		require.NoError(t, err)
+		snapshotter := restored.(aggregator.Snapshotter)
+		require.Equal(t, aggregator.ErrStateMismatch, snapshotter.CheckState(bytes.NewReader(buf.Bytes())), "%s %s", c.name, c.key)
+		require.Equal(t, aggregator.ErrStateMismatch, snapshotter.Restore(bytes.NewReader(buf.Bytes())), "%s %s", c.name, c.key)
+	}
+
+	// retention is not part of state
+	cfg[KeyRetention] = "2h"
+	restored, err := aggregator.New("realtime_window_sum", cfg)
+	require.NoError(t, err)
+	require.NoError(t, restored.(aggregator.Snapshotter).Restore(bytes.NewReader(buf.Bytes())))
+}
+
+func TestWindowFutureEvent(t *testing.T) {
+	agg, err := newWindowAggregator(opCount, aggregator.Config{
+		KeySize:      "1m",
+		KeyRetention: "2m",
+		KeyTolerance: "1m",
+	})
+	require.NoError(t, err)
+	agg.now = func() time.Time { return time.Unix(100, 0) }
+
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Time: 10}))
+	// event of broken client clock does not expire the rest
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Time: 1000000}))
+	require.NoError(t, agg.Add(&eventagg.Event{Type: "a", Time: 150}))
+
+	res, err := agg.View()
+	require.NoError(t, err)
+	require.Equal(t, []windowPoint{point(0, 60, 1), point(120, 180, 1)}, res)
+}
+
+func TestWindowConfig(t *testing.T) {
+	for _, cfg := range []aggregator.Config{
+		{KeySize: "1.5s"},
+		{KeySize: "abc"},
+		{KeySize: 0},
+		{KeyWindow: "hopping"},
+		{KeyWindow: WindowSliding, KeySize: "1m", KeyStep: "7s"},
+		{KeyWindow: WindowSliding, KeySize: "1m", KeyStep: "2m"},
+		{KeyWindow: WindowSliding, KeySize: "1h", KeyStep: "1s"},
+		{KeyTolerance: "-1m"},
+	} {
+		_, err := aggregator.New("realtime_window_count", cfg)
+		require.Error(t, err, "%v", cfg)
+	}
+
+	_, err := aggregator.New("realtime_window_sum", aggregator.Config{})
+	require.Error(t, err, "param is required")
+}
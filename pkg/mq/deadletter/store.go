@@ -0,0 +1,168 @@
+package deadletter
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// Entry is event subscriber failed to handle after all retries
+type Entry struct {
+	ID         string          `json:"id"`
+	Subscriber string          `json:"subscriber"`
+	Event      *eventagg.Event `json:"event"`
+	Error      string          `json:"error"`
+	Attempts   int             `json:"attempts"`
+	FailedAt   int64           `json:"failed_at"`
+}
+
+// Store keeps every entry as separate file:
+// - <dir>/<subscriber>/<id>.json
+type Store struct {
+	dir string
+
+	mtx     sync.Mutex
+	entropy io.Reader
+}
+
+var ErrNotFound = errors.New("dead letter not found")
+
+const entryExt = ".json"
+
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "failed to create dead letter dir")
+	}
+
+	return &Store{
+		dir:     dir,
+		entropy: ulid.Monotonic(rand.Reader, 0),
+	}, nil
+}
+
+func (s *Store) entryPath(subscriber, id string) string {
+	return filepath.Join(s.dir, subscriber, id+entryExt)
+}
+
+func (s *Store) newID() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return ulid.MustNew(ulid.Now(), s.entropy).String()
+}
+
+func (s *Store) Add(subscriber string, ev *eventagg.Event, cause error, attempts int) error {
+	entry := &Entry{
+		ID:         s.newID(),
+		Subscriber: subscriber,
+		Event:      ev,
+		Attempts:   attempts,
+		FailedAt:   time.Now().Unix(),
+	}
+	if cause != nil {
+		entry.Error = cause.Error()
+	}
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal dead letter")
+	}
+
+	if err = os.MkdirAll(filepath.Join(s.dir, subscriber), 0777); err != nil {
+		return errors.Wrap(err, "failed to create subscriber dir")
+	}
+
+	// write and rename, so listing never sees partial entry
+	path := s.entryPath(subscriber, entry.ID)
+	if err = ioutil.WriteFile(path+".tmp", content, 0666); err != nil {
+		return errors.Wrap(err, "failed to write dead letter")
+	}
+	return errors.Wrap(os.Rename(path+".tmp", path), "failed to store dead letter")
+}
+
+// List returns entries of subscriber ordered by failure time
+func (s *Store) List(subscriber string) ([]*Entry, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, subscriber, "*"+entryExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list dead letters")
+	}
+	sort.Strings(names)
+
+	entries := make([]*Entry, 0, len(names))
+	for _, name := range names {
+		entry, err := s.Get(subscriber, strings.TrimSuffix(filepath.Base(name), entryExt))
+		if err == ErrNotFound {
+			// removed concurrently
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Subscribers returns names of subscribers having dead letters
+func (s *Store) Subscribers() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read dead letter dir")
+	}
+
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *Store) Get(subscriber, id string) (*Entry, error) {
+	if !validName(subscriber) || !validName(id) {
+		return nil, ErrNotFound
+	}
+
+	content, err := ioutil.ReadFile(s.entryPath(subscriber, id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read dead letter")
+	}
+
+	var entry Entry
+	if err = json.Unmarshal(content, &entry); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal dead letter")
+	}
+	return &entry, nil
+}
+
+func (s *Store) Remove(subscriber, id string) error {
+	if !validName(subscriber) || !validName(id) {
+		return ErrNotFound
+	}
+
+	err := os.Remove(s.entryPath(subscriber, id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return errors.Wrap(err, "failed to remove dead letter")
+}
+
+// validName prevents escaping store directory with user given names
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
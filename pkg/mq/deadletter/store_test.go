@@ -0,0 +1,56 @@
+package deadletter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-deadletter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Add("persistence", &eventagg.Event{Time: int64(i)}, errors.New("disk full"), 3))
+	}
+	require.NoError(t, s.Add("counter", &eventagg.Event{Time: 10}, nil, 1))
+
+	subscribers, err := s.Subscribers()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"persistence", "counter"}, subscribers)
+
+	entries, err := s.List("persistence")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for i, entry := range entries {
+		require.EqualValues(t, i, entry.Event.Time)
+		require.Equal(t, "disk full", entry.Error)
+		require.Equal(t, 3, entry.Attempts)
+		require.Equal(t, "persistence", entry.Subscriber)
+	}
+
+	entry, err := s.Get("persistence", entries[1].ID)
+	require.NoError(t, err)
+	require.Equal(t, entries[1], entry)
+
+	require.NoError(t, s.Remove("persistence", entries[1].ID))
+	_, err = s.Get("persistence", entries[1].ID)
+	require.Equal(t, ErrNotFound, err)
+	require.Equal(t, ErrNotFound, s.Remove("persistence", entries[1].ID))
+
+	entries, err = s.List("persistence")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	_, err = s.Get("..", "persistence")
+	require.Equal(t, ErrNotFound, err)
+}
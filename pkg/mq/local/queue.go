@@ -2,26 +2,61 @@ package local
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/mq"
 
 	"github.com/pkg/errors"
 )
 
 type eventHandler func(*eventagg.Event) error
 
+type Config struct {
+	// Default is used for subscribers without own configuration
+	Default     SubscriberConfig
+	Subscribers map[string]SubscriberConfig
+	// DeadLetters keeps events failed after all retries, dropped when nil
+	DeadLetters mq.DeadLetterStore
+	// DrainTimeout limits delivery of buffered events on shutdown
+	DrainTimeout time.Duration
+}
+
 type Queue struct {
 	// when events are too fast
 	// channel could be blocked too many times
 	started int32
 	ch      chan *eventagg.Event
+	cfg     Config
+
+	// inserts hold read lock while sending to ch, shutdown takes write
+	// lock so no insert is in flight once queue is stopped
+	mtxInsert sync.RWMutex
+	// stopping is closed on shutdown to unblock waiting inserts
+	stopping chan struct{}
 
 	mtxSubscribers sync.Mutex
-	subscribers    []eventHandler
+	subscribers    []*subscriber
+
+	// pauses are handled by delivery loop between pushes
+	pauses chan pauseRequest
 }
 
+type pauseRequest struct {
+	f    func() error
+	done chan error
+}
+
+// DefaultDrainTimeout is used when drain timeout is not configured
+const DefaultDrainTimeout = 10 * time.Second
+
+// ErrNotRunning is returned by inserts before start and after shutdown
+var ErrNotRunning = errors.New("queue is not running")
+
 const (
 	// C/C++ style???????????????
 	STARTED = 1
@@ -29,57 +64,239 @@ const (
 )
 
 func New() *Queue {
+	return NewWithConfig(Config{})
+}
+
+func NewWithConfig(cfg Config) *Queue {
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = DefaultDrainTimeout
+	}
 	return &Queue{
 		started:     STOPPED,
 		ch:          make(chan *eventagg.Event, 100),
-		subscribers: make([]eventHandler, 0),
+		cfg:         cfg,
+		subscribers: make([]*subscriber, 0),
+		pauses:      make(chan pauseRequest),
 	}
 }
 
+// Start delivers events until ctx is done, then queue is drained:
+// inserts are rejected, already accepted events are delivered to subscribers
+// within DrainTimeout. Error reports events left undelivered
 func (q *Queue) Start(ctx context.Context) error {
-	if !atomic.CompareAndSwapInt32(&q.started, STOPPED, STARTED) {
+	q.mtxInsert.Lock()
+	if q.isRunning() {
+		q.mtxInsert.Unlock()
 		return errors.New("queue is already running")
 	}
+	q.stopping = make(chan struct{})
+	atomic.StoreInt32(&q.started, STARTED)
+	q.mtxInsert.Unlock()
 
-	defer func() {
-		atomic.CompareAndSwapInt32(&q.started, STARTED, STOPPED)
-		close(q.ch)
+	var wg sync.WaitGroup
+	for _, s := range q.subscribers {
+		wg.Add(1)
+		go func(s *subscriber) {
+			defer wg.Done()
+			s.run()
+		}(s)
+	}
+	delivered := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(delivered)
 	}()
 
 	for {
 		select {
 		case <-ctx.Done():
-			break
+			return q.shutdown(delivered)
 		case ev := <-q.ch:
-			for _, handler := range q.subscribers {
-				handler(ev)
-			}
+			q.push(ev)
+		case req := <-q.pauses:
+			req.done <- q.pause(ctx, req.f)
+		}
+	}
+}
+
+// pause waits until subscribers handle every pushed event and calls f,
+// new events are not pushed meanwhile
+func (q *Queue) pause(ctx context.Context, f func() error) error {
+	for {
+		idle := true
+		for _, s := range q.subscribers {
+			idle = idle && s.idle()
 		}
+		if idle {
+			return f()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// WhilePaused calls f when every accepted event is delivered to subscribers,
+// events inserted meanwhile are delivered after f returns
+func (q *Queue) WhilePaused(ctx context.Context, f func() error) error {
+	q.mtxInsert.RLock()
+	if !q.isRunning() {
+		q.mtxInsert.RUnlock()
+		return ErrNotRunning
+	}
+	stopping := q.stopping
+	q.mtxInsert.RUnlock()
+
+	req := pauseRequest{f: f, done: make(chan error, 1)}
+	select {
+	case q.pauses <- req:
+	case <-stopping:
+		return ErrNotRunning
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-req.done
+}
+
+// shutdown stops inserts and waits until subscribers deliver buffered events,
+// after DrainTimeout subscribers are aborted and the rest is undelivered
+func (q *Queue) shutdown(delivered chan struct{}) error {
+	close(q.stopping)
+	q.mtxInsert.Lock()
+	atomic.StoreInt32(&q.started, STOPPED)
+	q.mtxInsert.Unlock()
+
+	aborted := make(chan struct{})
+	deadline := time.AfterFunc(q.cfg.DrainTimeout, func() {
+		for _, s := range q.subscribers {
+			s.abort()
+		}
+		close(aborted)
+	})
+
+	// events accepted by inserts are still in channel
+	for drained := false; !drained; {
+		select {
+		case ev := <-q.ch:
+			q.push(ev)
+		default:
+			drained = true
+		}
+	}
+	for _, s := range q.subscribers {
+		s.close()
+	}
+
+	// handler stuck after abort is not waited for
+	select {
+	case <-delivered:
+		if !deadline.Stop() {
+			<-aborted
+		}
+	case <-aborted:
+	}
+
+	undelivered := []string{}
+	for _, s := range q.subscribers {
+		if n := atomic.LoadInt64(&s.undelivered); n > 0 {
+			undelivered = append(undelivered, fmt.Sprintf("%s: %d", s.name, n))
+		}
+	}
+	if len(undelivered) > 0 {
+		return errors.Errorf("queue drain timed out, undelivered events: %s", strings.Join(undelivered, ", "))
 	}
 	return nil
 }
 
+func (q *Queue) push(ev *eventagg.Event) {
+	for _, s := range q.subscribers {
+		s.push(ev)
+	}
+}
+
+// Insert accepts event until queue is stopped
 func (q *Queue) Insert(ev *eventagg.Event) error {
+	q.mtxInsert.RLock()
+	defer q.mtxInsert.RUnlock()
 	if !q.isRunning() {
-		return errors.New("queue is not running")
+		return ErrNotRunning
 	}
 
 	if ev == nil {
 		return nil
 	}
-	q.ch <- ev
-	return nil
+	select {
+	case q.ch <- ev:
+		return nil
+	case <-q.stopping:
+		return ErrNotRunning
+	}
 }
 
 func (q *Queue) Subscribe(f func(ev *eventagg.Event) error) error {
+	return q.SubscribeNamed(fmt.Sprintf("subscriber-%d", len(q.subscribers)), f)
+}
+
+// SubscribeNamed registers handler with configuration given for name
+func (q *Queue) SubscribeNamed(name string, f func(ev *eventagg.Event) error) error {
 	if q.isRunning() {
 		return errors.New("queue is already running")
 	}
 
-	q.subscribers = append(q.subscribers, f)
+	q.mtxSubscribers.Lock()
+	defer q.mtxSubscribers.Unlock()
+	for _, s := range q.subscribers {
+		if s.name == name {
+			return errors.Errorf("subscriber %s already exist", name)
+		}
+	}
+
+	cfg, ok := q.cfg.Subscribers[name]
+	if !ok {
+		cfg = q.cfg.Default
+	}
+	q.subscribers = append(q.subscribers, newSubscriber(name, cfg, f, q.cfg.DeadLetters))
 	return nil
 }
 
+// Replay puts event into buffer of subscriber with given name
+func (q *Queue) Replay(name string, ev *eventagg.Event) error {
+	q.mtxInsert.RLock()
+	defer q.mtxInsert.RUnlock()
+	if !q.isRunning() {
+		return ErrNotRunning
+	}
+
+	var target *subscriber
+	q.mtxSubscribers.Lock()
+	for _, s := range q.subscribers {
+		if s.name == name {
+			target = s
+		}
+	}
+	q.mtxSubscribers.Unlock()
+
+	if target == nil {
+		return errors.Errorf("no subscriber with name %s", name)
+	}
+	return target.push(ev)
+}
+
+// Stats reports lag and delivery counters of every subscriber
+func (q *Queue) Stats() []mq.SubscriberStats {
+	q.mtxSubscribers.Lock()
+	defer q.mtxSubscribers.Unlock()
+
+	stats := make([]mq.SubscriberStats, len(q.subscribers))
+	for i, s := range q.subscribers {
+		stats[i] = s.stats()
+	}
+	return stats
+}
+
 func (q *Queue) isRunning() bool {
 	return atomic.LoadInt32(&q.started) == STARTED
 }
@@ -2,20 +2,47 @@ package local
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/iahmedov/eventagg"
 
 	"github.com/stretchr/testify/require"
 )
 
+// startQueue runs q in background and waits until it accepts inserts
+func startQueue(t *testing.T, ctx context.Context, q *Queue) {
+	go q.Start(ctx)
+	deadline := time.Now().Add(time.Second)
+	for !q.isRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("queue did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitCount waits until counter reaches expected value or timeout exceeds
+func waitCount(counter *int64, expected int64, timeout time.Duration) int64 {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if v := atomic.LoadInt64(counter); v >= expected {
+			return v
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return atomic.LoadInt64(counter)
+}
+
 func TestQueueFlow(t *testing.T) {
 	q := New()
 
 	// add subscribers
-	callCount := 0
+	var callCount int64
 	callCounterFunc := func(ev *eventagg.Event) error {
-		callCount++
+		atomic.AddInt64(&callCount, 1)
 		return nil
 	}
 	q.Subscribe(callCounterFunc)
@@ -27,13 +54,7 @@ func TestQueueFlow(t *testing.T) {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
-	// make sure queue is going to be started
-	ch := make(chan interface{}, 1)
-	go func() {
-		ch <- struct{}{}
-		q.Start(ctx)
-	}()
-	<-ch
+	startQueue(t, ctx, q)
 
 	// try to insert new subscriber
 	require.Error(t, q.Subscribe(callCounterFunc))
@@ -43,28 +64,123 @@ func TestQueueFlow(t *testing.T) {
 		require.NoError(t, q.Insert(&eventagg.Event{}))
 	}
 
-	require.Equal(t, 200, callCount)
+	require.EqualValues(t, 200, waitCount(&callCount, 200, time.Second))
 }
 
 func TestInsertNil(t *testing.T) {
 	q := New()
 
-	callCount := 0
+	var callCount int64
 	q.Subscribe(func(ev *eventagg.Event) error {
-		callCount++
+		atomic.AddInt64(&callCount, 1)
 		return nil
 	})
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
-	// make sure queue is going to be started
-	ch := make(chan interface{}, 1)
-	go func() {
-		ch <- struct{}{}
-		q.Start(ctx)
-	}()
-	<-ch
+	startQueue(t, ctx, q)
 
 	require.NoError(t, q.Insert(nil))
-	require.Equal(t, 0, callCount)
+	require.EqualValues(t, 0, atomic.LoadInt64(&callCount))
+}
+
+func TestShutdownConcurrentInsert(t *testing.T) {
+	q := New()
+	var first, second int64
+	require.NoError(t, q.Subscribe(func(ev *eventagg.Event) error {
+		atomic.AddInt64(&first, 1)
+		return nil
+	}))
+	require.NoError(t, q.Subscribe(func(ev *eventagg.Event) error {
+		atomic.AddInt64(&second, 1)
+		return nil
+	}))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	stopped := make(chan error, 1)
+	go func() { stopped <- q.Start(ctx) }()
+	for !q.isRunning() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// inserts racing with shutdown are either accepted and delivered or rejected
+	var accepted, unexpected int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := q.Insert(&eventagg.Event{}); err != nil {
+					if err != ErrNotRunning {
+						atomic.AddInt64(&unexpected, 1)
+					}
+					return
+				}
+				atomic.AddInt64(&accepted, 1)
+			}
+		}()
+	}
+	waitCount(&accepted, 1000, time.Second)
+	cancelFunc()
+
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue did not stop")
+	}
+	wg.Wait()
+
+	require.EqualValues(t, 0, unexpected)
+	require.EqualValues(t, accepted, atomic.LoadInt64(&first))
+	require.EqualValues(t, accepted, atomic.LoadInt64(&second))
+	require.Equal(t, ErrNotRunning, q.Insert(&eventagg.Event{}))
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	q := NewWithConfig(Config{DrainTimeout: 50 * time.Millisecond})
+
+	handling := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	var fastCount int64
+	require.NoError(t, q.SubscribeNamed("stuck", func(ev *eventagg.Event) error {
+		handling <- struct{}{}
+		<-release
+		return nil
+	}))
+	require.NoError(t, q.SubscribeNamed("fast", func(ev *eventagg.Event) error {
+		atomic.AddInt64(&fastCount, 1)
+		return nil
+	}))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	stopped := make(chan error, 1)
+	go func() { stopped <- q.Start(ctx) }()
+	for !q.isRunning() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, q.Insert(&eventagg.Event{}))
+	}
+	<-handling
+	cancelFunc()
+
+	select {
+	case err := <-stopped:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue did not stop after drain timeout")
+	}
+
+	stats := q.Stats()
+	require.Equal(t, "stuck", stats[0].Name)
+	require.EqualValues(t, 9, stats[0].Undelivered, "one event is being handled")
+	require.Equal(t, "fast", stats[1].Name)
+	require.EqualValues(t, 10, stats[1].Delivered)
+	require.EqualValues(t, 0, stats[1].Undelivered)
 }
@@ -0,0 +1,111 @@
+package local
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/pkg/errors"
+)
+
+// spillFile keeps overflowed events of subscriber as json lines,
+// file is truncated every time it is fully read
+type spillFile struct {
+	fl          *os.File
+	reader      *bufio.Reader
+	readOffset  int64
+	writeOffset int64
+	count       int64
+}
+
+type offsetReader struct {
+	fl     *os.File
+	offset *int64
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.fl.ReadAt(p, *r.offset)
+	*r.offset += int64(n)
+	return n, err
+}
+
+func SpillFilePath(dir, name string) string {
+	return filepath.Join(dir, name+".spill")
+}
+
+func newSpillFile(dir, name string) (*spillFile, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	fl, err := os.OpenFile(SpillFilePath(dir, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open spill file")
+	}
+
+	s := &spillFile{fl: fl}
+	s.reader = bufio.NewReader(&offsetReader{fl: fl, offset: &s.readOffset})
+	return s, nil
+}
+
+func (s *spillFile) Write(ev *eventagg.Event) error {
+	content, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+
+	content = append(content, '\n')
+	n, err := s.fl.WriteAt(content, s.writeOffset)
+	if err != nil {
+		return errors.Wrap(err, "failed to write spill file")
+	}
+	s.writeOffset += int64(n)
+	s.count++
+	return nil
+}
+
+func (s *spillFile) Read() (*eventagg.Event, error) {
+	line, err := s.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		// reader keeps EOF hit by earlier read, while lines are written
+		// only whole, so events written after it are read again
+		s.reader.Reset(&offsetReader{fl: s.fl, offset: &s.readOffset})
+		line, err = s.reader.ReadBytes('\n')
+	}
+	s.count--
+	if s.count == 0 {
+		s.reset()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read spill file")
+	}
+
+	var ev eventagg.Event
+	if err = json.Unmarshal(line, &ev); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal event")
+	}
+	return &ev, nil
+}
+
+// Len returns count of events in file
+func (s *spillFile) Len() int64 {
+	return s.count
+}
+
+func (s *spillFile) reset() {
+	s.fl.Truncate(0)
+	s.readOffset = 0
+	s.writeOffset = 0
+	s.reader.Reset(&offsetReader{fl: s.fl, offset: &s.readOffset})
+}
+
+func (s *spillFile) Close() error {
+	name := s.fl.Name()
+	err := s.fl.Close()
+	os.Remove(name)
+	return err
+}
@@ -0,0 +1,310 @@
+package local
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/mq"
+)
+
+type OverflowPolicy string
+
+const (
+	// OverflowBlock blocks queue until subscriber frees buffer
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest evicts oldest buffered event
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowDropNewest drops incoming event
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowSpill writes events to disk until subscriber catches up
+	OverflowSpill OverflowPolicy = "spill"
+
+	DefaultBufferSize = 100
+
+	DefaultInitialBackoff = time.Millisecond * 100
+	DefaultMaxBackoff     = time.Second * 10
+)
+
+// RetryConfig controls redelivery of events failed by handler,
+// backoff is doubled after every attempt up to MaxBackoff
+type RetryConfig struct {
+	// MaxAttempts including the first one, no retries when <= 1
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+type SubscriberConfig struct {
+	BufferSize int
+	Overflow   OverflowPolicy
+	// SpillDir is directory for spill files, used with OverflowSpill
+	SpillDir string
+	Retry    RetryConfig
+}
+
+// subscriber buffers events and delivers them to handler in own goroutine
+type subscriber struct {
+	name        string
+	cfg         SubscriberConfig
+	handler     eventHandler
+	deadLetters mq.DeadLetterStore
+	done        chan struct{}
+
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	buf    []*eventagg.Event
+	spill  *spillFile
+	closed bool
+	// aborted subscriber stops delivery of buffered events
+	aborted bool
+	// busy is set while popped event is delivered
+	busy bool
+
+	delivered, failed, retried, deadLettered, dropped, spilled int64
+	// events left buffered when subscriber was aborted
+	undelivered int64
+}
+
+func newSubscriber(name string, cfg SubscriberConfig, handler eventHandler, deadLetters mq.DeadLetterStore) *subscriber {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultBufferSize
+	}
+	if cfg.Overflow == "" {
+		cfg.Overflow = OverflowBlock
+	}
+	if cfg.Retry.InitialBackoff <= 0 {
+		cfg.Retry.InitialBackoff = DefaultInitialBackoff
+	}
+	if cfg.Retry.MaxBackoff <= 0 {
+		cfg.Retry.MaxBackoff = DefaultMaxBackoff
+	}
+
+	s := &subscriber{
+		name:        name,
+		cfg:         cfg,
+		handler:     handler,
+		deadLetters: deadLetters,
+		done:        make(chan struct{}),
+		buf:         make([]*eventagg.Event, 0, cfg.BufferSize),
+	}
+	s.cond = sync.NewCond(&s.mtx)
+	return s
+}
+
+// push buffers event according to overflow policy
+func (s *subscriber) push(ev *eventagg.Event) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.aborted {
+		atomic.AddInt64(&s.undelivered, 1)
+		return nil
+	}
+	if s.closed {
+		atomic.AddInt64(&s.dropped, 1)
+		return nil
+	}
+
+	// keep order, once spilling started every event goes to disk
+	if s.cfg.Overflow == OverflowSpill && (len(s.buf) >= s.cfg.BufferSize || s.spillLen() > 0) {
+		if s.spill == nil {
+			spill, err := newSpillFile(s.cfg.SpillDir, s.name)
+			if err != nil {
+				atomic.AddInt64(&s.dropped, 1)
+				return err
+			}
+			s.spill = spill
+		}
+		if err := s.spill.Write(ev); err != nil {
+			atomic.AddInt64(&s.dropped, 1)
+			return err
+		}
+		atomic.AddInt64(&s.spilled, 1)
+		s.cond.Broadcast()
+		return nil
+	}
+
+	for len(s.buf) >= s.cfg.BufferSize {
+		switch s.cfg.Overflow {
+		case OverflowDropNewest:
+			atomic.AddInt64(&s.dropped, 1)
+			return nil
+		case OverflowDropOldest:
+			s.buf[0] = nil
+			s.buf = s.buf[1:]
+			atomic.AddInt64(&s.dropped, 1)
+		default:
+			s.cond.Wait()
+			if s.aborted {
+				atomic.AddInt64(&s.undelivered, 1)
+				return nil
+			}
+			if s.closed {
+				atomic.AddInt64(&s.dropped, 1)
+				return nil
+			}
+		}
+	}
+
+	s.buf = append(s.buf, ev)
+	s.cond.Broadcast()
+	return nil
+}
+
+// pop waits for next event, returns nil when subscriber is closed
+// and every buffered event is delivered
+func (s *subscriber) pop() *eventagg.Event {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// previous event is delivered
+	s.busy = false
+	for len(s.buf) == 0 && s.spillLen() == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.aborted {
+		return nil
+	}
+
+	if len(s.buf) > 0 {
+		ev := s.buf[0]
+		s.buf[0] = nil
+		s.buf = s.buf[1:]
+		s.busy = true
+		s.cond.Broadcast()
+		return ev
+	}
+
+	for s.spillLen() > 0 {
+		ev, err := s.spill.Read()
+		if err == nil {
+			s.busy = true
+			return ev
+		}
+		// event could not be restored from disk
+		atomic.AddInt64(&s.dropped, 1)
+	}
+	return nil
+}
+
+// deliver calls handler retrying with backoff, event is moved to dead
+// letter store when all attempts failed
+func (s *subscriber) deliver(ev *eventagg.Event) {
+	backoff := s.cfg.Retry.InitialBackoff
+	attempt := 1
+	for {
+		err := s.handler(ev)
+		if err == nil {
+			atomic.AddInt64(&s.delivered, 1)
+			return
+		}
+
+		if attempt >= s.cfg.Retry.MaxAttempts || !s.wait(backoff) {
+			atomic.AddInt64(&s.failed, 1)
+			if s.deadLetters == nil {
+				return
+			}
+			if s.deadLetters.Add(s.name, ev, err, attempt) == nil {
+				atomic.AddInt64(&s.deadLettered, 1)
+			} else {
+				atomic.AddInt64(&s.dropped, 1)
+			}
+			return
+		}
+
+		atomic.AddInt64(&s.retried, 1)
+		attempt++
+		backoff *= 2
+		if backoff > s.cfg.Retry.MaxBackoff {
+			backoff = s.cfg.Retry.MaxBackoff
+		}
+	}
+}
+
+// wait sleeps for given duration, returns false if subscriber was closed
+func (s *subscriber) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *subscriber) run() {
+	for ev := s.pop(); ev != nil; ev = s.pop() {
+		s.deliver(ev)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.spill != nil {
+		s.spill.Close()
+		s.spill = nil
+	}
+}
+
+func (s *subscriber) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.cond.Broadcast()
+}
+
+// abort closes subscriber and counts buffered events as undelivered
+func (s *subscriber) abort() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.aborted {
+		return
+	}
+	s.aborted = true
+	atomic.AddInt64(&s.undelivered, int64(len(s.buf))+s.spillLen())
+	s.buf = s.buf[:0]
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	s.cond.Broadcast()
+}
+
+// idle reports whether every pushed event is delivered
+func (s *subscriber) idle() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.buf) == 0 && s.spillLen() == 0 && !s.busy
+}
+
+func (s *subscriber) spillLen() int64 {
+	if s.spill == nil {
+		return 0
+	}
+	return s.spill.Len()
+}
+
+func (s *subscriber) stats() mq.SubscriberStats {
+	s.mtx.Lock()
+	lag := int64(len(s.buf)) + s.spillLen()
+	s.mtx.Unlock()
+
+	return mq.SubscriberStats{
+		Name:         s.name,
+		Lag:          lag,
+		Delivered:    atomic.LoadInt64(&s.delivered),
+		Failed:       atomic.LoadInt64(&s.failed),
+		Retried:      atomic.LoadInt64(&s.retried),
+		DeadLettered: atomic.LoadInt64(&s.deadLettered),
+		Dropped:      atomic.LoadInt64(&s.dropped),
+		Spilled:      atomic.LoadInt64(&s.spilled),
+		Undelivered:  atomic.LoadInt64(&s.undelivered),
+	}
+}
@@ -0,0 +1,234 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowSubscriberIsolation(t *testing.T) {
+	q := NewWithConfig(Config{
+		Subscribers: map[string]SubscriberConfig{
+			"slow": {BufferSize: 5, Overflow: OverflowDropNewest},
+		},
+	})
+
+	release := make(chan struct{})
+	var fastCount int64
+	require.NoError(t, q.SubscribeNamed("slow", func(ev *eventagg.Event) error {
+		<-release
+		return nil
+	}))
+	require.NoError(t, q.SubscribeNamed("fast", func(ev *eventagg.Event) error {
+		atomic.AddInt64(&fastCount, 1)
+		return nil
+	}))
+	require.Error(t, q.SubscribeNamed("fast", nil))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	startQueue(t, ctx, q)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, q.Insert(&eventagg.Event{}))
+	}
+	require.EqualValues(t, 100, waitCount(&fastCount, 100, time.Second))
+
+	stats := q.Stats()
+	require.Len(t, stats, 2)
+	require.Equal(t, "slow", stats[0].Name)
+	// at most one event is being handled, the rest is buffered or dropped
+	require.True(t, stats[0].Lag <= 5)
+	require.True(t, stats[0].Lag+stats[0].Dropped >= 99)
+	require.True(t, stats[0].Dropped > 0)
+	require.Equal(t, "fast", stats[1].Name)
+	require.EqualValues(t, 100, stats[1].Delivered)
+	close(release)
+}
+
+func collect(s *subscriber) (*sync.WaitGroup, *[]int64) {
+	var wg sync.WaitGroup
+	received := []int64{}
+	s.handler = func(ev *eventagg.Event) error {
+		received = append(received, ev.Time)
+		return nil
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.run()
+	}()
+	return &wg, &received
+}
+
+func TestDropOldest(t *testing.T) {
+	s := newSubscriber("sub", SubscriberConfig{BufferSize: 3, Overflow: OverflowDropOldest}, nil, nil)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.push(&eventagg.Event{Time: int64(i)}))
+	}
+	require.EqualValues(t, 7, s.stats().Dropped)
+
+	wg, received := collect(s)
+	s.close()
+	wg.Wait()
+	require.Equal(t, []int64{7, 8, 9}, *received)
+}
+
+func TestSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := newSubscriber("sub", SubscriberConfig{BufferSize: 3, Overflow: OverflowSpill, SpillDir: dir}, nil, nil)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.push(&eventagg.Event{Time: int64(i)}))
+	}
+	stats := s.stats()
+	require.EqualValues(t, 7, stats.Spilled)
+	require.EqualValues(t, 10, stats.Lag)
+	require.EqualValues(t, 0, stats.Dropped)
+
+	wg, received := collect(s)
+	// pushes after spill is drained keep order
+	require.NoError(t, s.push(&eventagg.Event{Time: 10}))
+	s.close()
+	wg.Wait()
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, *received)
+
+	_, err = os.Stat(SpillFilePath(dir, "sub"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSpillFileInterleaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spill, err := newSpillFile(dir, "sub")
+	require.NoError(t, err)
+	defer spill.Close()
+
+	// the first read reaches end of file, the last event is written after it
+	require.NoError(t, spill.Write(&eventagg.Event{Time: 1}))
+	require.NoError(t, spill.Write(&eventagg.Event{Time: 2}))
+	received := []int64{}
+	ev, err := spill.Read()
+	require.NoError(t, err)
+	received = append(received, ev.Time)
+	require.NoError(t, spill.Write(&eventagg.Event{Time: 3}))
+	for spill.Len() > 0 {
+		ev, err = spill.Read()
+		require.NoError(t, err)
+		received = append(received, ev.Time)
+	}
+	require.Equal(t, []int64{1, 2, 3}, received)
+}
+
+func TestBlock(t *testing.T) {
+	s := newSubscriber("sub", SubscriberConfig{BufferSize: 1}, nil, nil)
+	require.NoError(t, s.push(&eventagg.Event{Time: 0}))
+
+	pushed := make(chan struct{})
+	go func() {
+		s.push(&eventagg.Event{Time: 1})
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push should block while buffer is full")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	wg, received := collect(s)
+	<-pushed
+	s.close()
+	wg.Wait()
+	require.Equal(t, []int64{0, 1}, *received)
+}
+
+type memoryDeadLetters struct {
+	mtx      sync.Mutex
+	events   []*eventagg.Event
+	attempts []int
+}
+
+func (d *memoryDeadLetters) Add(subscriber string, ev *eventagg.Event, cause error, attempts int) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.events = append(d.events, ev)
+	d.attempts = append(d.attempts, attempts)
+	return nil
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	deadLetters := &memoryDeadLetters{}
+	s := newSubscriber("sub", SubscriberConfig{
+		Retry: RetryConfig{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond * 2,
+		},
+	}, nil, deadLetters)
+
+	calls := map[int64]int{}
+	s.handler = func(ev *eventagg.Event) error {
+		calls[ev.Time]++
+		// event 0 succeeds on second attempt, event 1 always fails
+		if ev.Time == 0 && calls[ev.Time] == 2 {
+			return nil
+		}
+		return errors.New("failed")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.run()
+	}()
+	s.push(&eventagg.Event{Time: 0})
+	s.push(&eventagg.Event{Time: 1})
+	for s.stats().Lag > 0 || s.stats().Delivered+s.stats().Failed < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	s.close()
+	wg.Wait()
+
+	require.Equal(t, map[int64]int{0: 2, 1: 3}, calls)
+	stats := s.stats()
+	require.EqualValues(t, 1, stats.Delivered)
+	require.EqualValues(t, 1, stats.Failed)
+	require.EqualValues(t, 3, stats.Retried)
+	require.EqualValues(t, 1, stats.DeadLettered)
+	require.Len(t, deadLetters.events, 1)
+	require.EqualValues(t, 1, deadLetters.events[0].Time)
+	require.Equal(t, []int{3}, deadLetters.attempts)
+}
+
+func TestReplay(t *testing.T) {
+	q := New()
+	var count int64
+	q.SubscribeNamed("sub", func(ev *eventagg.Event) error {
+		atomic.AddInt64(&count, 1)
+		return nil
+	})
+	require.Error(t, q.Replay("sub", &eventagg.Event{})) // queue not started
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	startQueue(t, ctx, q)
+
+	require.Error(t, q.Replay("unknown", &eventagg.Event{}))
+	require.NoError(t, q.Replay("sub", &eventagg.Event{}))
+	require.EqualValues(t, 1, waitCount(&count, 1, time.Second))
+}
@@ -0,0 +1,63 @@
+package mq
+
+import (
+	"context"
+
+	"github.com/iahmedov/eventagg"
+)
+
+// Queue delivers inserted events to every subscriber
+type Queue interface {
+	Insert(ev *eventagg.Event) error
+	// Subscribe registers handler, allowed only before Start
+	Subscribe(f func(ev *eventagg.Event) error) error
+	// Start delivers events until ctx is done. Local queue delivers events
+	// accepted by Insert before it returns (within drain timeout), wal queue
+	// keeps not delivered events in log and delivers them after restart
+	Start(ctx context.Context) error
+}
+
+// NamedQueue identifies subscribers by name, so they could be configured
+// independently and reported in stats
+type NamedQueue interface {
+	Queue
+	SubscribeNamed(name string, f func(ev *eventagg.Event) error) error
+}
+
+// StatsProvider reports delivery state of every subscriber
+type StatsProvider interface {
+	Stats() []SubscriberStats
+}
+
+type SubscriberStats struct {
+	Name string `json:"name"`
+	// Lag is count of events waiting for delivery
+	Lag       int64 `json:"lag"`
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+	Retried   int64 `json:"retried"`
+	// DeadLettered is count of failed events moved to dead letter store
+	DeadLettered int64 `json:"dead_lettered"`
+	Dropped      int64 `json:"dropped"`
+	Spilled      int64 `json:"spilled"`
+	// Undelivered is count of events left buffered when shutdown timed out
+	Undelivered int64 `json:"undelivered"`
+}
+
+// Pauser stops delivery at the same point of stream for every subscriber,
+// used to read state of several subscribers consistently
+type Pauser interface {
+	// WhilePaused calls f once every event delivered before pause is
+	// handled and no other event is delivered until f returns
+	WhilePaused(ctx context.Context, f func() error) error
+}
+
+// Replayer delivers event to single subscriber again
+type Replayer interface {
+	Replay(subscriber string, ev *eventagg.Event) error
+}
+
+// DeadLetterStore keeps events subscribers failed to handle
+type DeadLetterStore interface {
+	Add(subscriber string, ev *eventagg.Event, cause error, attempts int) error
+}
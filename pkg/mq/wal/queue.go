@@ -0,0 +1,442 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/mq"
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/pkg/errors"
+)
+
+type eventHandler func(*eventagg.Event) error
+
+type subscriber struct {
+	name    string
+	handler eventHandler
+}
+
+type Config struct {
+	Dir string
+	// CompactSize is size of fully acknowledged log after which it is truncated
+	CompactSize int64
+	// failed handlers are retried with backoff doubled after every attempt,
+	// MaxAttempts includes the first one, no retries when <= 1
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// DeadLetters keeps events failed after all attempts, dropped when nil
+	DeadLetters mq.DeadLetterStore
+}
+
+// Queue is durable queue backed by write ahead log, every inserted event
+// is synced to disk before Insert returns. Event is acknowledged once every
+// subscriber handled it, delivery is at least once: events not acknowledged
+// or acknowledged after the last sync of ack file are replayed after restart
+type Queue struct {
+	started int32
+	cfg     Config
+
+	mtxLog      sync.Mutex
+	log         *os.File
+	writeOffset int64
+
+	// accessed only by delivery loop
+	ack        *os.File
+	readOffset int64
+
+	notify      chan struct{}
+	subscribers []subscriber
+
+	// pauses are handled by delivery loop between events
+	pauses chan pauseRequest
+}
+
+type pauseRequest struct {
+	f    func() error
+	done chan error
+}
+
+const (
+	STARTED = 1
+	STOPPED = 0
+
+	DefaultCompactSize int64 = 64 << 20
+
+	DefaultInitialBackoff = time.Millisecond * 100
+	DefaultMaxBackoff     = time.Second * 10
+)
+
+// output format:
+// - queue.wal - sequence of records, see pkg/record
+// - queue.ack - [8 bytes] offset of first not acknowledged record
+func LogFilePath(dir string) string {
+	return filepath.Join(dir, "queue.wal")
+}
+
+func AckFilePath(dir string) string {
+	return filepath.Join(dir, "queue.ack")
+}
+
+func New(cfg Config) (*Queue, error) {
+	if cfg.CompactSize <= 0 {
+		cfg.CompactSize = DefaultCompactSize
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = DefaultInitialBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+
+	fileInfo, err := os.Stat(cfg.Dir)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		if err = os.MkdirAll(cfg.Dir, 0777); err != nil {
+			return nil, errors.Wrap(err, "failed to create folder")
+		}
+	case err != nil:
+		return nil, errors.Wrap(err, "failed to read file info")
+	default:
+		if !fileInfo.IsDir() {
+			return nil, errors.New("invalid type for queue dir")
+		}
+	}
+
+	logFile, err := os.OpenFile(LogFilePath(cfg.Dir), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open log file")
+	}
+	ackFile, err := os.OpenFile(AckFilePath(cfg.Dir), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		logFile.Close()
+		return nil, errors.Wrap(err, "failed to open ack file")
+	}
+
+	q := &Queue{
+		started:     STOPPED,
+		cfg:         cfg,
+		log:         logFile,
+		ack:         ackFile,
+		notify:      make(chan struct{}, 1),
+		subscribers: make([]subscriber, 0),
+		pauses:      make(chan pauseRequest),
+	}
+	if err = q.recover(); err != nil {
+		q.Close()
+		return nil, errors.Wrap(err, "failed to recover log")
+	}
+	return q, nil
+}
+
+// recover reads acknowledged offset and truncates torn records
+// at the end of log left after crash
+func (q *Queue) recover() error {
+	var raw [8]byte
+	n, err := q.ack.ReadAt(raw[:], 0)
+	if n == len(raw) {
+		q.readOffset = int64(binary.BigEndian.Uint64(raw[:]))
+	} else if n > 0 && err != nil {
+		return errors.Wrap(err, "failed to read ack file")
+	}
+
+	logInfo, err := q.log.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to read log file info")
+	}
+	if q.readOffset > logInfo.Size() {
+		q.readOffset = logInfo.Size()
+	}
+
+	validEnd, err := record.Scan(q.log, q.readOffset, logInfo.Size(), nil)
+	if err != nil {
+		return err
+	}
+
+	if validEnd < logInfo.Size() {
+		if err := q.log.Truncate(validEnd); err != nil {
+			return errors.Wrap(err, "failed to truncate torn records")
+		}
+	}
+	q.writeOffset = validEnd
+	if err = q.storeAck(); err != nil {
+		return err
+	}
+	return q.syncAck()
+}
+
+func (q *Queue) storeAck() error {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], uint64(q.readOffset))
+	_, err := q.ack.WriteAt(raw[:], 0)
+	return errors.Wrap(err, "failed to write ack offset")
+}
+
+func (q *Queue) syncAck() error {
+	return errors.Wrap(q.ack.Sync(), "failed to sync ack file")
+}
+
+// Pending returns size in bytes of events waiting for delivery
+func (q *Queue) Pending() int64 {
+	q.mtxLog.Lock()
+	defer q.mtxLog.Unlock()
+	return q.writeOffset - q.readOffset
+}
+
+func (q *Queue) Start(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&q.started, STOPPED, STARTED) {
+		return errors.New("queue is already running")
+	}
+	defer atomic.CompareAndSwapInt32(&q.started, STARTED, STOPPED)
+
+	for {
+		if err := q.deliver(ctx); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-q.notify:
+		case req := <-q.pauses:
+			req.done <- q.pause(req.f)
+		}
+	}
+}
+
+// pause syncs acknowledged offset and calls f, so events handled before f
+// are not replayed after restart
+func (q *Queue) pause(f func() error) error {
+	if err := q.syncAck(); err != nil {
+		return err
+	}
+	return f()
+}
+
+// WhilePaused calls f between delivered events, events are not delivered
+// until f returns
+func (q *Queue) WhilePaused(ctx context.Context, f func() error) error {
+	if !q.isRunning() {
+		return errors.New("queue is not running")
+	}
+
+	req := pauseRequest{f: f, done: make(chan error, 1)}
+	select {
+	case q.pauses <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-req.done
+}
+
+// deliver sends every not acknowledged event to subscribers, ack file is
+// synced once delivery caught up with log or ctx is done
+func (q *Queue) deliver(ctx context.Context) error {
+	for ctx.Err() == nil {
+		select {
+		case req := <-q.pauses:
+			req.done <- q.pause(req.f)
+		default:
+		}
+
+		q.mtxLog.Lock()
+		end := q.writeOffset
+		q.mtxLog.Unlock()
+		if q.readOffset >= end {
+			break
+		}
+
+		payload, size, err := record.Read(q.log, q.readOffset, end)
+		if err == record.ErrChecksum || err == record.ErrTorn {
+			// records before write offset are fully written,
+			// corrupted ones are skipped as record.Scan does
+			if q.readOffset, err = nextRecord(q.log, q.readOffset, end); err != nil {
+				return err
+			}
+			if err = q.storeAck(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read log")
+		}
+
+		var ev eventagg.Event
+		if err = json.Unmarshal(payload, &ev); err != nil {
+			return errors.Wrapf(err, "failed to decode event at offset %d", q.readOffset)
+		}
+		if !q.handle(ctx, &ev) {
+			break
+		}
+
+		q.readOffset += size
+		if err = q.storeAck(); err != nil {
+			return err
+		}
+	}
+	if err := q.compact(); err != nil {
+		return err
+	}
+	return q.syncAck()
+}
+
+// handle calls every subscriber, failed ones are retried with backoff until
+// they succeed or run out of attempts, then event is moved to dead letter
+// store or dropped without it. Returns false if ctx is done before event
+// is handled
+func (q *Queue) handle(ctx context.Context, ev *eventagg.Event) bool {
+	pending := q.subscribers
+	backoff := q.cfg.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		failed := make([]subscriber, 0)
+		for _, s := range pending {
+			err := s.handler(ev)
+			if err == nil {
+				continue
+			}
+			// event is kept in log while dead letter store fails
+			if attempt < q.cfg.MaxAttempts ||
+				(q.cfg.DeadLetters != nil && q.cfg.DeadLetters.Add(s.name, ev, err, attempt) != nil) {
+				failed = append(failed, s)
+			}
+		}
+		if len(failed) == 0 {
+			return true
+		}
+		pending = failed
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > q.cfg.MaxBackoff {
+			backoff = q.cfg.MaxBackoff
+		}
+	}
+}
+
+// errFound stops scan at the first valid record
+var errFound = errors.New("found")
+
+// nextRecord returns offset of the first valid record after corrupted one
+// at offset, or end when there are no valid records
+func nextRecord(log *os.File, offset, end int64) (int64, error) {
+	next := end
+	_, err := record.Scan(log, offset, end, func(_ []byte, begin, _ int64) error {
+		next = begin
+		return errFound
+	})
+	if err != nil && err != errFound {
+		return 0, err
+	}
+	return next, nil
+}
+
+// compact truncates log when every event in it is acknowledged
+func (q *Queue) compact() error {
+	q.mtxLog.Lock()
+	defer q.mtxLog.Unlock()
+
+	if q.readOffset != q.writeOffset || q.writeOffset < q.cfg.CompactSize {
+		return nil
+	}
+
+	if err := q.log.Truncate(0); err != nil {
+		return errors.Wrap(err, "failed to truncate log")
+	}
+	q.writeOffset = 0
+	q.readOffset = 0
+	return q.storeAck()
+}
+
+func (q *Queue) Insert(ev *eventagg.Event) error {
+	if !q.isRunning() {
+		return errors.New("queue is not running")
+	}
+
+	if ev == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+	rec := record.Encode(payload)
+
+	q.mtxLog.Lock()
+	defer q.mtxLog.Unlock()
+	if q.log == nil {
+		return errors.New("queue closed")
+	}
+	if _, err = q.log.Write(rec); err != nil {
+		// drop partially written record
+		q.log.Truncate(q.writeOffset)
+		return errors.Wrap(err, "failed to write to log")
+	}
+	if err = q.log.Sync(); err != nil {
+		// insert failed, record is not delivered and next one is
+		// written at write offset
+		q.log.Truncate(q.writeOffset)
+		return errors.Wrap(err, "failed to sync log")
+	}
+	q.writeOffset += int64(len(rec))
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *Queue) Subscribe(f func(ev *eventagg.Event) error) error {
+	return q.SubscribeNamed(fmt.Sprintf("subscriber-%d", len(q.subscribers)), f)
+}
+
+// SubscribeNamed registers handler, name identifies it in dead letter store
+func (q *Queue) SubscribeNamed(name string, f func(ev *eventagg.Event) error) error {
+	if q.isRunning() {
+		return errors.New("queue is already running")
+	}
+
+	for _, s := range q.subscribers {
+		if s.name == name {
+			return errors.Errorf("subscriber %s already exist", name)
+		}
+	}
+	q.subscribers = append(q.subscribers, subscriber{name: name, handler: f})
+	return nil
+}
+
+// Close releases log files, should be called after Start returned
+func (q *Queue) Close() error {
+	q.mtxLog.Lock()
+	defer q.mtxLog.Unlock()
+
+	if q.log == nil {
+		return errors.New("already closed")
+	}
+	q.ack.Sync()
+	q.ack.Close()
+	err := q.log.Close()
+	q.log = nil
+	return err
+}
+
+func (q *Queue) isRunning() bool {
+	return atomic.LoadInt32(&q.started) == STARTED
+}
@@ -0,0 +1,378 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func startQueue(t *testing.T, ctx context.Context, q *Queue) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Start(ctx)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !q.isRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("queue did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+type collector struct {
+	mtx    sync.Mutex
+	events []int64
+}
+
+func (c *collector) Add(ev *eventagg.Event) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.events = append(c.events, ev.Time)
+	return nil
+}
+
+func (c *collector) wait(t *testing.T, count int) []int64 {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mtx.Lock()
+		n := len(c.events)
+		c.mtx.Unlock()
+		if n >= count {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]int64{}, c.events...)
+}
+
+func TestQueueFlow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+	defer q.Close()
+
+	c := &collector{}
+	require.NoError(t, q.Subscribe(c.Add))
+	require.Error(t, q.Insert(&eventagg.Event{})) // queue not started
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	done := startQueue(t, ctx, q)
+	require.Error(t, q.Subscribe(c.Add))
+
+	require.NoError(t, q.Insert(nil))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, q.Insert(&eventagg.Event{Time: int64(i)}))
+	}
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, c.wait(t, 10))
+
+	cancelFunc()
+	require.NoError(t, <-done)
+	require.EqualValues(t, 0, q.Pending())
+}
+
+func TestReplayAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+
+	// first subscriber gets stuck on 5th event as if process crashed
+	release := make(chan struct{})
+	c := &collector{}
+	q.Subscribe(func(ev *eventagg.Event) error {
+		if ev.Time >= 5 {
+			<-release
+		}
+		return c.Add(ev)
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	startQueue(t, ctx, q)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, q.Insert(&eventagg.Event{Time: int64(i)}))
+	}
+	require.Equal(t, []int64{0, 1, 2, 3, 4}, c.wait(t, 5))
+
+	// not acknowledged events are delivered by new instance
+	restarted, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+	defer restarted.Close()
+	rc := &collector{}
+	restarted.Subscribe(rc.Add)
+	startQueue(t, ctx, restarted)
+	require.Equal(t, []int64{5, 6, 7, 8, 9}, rc.wait(t, 5))
+
+	close(release)
+	cancelFunc()
+}
+
+func TestTruncateTornTail(t *testing.T) {
+	tails := map[string][]byte{
+		"torn record": record.Encode([]byte(`{"ts":2}`))[:10],
+		// left by power loss
+		"zero filled": make([]byte, 16),
+	}
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "eventagg-wal")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fl, err := os.OpenFile(LogFilePath(dir), os.O_RDWR|os.O_CREATE, 0666)
+			require.NoError(t, err)
+			fl.Write(record.Encode([]byte(`{"ts":1}`)))
+			fl.Write(tail)
+			fl.Close()
+
+			q, err := New(Config{Dir: dir})
+			require.NoError(t, err)
+			defer q.Close()
+			require.EqualValues(t, record.HeaderSize+len(`{"ts":1}`), q.Pending())
+
+			c := &collector{}
+			q.Subscribe(c.Add)
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+			startQueue(t, ctx, q)
+			require.NoError(t, q.Insert(&eventagg.Event{Time: 3}))
+			require.Equal(t, []int64{1, 3}, c.wait(t, 2))
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := New(Config{Dir: dir, CompactSize: 1})
+	require.NoError(t, err)
+	defer q.Close()
+
+	c := &collector{}
+	q.Subscribe(c.Add)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	startQueue(t, ctx, q)
+
+	require.NoError(t, q.Insert(&eventagg.Event{Time: 1}))
+	c.wait(t, 1)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		info, err := os.Stat(LogFilePath(dir))
+		require.NoError(t, err)
+		if info.Size() == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("log was not compacted")
+}
+
+func TestRetryFailedHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := New(Config{Dir: dir, MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	require.NoError(t, err)
+
+	// the first subscriber fails twice, the second one is not called again
+	var attempts int32
+	c := &collector{}
+	q.Subscribe(func(ev *eventagg.Event) error {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			return errors.New("not now")
+		}
+		return nil
+	})
+	q.Subscribe(c.Add)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	done := startQueue(t, ctx, q)
+	require.NoError(t, q.Insert(&eventagg.Event{Time: 1}))
+	require.NoError(t, q.Insert(&eventagg.Event{Time: 2}))
+	require.Equal(t, []int64{1, 2}, c.wait(t, 2))
+	require.EqualValues(t, 4, atomic.LoadInt32(&attempts))
+
+	cancelFunc()
+	require.NoError(t, <-done)
+	require.EqualValues(t, 0, q.Pending())
+	require.NoError(t, q.Close())
+}
+
+type deadLetter struct {
+	subscriber string
+	ts         int64
+	attempts   int
+}
+
+type memoryDeadLetters struct {
+	mtx    sync.Mutex
+	events []deadLetter
+}
+
+func (d *memoryDeadLetters) Add(subscriber string, ev *eventagg.Event, cause error, attempts int) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.events = append(d.events, deadLetter{subscriber, ev.Time, attempts})
+	return nil
+}
+
+func TestPoisonEventDeadLettered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	deadLetters := &memoryDeadLetters{}
+	q, err := New(Config{
+		Dir:            dir,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		DeadLetters:    deadLetters,
+	})
+	require.NoError(t, err)
+	defer q.Close()
+
+	// event 1 always fails, it does not block delivery of next ones
+	c := &collector{}
+	require.NoError(t, q.SubscribeNamed("poisoned", func(ev *eventagg.Event) error {
+		if ev.Time == 1 {
+			return errors.New("always")
+		}
+		return c.Add(ev)
+	}))
+	require.Error(t, q.SubscribeNamed("poisoned", c.Add))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	done := startQueue(t, ctx, q)
+	require.NoError(t, q.Insert(&eventagg.Event{Time: 1}))
+	require.NoError(t, q.Insert(&eventagg.Event{Time: 2}))
+	require.Equal(t, []int64{2}, c.wait(t, 1))
+	cancelFunc()
+	require.NoError(t, <-done)
+
+	require.EqualValues(t, 0, q.Pending())
+	require.Equal(t, []deadLetter{{"poisoned", 1, 3}}, deadLetters.events)
+}
+
+func TestFailedHandlerIsNotAcknowledged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := New(Config{Dir: dir, MaxAttempts: 1000, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	require.NoError(t, err)
+	failing := make(chan struct{}, 1)
+	q.Subscribe(func(ev *eventagg.Event) error {
+		select {
+		case failing <- struct{}{}:
+		default:
+		}
+		return errors.New("always")
+	})
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	done := startQueue(t, ctx, q)
+	require.NoError(t, q.Insert(&eventagg.Event{Time: 1}))
+	<-failing
+	cancelFunc()
+	require.NoError(t, <-done)
+	require.NoError(t, q.Close())
+
+	// event is delivered again after restart
+	restarted, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+	defer restarted.Close()
+	c := &collector{}
+	restarted.Subscribe(c.Add)
+	ctx, cancelFunc = context.WithCancel(context.Background())
+	defer cancelFunc()
+	startQueue(t, ctx, restarted)
+	require.Equal(t, []int64{1}, c.wait(t, 1))
+}
+
+func TestUndecodableEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fl, err := os.OpenFile(LogFilePath(dir), os.O_RDWR|os.O_CREATE, 0666)
+	require.NoError(t, err)
+	fl.Write(record.Encode([]byte(`not json`)))
+	fl.Close()
+
+	q, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+	defer q.Close()
+	q.Subscribe((&collector{}).Add)
+
+	// delivery stops instead of acknowledging event
+	require.Error(t, q.Start(context.Background()))
+	require.EqualValues(t, record.HeaderSize+len(`not json`), q.Pending())
+}
+
+func TestWhilePaused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+	defer q.Close()
+
+	first, second := &collector{}, &collector{}
+	require.NoError(t, q.Subscribe(first.Add))
+	require.NoError(t, q.Subscribe(second.Add))
+	require.Error(t, q.WhilePaused(context.Background(), func() error { return nil }))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	done := startQueue(t, ctx, q)
+	inserted := make(chan struct{})
+	go func() {
+		defer close(inserted)
+		for ts := int64(1); ts <= 200; ts++ {
+			require.NoError(t, q.Insert(&eventagg.Event{Time: ts}))
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, q.WhilePaused(ctx, func() error {
+			// every subscriber handled the same events, their ack is synced
+			require.Equal(t, first.wait(t, 0), second.wait(t, 0))
+			raw, err := ioutil.ReadFile(AckFilePath(dir))
+			require.NoError(t, err)
+			require.EqualValues(t, q.readOffset, binary.BigEndian.Uint64(raw))
+			return nil
+		}))
+		time.Sleep(time.Millisecond)
+	}
+	<-inserted
+	require.Len(t, first.wait(t, 200), 200)
+
+	cancelFunc()
+	require.NoError(t, <-done)
+}
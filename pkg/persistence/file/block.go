@@ -0,0 +1,71 @@
+package file
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// compressed data file contains framed records of zstd compressed blocks,
+// every block is framed records of events. Index entries of compressed
+// segment are [block_pos,intra_pos,ts]:
+// - block_pos - position of block record in data file
+// - intra_pos - position of event record in decompressed block
+// - ts - event timestamp
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+
+	DefaultBlockSize = 64 * 1024
+)
+
+var (
+	// encoder and decoder are safe for concurrent EncodeAll and DecodeAll
+	blockEncoder, _ = zstd.NewWriter(nil)
+	blockDecoder, _ = zstd.NewReader(nil)
+)
+
+// EncodeBlock compresses block of event records into data file record
+func EncodeBlock(block []byte) []byte {
+	return record.Encode(blockEncoder.EncodeAll(block, nil))
+}
+
+// ReadBlock reads and decompresses block record at offset of data ending
+// at dataEnd, returns decompressed block and size of record in data file,
+// size of corrupted record is returned with record.ErrChecksum
+func ReadBlock(r io.ReaderAt, offset, dataEnd int64) ([]byte, int64, error) {
+	payload, size, err := record.Read(r, offset, dataEnd)
+	if err != nil {
+		return nil, size, err
+	}
+
+	block, err := DecodeBlock(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return block, size, nil
+}
+
+// DecodeBlock decompresses payload of block record
+func DecodeBlock(payload []byte) ([]byte, error) {
+	block, err := blockDecoder.DecodeAll(payload, nil)
+	return block, errors.Wrap(err, "failed to decompress block")
+}
+
+// ScanBlock calls f for every event record of decompressed block
+// starting from offset
+func ScanBlock(block []byte, offset int64, f func(payload []byte, begin, end int64) error) error {
+	size := int64(len(block))
+	end, err := record.Scan(bytes.NewReader(block), offset, size, f)
+	if err != nil {
+		return err
+	}
+	if end != size {
+		return errors.Wrap(record.ErrTorn, "invalid block content")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package file
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{Compression: CompressionZstd, BlockSize: 200}
+	w, err := newWorker(dir, cfg, log.NewNopLogger())
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, w.Add(&eventagg.Event{Type: "click", Time: int64(i)}))
+	}
+	segment := w.segment
+	require.NoError(t, w.Close())
+
+	data, err := os.Open(segment.DataPath())
+	require.NoError(t, err)
+	defer data.Close()
+	format, err := ReadFormat(data)
+	require.NoError(t, err)
+	require.EqualValues(t, FormatCompressed, format)
+	dataInfo, err := data.Stat()
+	require.NoError(t, err)
+
+	// every index entry points to its event inside of block
+	indexFile, err := os.Open(segment.IndexPath())
+	require.NoError(t, err)
+	defer indexFile.Close()
+	info, err := indexFile.Stat()
+	require.NoError(t, err)
+	index := NewIndex(indexFile, info.Size())
+	require.Equal(t, 20, index.Len())
+
+	blocks := map[int64]bool{}
+	for i := 0; i < index.Len(); i++ {
+		entry, err := index.Entry(i)
+		require.NoError(t, err)
+		require.EqualValues(t, i, entry.Ts)
+		blocks[entry.Begin] = true
+
+		block, _, err := ReadBlock(data, entry.Begin, dataInfo.Size())
+		require.NoError(t, err)
+		err = ScanBlock(block, entry.End, func(payload []byte, begin, end int64) error {
+			var ev eventagg.Event
+			require.NoError(t, json.Unmarshal(payload, &ev))
+			require.EqualValues(t, i, ev.Time)
+			return errStop
+		})
+		require.Equal(t, errStop, err)
+	}
+	require.True(t, len(blocks) > 1, "events are split into several blocks")
+
+	// index is rebuilt from blocks
+	content, err := ioutil.ReadFile(segment.IndexPath())
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(segment.IndexPath(), IndexHeaderSize+5*IndexEntrySize+10))
+	w, err = newWorker(dir, cfg, log.NewNopLogger())
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	recovered, err := ioutil.ReadFile(segment.IndexPath())
+	require.NoError(t, err)
+	require.Equal(t, content, recovered)
+}
+
+func TestCompressedCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{Compression: CompressionZstd, Sync: SyncNone}
+	w, err := newWorker(workerPath(dir, 0), cfg, log.NewNopLogger())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, w.Add(&eventagg.Event{Type: "click", Time: int64(i)}))
+	}
+	require.NoError(t, w.commit())
+
+	// worker is reopened as after crash, committed events are readable
+	reopened, err := newWorker(workerPath(dir, 0), cfg, log.NewNopLogger())
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Equal(t, w.segment, reopened.segment)
+
+	times := []int64{}
+	_, err = Replay(dir, 0, log.NewNopLogger(), func(ev *eventagg.Event) error {
+		times = append(times, ev.Time)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int64{0, 1, 2}, times)
+}
+
+func TestCompressionChangeRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := newWorker(dir, Config{}, log.NewNopLogger())
+	require.NoError(t, err)
+	require.NoError(t, w.Add(&eventagg.Event{Time: 1}))
+	framed := w.segment
+	require.NoError(t, w.Close())
+
+	w, err = newWorker(dir, Config{Compression: CompressionZstd}, log.NewNopLogger())
+	require.NoError(t, err)
+	defer w.Close()
+	require.Equal(t, framed, w.segment)
+	require.NoError(t, w.Add(&eventagg.Event{Time: 2}))
+	require.NotEqual(t, framed, w.segment)
+	require.EqualValues(t, FormatCompressed, w.format)
+}
+
+var errStop = errors.New("stop")
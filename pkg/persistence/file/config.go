@@ -1,6 +1,81 @@
 package file
 
+import (
+	"time"
+)
+
 type Config struct {
 	DataDir string
 	Count   int
+
+	// segment is rotated when it reaches any of limits, unlimited when zero
+	SegmentMaxBytes int64
+	SegmentMaxAge   time.Duration
+
+	// closed segments are removed when they are older than RetentionMaxAge
+	// or worker data is bigger than RetentionMaxBytes, unlimited when zero
+	RetentionMaxAge   time.Duration
+	RetentionMaxBytes int64
+	// JanitorInterval is how often retention is enforced
+	JanitorInterval time.Duration
+
+	// Sync is durability policy of written events, SyncInterval and
+	// SyncEvery are used by corresponding policies
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	SyncEvery    int
+
+	// Compression of new segments, events are compressed in blocks
+	// of about BlockSize bytes
+	Compression string
+	BlockSize   int
+
+	// Partition is key events are partitioned by, event_type or
+	// params.<name>, events are distributed round robin when empty
+	Partition string
+}
+
+// SyncPolicy defines when buffered events are synced to disk,
+// events are always written to files in groups, when no more events are pending
+type SyncPolicy string
+
+const (
+	// SyncNone leaves syncing to OS, data is synced only on segment close
+	SyncNone SyncPolicy = "none"
+	// SyncInterval syncs written events every SyncInterval
+	SyncInterval SyncPolicy = "interval"
+	// SyncEveryN syncs after every SyncEvery written events
+	SyncEveryN SyncPolicy = "every_n"
+	// SyncAlways syncs every group of written events
+	SyncAlways SyncPolicy = "always"
+)
+
+const (
+	DefaultJanitorInterval = time.Minute
+	DefaultSync            = SyncInterval
+	DefaultSyncInterval    = time.Second
+	DefaultSyncEvery       = 1000
+)
+
+// withDefaults returns config with unset settings defaulted
+func (cfg Config) withDefaults() Config {
+	if cfg.JanitorInterval <= 0 {
+		cfg.JanitorInterval = DefaultJanitorInterval
+	}
+	if cfg.Sync == "" {
+		cfg.Sync = DefaultSync
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = DefaultSyncInterval
+	}
+	if cfg.SyncEvery <= 0 {
+		cfg.SyncEvery = DefaultSyncEvery
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = CompressionNone
+	}
+	if cfg.BlockSize <= 0 {
+		cfg.BlockSize = DefaultBlockSize
+	}
+	return cfg
 }
@@ -22,3 +22,16 @@ func fanoutRoundRobin(in chan *eventagg.Event, out ...chan *eventagg.Event) {
 		}
 	}()
 }
+
+// fanoutPartitioned sends events to partition of their key
+func fanoutPartitioned(in chan *eventagg.Event, p Partitioning, out ...chan *eventagg.Event) {
+	go func() {
+		for ev := range in {
+			out[p.Partition(p.keyOf(ev))] <- ev
+		}
+
+		for _, ch := range out {
+			close(ch)
+		}
+	}()
+}
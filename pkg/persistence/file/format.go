@@ -0,0 +1,58 @@
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/pkg/errors"
+)
+
+// data file starts with header:
+// - [4 bytes] magic "EVAG"
+// - [4 bytes] format version, big endian
+// followed by framed records, see pkg/record. Records of compressed
+// files are blocks of events, see block.go.
+// Files without header are written by older versions and contain
+// json events back to back
+const (
+	FormatLegacy     = 0
+	FormatFramed     = 1
+	FormatCompressed = 2
+
+	DataHeaderSize = 8
+)
+
+var dataMagic = []byte("EVAG")
+
+func encodeDataHeader(version uint32) []byte {
+	header := make([]byte, DataHeaderSize)
+	copy(header, dataMagic)
+	binary.BigEndian.PutUint32(header[4:], version)
+	return header
+}
+
+// ReadFormat returns format version of data file
+func ReadFormat(r io.ReaderAt) (uint32, error) {
+	header := make([]byte, DataHeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, errors.Wrap(err, "failed to read data header")
+	}
+	if n < DataHeaderSize || !bytes.Equal(header[:len(dataMagic)], dataMagic) {
+		return FormatLegacy, nil
+	}
+	return binary.BigEndian.Uint32(header[4:]), nil
+}
+
+// verifyData checks records of framed data file starting from offset and
+// returns offset where valid records end, everything after it is torn tail.
+// Count of skipped corrupted records is returned as well
+func verifyData(r io.ReaderAt, offset, size int64) (int64, int, error) {
+	if size < DataHeaderSize {
+		return 0, 0, nil
+	}
+	return record.ScanCorrupted(r, max(offset, DataHeaderSize), size, nil)
+}
@@ -0,0 +1,215 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// index file starts with header:
+// - [4 bytes] magic "EVIX"
+// - [4 bytes] index version, big endian
+// followed by fixed width entries:
+// - [8 bytes] begin, big endian
+// - [8 bytes] end, big endian
+// - [8 bytes] ts, big endian
+// Files without header are text indexes written by older versions,
+// [begin,end,ts] per line
+const (
+	IndexVersion    = 1
+	IndexHeaderSize = 8
+	IndexEntrySize  = 24
+)
+
+var (
+	indexMagic = []byte("EVIX")
+
+	// ErrNotIndexEntry is returned for line of text index which is not
+	// [begin,end,ts], e.g. partially written one
+	ErrNotIndexEntry = errors.New("not an index entry")
+	// ErrInvalidIndexEntry is returned for line with non numeric values
+	ErrInvalidIndexEntry = errors.New("invalid index entry format")
+)
+
+// IndexEntry points to event in data file, see worker.go and block.go
+// for meaning of begin and end in different data formats
+type IndexEntry struct {
+	Begin, End, Ts int64
+}
+
+func encodeIndexHeader() []byte {
+	header := make([]byte, IndexHeaderSize)
+	copy(header, indexMagic)
+	binary.BigEndian.PutUint32(header[4:], IndexVersion)
+	return header
+}
+
+func (e IndexEntry) encode() []byte {
+	buf := make([]byte, IndexEntrySize)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(e.Begin))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(e.End))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(e.Ts))
+	return buf
+}
+
+func decodeIndexEntry(buf []byte) IndexEntry {
+	return IndexEntry{
+		Begin: int64(binary.BigEndian.Uint64(buf[0:8])),
+		End:   int64(binary.BigEndian.Uint64(buf[8:16])),
+		Ts:    int64(binary.BigEndian.Uint64(buf[16:24])),
+	}
+}
+
+// IsBinaryIndex checks if index file starts with binary index header
+func IsBinaryIndex(r io.ReaderAt) (bool, error) {
+	header := make([]byte, IndexHeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return false, errors.Wrap(err, "failed to read index header")
+	}
+	return n == IndexHeaderSize && bytes.Equal(header[:len(indexMagic)], indexMagic), nil
+}
+
+// Index reads entries of binary index file
+type Index struct {
+	r io.ReaderAt
+	n int
+}
+
+// NewIndex returns reader of binary index file of given size,
+// partially written entry at the end is ignored
+func NewIndex(r io.ReaderAt, size int64) Index {
+	n := 0
+	if size > IndexHeaderSize {
+		n = int((size - IndexHeaderSize) / IndexEntrySize)
+	}
+	return Index{r: r, n: n}
+}
+
+// Len returns number of entries
+func (ix Index) Len() int {
+	return ix.n
+}
+
+// Entry returns i-th entry
+func (ix Index) Entry(i int) (IndexEntry, error) {
+	buf := make([]byte, IndexEntrySize)
+	if _, err := ix.r.ReadAt(buf, IndexHeaderSize+int64(i)*IndexEntrySize); err != nil {
+		return IndexEntry{}, errors.Wrap(err, "failed to read index entry")
+	}
+	return decodeIndexEntry(buf), nil
+}
+
+// Search returns index of the first entry with ts >= given one,
+// entries should be ordered by ts
+func (ix Index) Search(ts int64) (int, error) {
+	var err error
+	i := sort.Search(ix.n, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var entry IndexEntry
+		entry, err = ix.Entry(i)
+		return err != nil || entry.Ts >= ts
+	})
+	return i, err
+}
+
+// MigrateIndex converts text index of segment into binary one, index
+// is replaced atomically, entries after the first invalid line are dropped
+// and could be rebuilt by recovery. Segment is marked unsorted when entries
+// are not ordered by ts. Returns false when there was nothing to do
+func MigrateIndex(segment Segment) (bool, error) {
+	fl, err := os.Open(segment.IndexPath())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open index file")
+	}
+	defer fl.Close()
+
+	info, err := fl.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read index file info")
+	}
+	binaryIndex, err := IsBinaryIndex(fl)
+	if err != nil || binaryIndex || info.Size() == 0 {
+		return false, err
+	}
+
+	tmpPath := segment.IndexPath() + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create index file")
+	}
+	defer os.Remove(tmpPath)
+	defer tmp.Close()
+
+	writer := bufio.NewWriter(tmp)
+	writer.Write(encodeIndexHeader())
+	reader := bufio.NewReader(fl)
+	sorted, maxTs := true, int64(math.MinInt64)
+	for {
+		// last line without newline could be partially written
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "failed to read index file")
+		}
+
+		entry, err := ParseTextIndexEntry(line[:len(line)-1])
+		if err != nil {
+			break
+		}
+		writer.Write(entry.encode())
+		if entry.Ts < maxTs {
+			sorted = false
+		}
+		maxTs = max(maxTs, entry.Ts)
+	}
+
+	if err = writer.Flush(); err != nil {
+		return false, errors.Wrap(err, "failed to write index file")
+	}
+	if err = tmp.Sync(); err != nil {
+		return false, errors.Wrap(err, "failed to sync index file")
+	}
+	if !sorted {
+		if err = segment.markUnsorted(); err != nil {
+			return false, err
+		}
+	}
+	if err = os.Rename(tmpPath, segment.IndexPath()); err != nil {
+		return false, errors.Wrap(err, "failed to replace index file")
+	}
+	return true, nil
+}
+
+// ParseTextIndexEntry parses [begin,end,ts] line of text index
+func ParseTextIndexEntry(line []byte) (IndexEntry, error) {
+	splitted := strings.Split(string(line), ",")
+	if len(splitted) != 3 {
+		return IndexEntry{}, ErrNotIndexEntry
+	}
+
+	var values [3]int64
+	for i := range splitted {
+		v, err := strconv.ParseInt(splitted[i], 10, 64)
+		if err != nil {
+			return IndexEntry{}, ErrInvalidIndexEntry
+		}
+		values[i] = v
+	}
+	return IndexEntry{values[0], values[1], values[2]}, nil
+}
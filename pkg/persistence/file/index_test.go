@@ -0,0 +1,82 @@
+package file
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-index")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	segment := Segment{Dir: dir, Name: "segment-1"}
+	// the last line is partially written
+	text := "8,30,100\n30,52,101\n52,74,10"
+	require.NoError(t, ioutil.WriteFile(segment.IndexPath(), []byte(text), 0666))
+
+	migrated, err := MigrateIndex(segment)
+	require.NoError(t, err)
+	require.True(t, migrated)
+
+	content, err := ioutil.ReadFile(segment.IndexPath())
+	require.NoError(t, err)
+	index := NewIndex(bytes.NewReader(content), int64(len(content)))
+	require.Equal(t, 2, index.Len())
+	for i, expected := range []IndexEntry{{8, 30, 100}, {30, 52, 101}} {
+		entry, err := index.Entry(i)
+		require.NoError(t, err)
+		require.Equal(t, expected, entry)
+	}
+
+	// binary index is left as is
+	migrated, err = MigrateIndex(segment)
+	require.NoError(t, err)
+	require.False(t, migrated)
+
+	require.False(t, segment.Unsorted())
+
+	migrated, err = MigrateIndex(Segment{Dir: dir, Name: "missing"})
+	require.NoError(t, err)
+	require.False(t, migrated)
+
+	// entries out of ts order
+	unsorted := Segment{Dir: dir, Name: "segment-2"}
+	require.NoError(t, ioutil.WriteFile(unsorted.IndexPath(), []byte("8,30,100\n30,52,99\n"), 0666))
+	migrated, err = MigrateIndex(unsorted)
+	require.NoError(t, err)
+	require.True(t, migrated)
+	require.True(t, unsorted.Unsorted())
+}
+
+func TestIndexSearch(t *testing.T) {
+	content := encodeIndexHeader()
+	for i, ts := range []int64{100, 101, 101, 103} {
+		content = append(content, IndexEntry{int64(i), int64(i + 1), ts}.encode()...)
+	}
+	// partially written entry is ignored
+	content = append(content, 1, 2, 3)
+	index := NewIndex(bytes.NewReader(content), int64(len(content)))
+	require.Equal(t, 4, index.Len())
+
+	tests := []struct {
+		ts       int64
+		expected int
+	}{
+		{90, 0},
+		{100, 0},
+		{101, 1},
+		{102, 3},
+		{103, 3},
+		{104, 4},
+	}
+	for _, tt := range tests {
+		i, err := index.Search(tt.ts)
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, i, "ts %d", tt.ts)
+	}
+}
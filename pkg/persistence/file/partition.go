@@ -0,0 +1,115 @@
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/pkg/errors"
+)
+
+// events are partitioned by hash of partition key into partition-<n>
+// directories, key and number of partitions are stored in data dir
+// so readers know which partition has events they need
+const (
+	PartitionEventType   = "event_type"
+	PartitionParamPrefix = "params."
+
+	partitionDirPrefix   = "partition-"
+	partitioningFileName = "partitioning.json"
+)
+
+// Partitioning describes how events are spread between partitions
+type Partitioning struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+func validPartitionKey(key string) bool {
+	return key == PartitionEventType ||
+		(strings.HasPrefix(key, PartitionParamPrefix) && len(key) > len(PartitionParamPrefix))
+}
+
+func partitionPath(dir string, idx int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%.6d", partitionDirPrefix, idx))
+}
+
+// keyOf returns value of partition key of event
+func (p Partitioning) keyOf(ev *eventagg.Event) string {
+	if p.Key == PartitionEventType {
+		return ev.Type
+	}
+
+	v, ok := ev.Params[strings.TrimPrefix(p.Key, PartitionParamPrefix)]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// Partition returns partition of given key value
+func (p Partitioning) Partition(value string) int {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return int(h.Sum32() % uint32(p.Count))
+}
+
+// PartitionDir returns directory of partition with events of given key value
+func (p Partitioning) PartitionDir(dir string, value string) string {
+	return partitionPath(dir, p.Partition(value))
+}
+
+// IsPartitionDir checks if directory is partition one, other data
+// directories have events distributed round robin
+func IsPartitionDir(dir string) bool {
+	return strings.HasPrefix(filepath.Base(dir), partitionDirPrefix)
+}
+
+// ReadPartitioning returns partitioning of data dir, nil when events
+// were never partitioned
+func ReadPartitioning(dir string) (*Partitioning, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, partitioningFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read partitioning file")
+	}
+
+	var p Partitioning
+	if err = json.Unmarshal(content, &p); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal partitioning")
+	}
+	return &p, nil
+}
+
+// setupPartitioning stores partitioning of data dir, changing it
+// would put events of the same key into different partitions
+func setupPartitioning(dir string, p Partitioning) error {
+	current, err := ReadPartitioning(dir)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		if *current != p {
+			return errors.Errorf("partitioning of data dir is %s/%d, can't be changed to %s/%d",
+				current.Key, current.Count, p.Key, p.Count)
+		}
+		return nil
+	}
+
+	content, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal partitioning")
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, partitioningFileName), content, 0666); err != nil {
+		return errors.Wrap(err, "failed to write partitioning file")
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionedPersistence(t *testing.T) {
+	tests := []struct {
+		key   string
+		event func(i int) *eventagg.Event
+		value func(ev *eventagg.Event) string
+	}{
+		{
+			key: PartitionEventType,
+			event: func(i int) *eventagg.Event {
+				return &eventagg.Event{Type: []string{"a", "b", "c", "d"}[i%4], Time: int64(i)}
+			},
+			value: func(ev *eventagg.Event) string { return ev.Type },
+		},
+		{
+			key: "params.user",
+			event: func(i int) *eventagg.Event {
+				return &eventagg.Event{Type: "click", Time: int64(i), Params: map[string]interface{}{"user": i % 5}}
+			},
+			value: func(ev *eventagg.Event) string { return fmt.Sprint(ev.Params["user"]) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "eventagg-partition")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			cfg := Config{DataDir: dir, Count: 3, Partition: tt.key}
+			persistence, err := New(cfg, log.NewNopLogger())
+			require.NoError(t, err)
+			for i := 0; i < 100; i++ {
+				require.NoError(t, persistence.Add(tt.event(i)))
+			}
+			require.NoError(t, persistence.Close())
+
+			partitioning, err := ReadPartitioning(dir)
+			require.NoError(t, err)
+			require.Equal(t, &Partitioning{Key: tt.key, Count: 3}, partitioning)
+
+			dirs, err := WorkerDirs(dir)
+			require.NoError(t, err)
+			require.Len(t, dirs, 3)
+
+			// every event is stored in partition of its key
+			total := 0
+			for _, partitionDir := range dirs {
+				require.True(t, IsPartitionDir(partitionDir))
+				segments, err := Segments(partitionDir)
+				require.NoError(t, err)
+				for _, segment := range segments {
+					data, err := os.Open(segment.DataPath())
+					require.NoError(t, err)
+					info, err := data.Stat()
+					require.NoError(t, err)
+					_, err = record.Scan(data, DataHeaderSize, info.Size(), func(payload []byte, begin, end int64) error {
+						var ev eventagg.Event
+						require.NoError(t, json.Unmarshal(payload, &ev))
+						require.Equal(t, partitioning.PartitionDir(dir, tt.value(&ev)), partitionDir)
+						total++
+						return nil
+					})
+					require.NoError(t, err)
+					data.Close()
+				}
+			}
+			require.Equal(t, 100, total)
+
+			// partitioning can't be changed
+			cfg.Count = 4
+			_, err = New(cfg, log.NewNopLogger())
+			require.Error(t, err)
+		})
+	}
+
+	_, err := New(Config{DataDir: os.TempDir(), Count: 1, Partition: "user"}, log.NewNopLogger())
+	require.Error(t, err)
+}
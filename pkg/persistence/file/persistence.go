@@ -1,12 +1,19 @@
 package file
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/iahmedov/eventagg"
 
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
@@ -14,17 +21,64 @@ type file struct {
 	cfg     Config
 	in      chan *eventagg.Event
 	workers []*worker
+	// dirs of workers in the same order
+	dirs []string
+	wg   sync.WaitGroup
+
+	// adds hold read lock while sending to in, close takes write lock
+	mtx    sync.RWMutex
+	closed bool
+	// closing is closed first on close to unblock adds waiting for workers
+	closing   chan struct{}
+	closeOnce sync.Once
+	// count of events sent to workers, updated atomically
+	added int64
 }
 
+const workerDirPrefix = "worker-"
+
+// workerChannelSize is how many events may wait for worker,
+// they are written to files as one group
+const workerChannelSize = 128
+
 func workerPath(dir string, idx int) string {
-	return filepath.Join(dir, fmt.Sprintf("worker-%.6d", idx))
+	return filepath.Join(dir, fmt.Sprintf("%s%.6d", workerDirPrefix, idx))
+}
+
+// WorkerDirs lists worker and partition directories inside of data dir,
+// other files and folders are ignored
+func WorkerDirs(dir string) ([]string, error) {
+	fl, err := os.Open(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	defer fl.Close()
+
+	infos, err := fl.Readdir(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read child directories")
+	}
+
+	dirs := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() || !(strings.HasPrefix(info.Name(), workerDirPrefix) ||
+			strings.HasPrefix(info.Name(), partitionDirPrefix)) {
+			continue
+		}
+		dirs = append(dirs, filepath.Join(dir, info.Name()))
+	}
+	sort.Strings(dirs)
+	return dirs, nil
 }
 
-func New(cfg Config) (*file, error) {
+func New(cfg Config, logger log.Logger) (*file, error) {
+	cfg = cfg.withDefaults()
 	filePersistence := &file{
 		cfg:     cfg,
 		in:      make(chan *eventagg.Event, cfg.Count*10),
 		workers: make([]*worker, cfg.Count),
+		dirs:    make([]string, cfg.Count),
+		closing: make(chan struct{}),
 	}
 
 	fileInfo, err := os.Stat(cfg.DataDir)
@@ -35,8 +89,21 @@ func New(cfg Config) (*file, error) {
 		return nil, errors.Wrap(err, "invalid type for data dir")
 	}
 
+	// partitioned events are written into partition directories
+	dirPath := workerPath
+	partitioning := Partitioning{Key: cfg.Partition, Count: cfg.Count}
+	if cfg.Partition != "" {
+		if !validPartitionKey(cfg.Partition) {
+			return nil, errors.Errorf("invalid partition key: %s", cfg.Partition)
+		}
+		if err = setupPartitioning(cfg.DataDir, partitioning); err != nil {
+			return nil, err
+		}
+		dirPath = partitionPath
+	}
+
 	for i := 0; i < cfg.Count; i++ {
-		w, err := newWorker(workerPath(cfg.DataDir, i))
+		w, err := newWorker(dirPath(cfg.DataDir, i), cfg, logger)
 		if err != nil {
 			// close previous open workers
 			for j := i - 1; j >= 0; j-- {
@@ -45,29 +112,139 @@ func New(cfg Config) (*file, error) {
 			return nil, errors.Wrap(err, "failed to create worker")
 		}
 		filePersistence.workers[i] = w
+		filePersistence.dirs[i] = dirPath(cfg.DataDir, i)
 	}
 
 	workerChannels := make([]chan *eventagg.Event, cfg.Count)
 	for i := 0; i < cfg.Count; i++ {
-		workerChannels[i] = make(chan *eventagg.Event, 1)
+		workerChannels[i] = make(chan *eventagg.Event, workerChannelSize)
+		filePersistence.wg.Add(1)
 		go func(w *worker, ch chan *eventagg.Event) {
-			for ev := range ch {
-				w.Add(ev)
-			}
-			w.Close()
+			defer filePersistence.wg.Done()
+			runWorker(w, ch)
 		}(filePersistence.workers[i], workerChannels[i])
 	}
-	fanoutRoundRobin(filePersistence.in, workerChannels...)
+	if cfg.Partition != "" {
+		fanoutPartitioned(filePersistence.in, partitioning, workerChannels...)
+	} else {
+		fanoutRoundRobin(filePersistence.in, workerChannels...)
+	}
 	return filePersistence, nil
 }
 
+// runWorker writes events of channel, commits them when channel is drained
+// and periodically rotates expired segment and enforces retention, all is done in the same goroutine
+// so janitor and syncs never race with writes
+func runWorker(w *worker, ch chan *eventagg.Event) {
+	janitor := time.NewTicker(w.cfg.JanitorInterval)
+	defer janitor.Stop()
+
+	var syncTick <-chan time.Time
+	if w.cfg.Sync == SyncInterval {
+		syncTicker := time.NewTicker(w.cfg.SyncInterval)
+		defer syncTicker.Stop()
+		syncTick = syncTicker.C
+	}
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				w.Close()
+				return
+			}
+			if err := w.Add(ev); err != nil {
+				atomic.AddInt64(&w.lost, 1)
+				w.logger.Log("event", "failed to write event", "error", err,
+					"lost", atomic.LoadInt64(&w.lost))
+			}
+			atomic.AddInt64(&w.written, 1)
+			// group commit, events already waiting are written together
+			if len(ch) == 0 {
+				if err := w.commit(); err != nil {
+					w.logger.Log("event", "failed to commit events", "error", err,
+						"lost", atomic.LoadInt64(&w.lost))
+				}
+			}
+		case <-syncTick:
+			if err := w.sync(); err != nil {
+				w.logger.Log("event", "failed to sync events", "error", err,
+					"lost", atomic.LoadInt64(&w.lost))
+			}
+		case <-janitor.C:
+			if _, err := w.janitor(); err != nil {
+				w.logger.Log("event", "failed to enforce retention", "error", err)
+			}
+		}
+	}
+}
+
 func (f *file) Add(ev *eventagg.Event) error {
-	// no need for ID
-	f.in <- ev
-	return nil
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	if f.closed {
+		return errors.New("persistence closed")
+	}
+	select {
+	case f.in <- ev:
+		atomic.AddInt64(&f.added, 1)
+		return nil
+	case <-f.closing:
+		return errors.New("persistence closed")
+	}
+}
+
+// WaitWritten waits until workers write every added event, so positions
+// cover them. Events should not be added meanwhile
+func (f *file) WaitWritten(ctx context.Context) error {
+	for {
+		var written int64
+		for _, w := range f.workers {
+			written += atomic.LoadInt64(&w.written)
+		}
+		if written >= atomic.LoadInt64(&f.added) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// Positions returns positions after the last written events of workers,
+// events added later are read by ReplayFrom
+func (f *file) Positions() Positions {
+	positions := make(Positions, len(f.workers))
+	for i, w := range f.workers {
+		positions[filepath.Base(f.dirs[i])] = w.Position()
+	}
+	return positions
+}
+
+// Lost returns count of accepted events dropped because writing them failed
+func (f *file) Lost() int64 {
+	var lost int64
+	for _, w := range f.workers {
+		lost += atomic.LoadInt64(&w.lost)
+	}
+	return lost
 }
 
+// Close stops accepting events and waits until workers write pending ones
 func (f *file) Close() error {
+	f.closeOnce.Do(func() { close(f.closing) })
+	f.mtx.Lock()
+	if f.closed {
+		f.mtx.Unlock()
+		return errors.New("already closed")
+	}
+	f.closed = true
 	close(f.in)
+	f.mtx.Unlock()
+
+	f.wg.Wait()
 	return nil
 }
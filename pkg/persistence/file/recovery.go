@@ -0,0 +1,173 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/pkg/errors"
+)
+
+// recoveryReport describes what was fixed in segment after crash
+type recoveryReport struct {
+	DataTruncated  int64
+	IndexTruncated int64
+	IndexRebuilt   int
+	// records with checksum mismatch followed by valid ones,
+	// they are kept in file and skipped by readers
+	DataCorrupted int
+}
+
+func (r recoveryReport) empty() bool {
+	return r.DataTruncated == 0 && r.IndexTruncated == 0 && r.IndexRebuilt == 0 && r.DataCorrupted == 0
+}
+
+// recoverSegment reconciles framed data file with its binary index after crash:
+// - index entries pointing to missing records and partial entries are truncated
+// - torn record at the end of data file is truncated
+// - corrupted records followed by valid ones are counted and kept
+// - index entries of records written after last valid entry are rebuilt
+// only tails of files are scanned, data is scanned from the last valid entry
+func recoverSegment(data, idx *os.File, format uint32) (recoveryReport, error) {
+	var report recoveryReport
+
+	dataInfo, err := data.Stat()
+	if err != nil {
+		return report, errors.Wrap(err, "failed to read data file info")
+	}
+	idxInfo, err := idx.Stat()
+	if err != nil {
+		return report, errors.Wrap(err, "failed to read index file info")
+	}
+	idxSize := idxInfo.Size()
+	if idxSize < IndexHeaderSize {
+		// header is written with the first entry
+		if err = idx.Truncate(0); err != nil {
+			return report, errors.Wrap(err, "failed to truncate index")
+		}
+		if _, err = idx.Write(encodeIndexHeader()); err != nil {
+			return report, errors.Wrap(err, "failed to write index header")
+		}
+		idxSize = IndexHeaderSize
+	}
+	last, idxEnd, err := lastValidIndexEntry(data, NewIndex(idx, idxSize), format, dataInfo.Size())
+	if err != nil {
+		return report, err
+	}
+	if idxEnd < idxSize {
+		if err = idx.Truncate(idxEnd); err != nil {
+			return report, errors.Wrap(err, "failed to truncate index")
+		}
+		report.IndexTruncated = idxSize - idxEnd
+	}
+
+	// records up to the last indexed one are valid, block of
+	// compressed segment is scanned from its beginning
+	indexedEnd := int64(DataHeaderSize)
+	switch {
+	case last != nil && format == FormatCompressed:
+		indexedEnd = last.Begin
+	case last != nil:
+		indexedEnd = last.End
+	}
+	dataEnd, corrupted, err := verifyData(data, indexedEnd, dataInfo.Size())
+	if err != nil {
+		return report, errors.Wrap(err, "failed to verify data file")
+	}
+	report.DataCorrupted = corrupted
+	if dataEnd < dataInfo.Size() {
+		if err = data.Truncate(dataEnd); err != nil {
+			return report, errors.Wrap(err, "failed to truncate torn data tail")
+		}
+		report.DataTruncated = dataInfo.Size() - dataEnd
+	}
+
+	// rebuild entries of records not present in index
+	var rebuilt bytes.Buffer
+	addEntry := func(payload []byte, begin, end int64) error {
+		var ev struct {
+			Time int64 `json:"ts"`
+		}
+		if err := json.Unmarshal(payload, &ev); err != nil {
+			return errors.Wrap(err, "failed to unmarshal event")
+		}
+		rebuilt.Write(IndexEntry{begin, end, ev.Time}.encode())
+		report.IndexRebuilt++
+		return nil
+	}
+
+	if format == FormatCompressed {
+		err = rebuildBlockIndex(data, last, dataEnd, addEntry)
+	} else {
+		_, err = record.Scan(data, indexedEnd, dataEnd, addEntry)
+	}
+	if err != nil {
+		return report, errors.Wrap(err, "failed to rebuild index")
+	}
+	if rebuilt.Len() > 0 {
+		// index is opened for append and already truncated to idxEnd
+		if _, err = idx.Write(rebuilt.Bytes()); err != nil {
+			return report, errors.Wrap(err, "failed to write rebuilt index")
+		}
+	}
+	return report, nil
+}
+
+// lastValidIndexEntry searches index backwards for the last entry
+// pointing to valid record, returns it and offset right after it
+func lastValidIndexEntry(data *os.File, index Index, format uint32, dataEnd int64) (*IndexEntry, int64, error) {
+	for i := index.Len() - 1; i >= 0; i-- {
+		entry, err := index.Entry(i)
+		if err != nil {
+			return nil, 0, err
+		}
+		if validIndexEntry(data, format, entry, dataEnd) {
+			return &entry, IndexHeaderSize + int64(i+1)*IndexEntrySize, nil
+		}
+	}
+	return nil, IndexHeaderSize, nil
+}
+
+// validIndexEntry checks that entry points to record within valid data
+func validIndexEntry(data *os.File, format uint32, entry IndexEntry, dataEnd int64) bool {
+	if entry.Begin < DataHeaderSize || entry.Begin >= dataEnd {
+		return false
+	}
+
+	if format == FormatCompressed {
+		block, _, err := ReadBlock(data, entry.Begin, dataEnd)
+		if err != nil {
+			return false
+		}
+		_, _, err = record.Read(bytes.NewReader(block), entry.End, int64(len(block)))
+		return err == nil
+	}
+
+	_, size, err := record.Read(data, entry.Begin, dataEnd)
+	return err == nil && entry.End <= dataEnd && entry.Begin+size == entry.End
+}
+
+// rebuildBlockIndex calls f with [block_pos,intra_pos] of events
+// written after last indexed one, corrupted blocks are skipped
+func rebuildBlockIndex(data *os.File, last *IndexEntry, dataEnd int64, f func(payload []byte, begin, end int64) error) error {
+	offset := int64(DataHeaderSize)
+	if last != nil {
+		offset = last.Begin
+	}
+
+	_, err := record.Scan(data, offset, dataEnd, func(payload []byte, blockPos, _ int64) error {
+		block, err := DecodeBlock(payload)
+		if err != nil {
+			return err
+		}
+		return ScanBlock(block, 0, func(payload []byte, begin, end int64) error {
+			if last != nil && blockPos == last.Begin && begin <= last.End {
+				return nil
+			}
+			return f(payload, blockPos, begin)
+		})
+	})
+	return err
+}
@@ -0,0 +1,198 @@
+package file
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverSegment(t *testing.T) {
+	tests := []struct {
+		name   string
+		crash  func(t *testing.T, segment Segment, index []byte)
+		report recoveryReport
+		// recovered index, the same as before crash when nil
+		index func(index []byte) []byte
+	}{
+		{
+			name:   "consistent",
+			crash:  func(t *testing.T, segment Segment, index []byte) {},
+			report: recoveryReport{},
+		},
+		{
+			name: "index entries lost",
+			crash: func(t *testing.T, segment Segment, index []byte) {
+				require.NoError(t, os.Truncate(segment.IndexPath(), 0))
+			},
+			report: recoveryReport{IndexRebuilt: 5},
+		},
+		{
+			name: "partial index entry",
+			crash: func(t *testing.T, segment Segment, index []byte) {
+				require.NoError(t, os.Truncate(segment.IndexPath(), int64(len(index)-10)))
+			},
+			report: recoveryReport{IndexTruncated: IndexEntrySize - 10, IndexRebuilt: 1},
+		},
+		{
+			name: "torn data tail",
+			crash: func(t *testing.T, segment Segment, index []byte) {
+				fl, err := os.OpenFile(segment.DataPath(), os.O_WRONLY|os.O_APPEND, 0666)
+				require.NoError(t, err)
+				defer fl.Close()
+				fl.Write(record.Encode([]byte(`{"ts":5}`))[:10])
+
+				idx, err := os.OpenFile(segment.IndexPath(), os.O_WRONLY|os.O_APPEND, 0666)
+				require.NoError(t, err)
+				defer idx.Close()
+				idx.Write(IndexEntry{Begin: 1000, End: 1016, Ts: 5}.encode())
+			},
+			report: recoveryReport{DataTruncated: 10, IndexTruncated: IndexEntrySize},
+		},
+		{
+			name: "zero filled data tail",
+			crash: func(t *testing.T, segment Segment, index []byte) {
+				fl, err := os.OpenFile(segment.DataPath(), os.O_WRONLY|os.O_APPEND, 0666)
+				require.NoError(t, err)
+				defer fl.Close()
+				fl.Write(make([]byte, 64))
+			},
+			report: recoveryReport{DataTruncated: 64},
+		},
+		{
+			name: "corrupted record in not indexed tail",
+			crash: func(t *testing.T, segment Segment, index []byte) {
+				require.NoError(t, os.Truncate(segment.IndexPath(), 0))
+				corruptRecord(t, segment, DataHeaderSize)
+			},
+			report: recoveryReport{IndexRebuilt: 4, DataCorrupted: 1},
+			index: func(index []byte) []byte {
+				return append(append([]byte{}, index[:IndexHeaderSize]...), index[IndexHeaderSize+IndexEntrySize:]...)
+			},
+		},
+		{
+			name: "corrupted indexed record",
+			crash: func(t *testing.T, segment Segment, index []byte) {
+				// readers skip it, indexed records are not scanned
+				corruptRecord(t, segment, DataHeaderSize)
+			},
+			report: recoveryReport{},
+		},
+		{
+			name: "garbage in index",
+			crash: func(t *testing.T, segment Segment, index []byte) {
+				garbage := append([]byte{}, index[:IndexHeaderSize+2*IndexEntrySize]...)
+				garbage = append(garbage, bytes.Repeat([]byte{0xff}, IndexEntrySize)...)
+				require.NoError(t, ioutil.WriteFile(segment.IndexPath(), garbage, 0666))
+			},
+			report: recoveryReport{IndexTruncated: IndexEntrySize, IndexRebuilt: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "eventagg-recovery")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			w, err := newWorker(dir, Config{}, log.NewNopLogger())
+			require.NoError(t, err)
+			for i := 0; i < 5; i++ {
+				require.NoError(t, w.Add(&eventagg.Event{Time: int64(i)}))
+			}
+			segment := w.segment
+			require.NoError(t, w.Close())
+
+			index, err := ioutil.ReadFile(segment.IndexPath())
+			require.NoError(t, err)
+			tt.crash(t, segment, index)
+
+			data, err := os.OpenFile(segment.DataPath(), os.O_RDWR|os.O_APPEND, 0666)
+			require.NoError(t, err)
+			defer data.Close()
+			idx, err := os.OpenFile(segment.IndexPath(), os.O_RDWR|os.O_APPEND, 0666)
+			require.NoError(t, err)
+			defer idx.Close()
+
+			report, err := recoverSegment(data, idx, FormatFramed)
+			require.NoError(t, err)
+			require.Equal(t, tt.report, report)
+
+			recovered, err := ioutil.ReadFile(segment.IndexPath())
+			require.NoError(t, err)
+			if tt.index != nil {
+				index = tt.index(index)
+			}
+			require.Equal(t, index, recovered)
+		})
+	}
+}
+
+// corruptRecord flips byte of record payload at offset
+func corruptRecord(t *testing.T, segment Segment, offset int64) {
+	fl, err := os.OpenFile(segment.DataPath(), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	defer fl.Close()
+	b := make([]byte, 1)
+	_, err = fl.ReadAt(b, offset+record.HeaderSize+2)
+	require.NoError(t, err)
+	b[0] ^= 0x01
+	_, err = fl.WriteAt(b, offset+record.HeaderSize+2)
+	require.NoError(t, err)
+}
+
+func TestRecoverCorruptedMiddle(t *testing.T) {
+	configs := map[string]Config{
+		"framed":     {},
+		"compressed": {Compression: CompressionZstd, BlockSize: 100},
+	}
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "eventagg-recovery")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			w, err := newWorker(workerPath(dir, 0), cfg, log.NewNopLogger())
+			require.NoError(t, err)
+			for i := 0; i < 10; i++ {
+				require.NoError(t, w.Add(&eventagg.Event{Type: "click", Time: int64(i)}))
+			}
+			segment := w.segment
+			require.NoError(t, w.Close())
+			info, err := os.Stat(segment.DataPath())
+			require.NoError(t, err)
+
+			// the first record (event or block) is corrupted
+			corruptRecord(t, segment, DataHeaderSize)
+			w, err = newWorker(workerPath(dir, 0), cfg, log.NewNopLogger())
+			require.NoError(t, err)
+			require.NoError(t, w.Add(&eventagg.Event{Type: "click", Time: 10}))
+			require.NoError(t, w.Close())
+
+			// valid records after corrupted one are kept
+			recovered, err := os.Stat(segment.DataPath())
+			require.NoError(t, err)
+			require.True(t, recovered.Size() > info.Size())
+
+			times := []int64{}
+			_, err = Replay(dir, 0, log.NewNopLogger(), func(ev *eventagg.Event) error {
+				times = append(times, ev.Time)
+				return nil
+			})
+			require.NoError(t, err)
+			// events of the first record are skipped, all others are kept
+			require.True(t, len(times) > 1)
+			require.True(t, times[0] > 0)
+			for i, ts := range times {
+				require.Equal(t, times[0]+int64(i), ts)
+			}
+			require.Equal(t, int64(10), times[len(times)-1])
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package file
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/record"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// Position points right after event of worker directory:
+// - segment - name of segment
+// - offset - data offset where the next record is written
+// - skip - events of compressed block at offset written before position
+type Position struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Skip    int    `json:"skip,omitempty"`
+}
+
+// Positions are keyed by name of worker directory
+type Positions map[string]Position
+
+// Replay calls f for persisted events with ts >= since, segments of every
+// worker directory are read from oldest to newest. Segments with summary
+// ending before since are skipped without reading. Returns count of replayed events
+func Replay(dataDir string, since int64, logger log.Logger, f func(ev *eventagg.Event) error) (int64, error) {
+	return replay(dataDir, since, nil, logger, f)
+}
+
+// ReplayFrom calls f for persisted events written after positions, directories
+// without position are replayed fully. Segment of position removed by retention
+// is skipped with all older ones
+func ReplayFrom(dataDir string, from Positions, logger log.Logger, f func(ev *eventagg.Event) error) (int64, error) {
+	return replay(dataDir, math.MinInt64, from, logger, f)
+}
+
+func replay(dataDir string, since int64, from Positions, logger log.Logger, f func(ev *eventagg.Event) error) (int64, error) {
+	dirs, err := WorkerDirs(dataDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, dir := range dirs {
+		segments, err := Segments(dir)
+		if err != nil {
+			return total, errors.Wrap(err, "failed to list segments")
+		}
+
+		position, hasPosition := from[filepath.Base(dir)]
+		positionStart := Segment{Name: position.Segment}.StartTime()
+		for _, segment := range segments {
+			offset, skip := int64(0), 0
+			if hasPosition {
+				if segment.StartTime() < positionStart {
+					continue
+				}
+				if segment.Name == position.Segment {
+					offset, skip = position.Offset, position.Skip
+				}
+			}
+
+			summary, _ := ReadSummary(segment)
+			if summary != nil && summary.MaxTs < since {
+				continue
+			}
+
+			var count int64
+			err = scanSegment(segment, offset, func(payload []byte, _ int64) error {
+				if skip > 0 {
+					skip--
+					return nil
+				}
+
+				var ev eventagg.Event
+				if err := json.Unmarshal(payload, &ev); err != nil {
+					return errors.Wrap(err, "failed to decode event")
+				}
+				if ev.Time < since {
+					return nil
+				}
+				count++
+				return f(&ev)
+			})
+			total += count
+			if err != nil {
+				return total, errors.Wrapf(err, "failed to replay segment %s", segment.DataPath())
+			}
+			logger.Log("event", "segment replayed", "dir", dir, "segment", segment.Name, "events", count, "total", total)
+		}
+	}
+	return total, nil
+}
+
+// scanSegment calls f with every event of segment stored after data offset
+// and offset where record of event ends, events of compressed block share
+// the end of block. Torn tail and corrupted records of data file are ignored
+func scanSegment(segment Segment, offset int64, f func(payload []byte, end int64) error) error {
+	data, err := os.Open(segment.DataPath())
+	if err != nil {
+		return errors.Wrap(err, "failed to open data file")
+	}
+	defer data.Close()
+
+	info, err := data.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to read data file info")
+	}
+	format, err := ReadFormat(data)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatLegacy:
+		return scanLegacy(data, offset, info.Size(), f)
+	case FormatFramed:
+		_, err = record.Scan(data, max(offset, DataHeaderSize), info.Size(), func(payload []byte, _, end int64) error {
+			return f(payload, end)
+		})
+		return err
+	case FormatCompressed:
+		_, err = record.Scan(data, max(offset, DataHeaderSize), info.Size(), func(payload []byte, _, end int64) error {
+			block, err := DecodeBlock(payload)
+			if err != nil {
+				return err
+			}
+			return ScanBlock(block, 0, func(payload []byte, _, _ int64) error {
+				return f(payload, end)
+			})
+		})
+		return err
+	}
+	return errors.Errorf("unknown data format: %d", format)
+}
+
+// scanLegacy decodes json events written back to back
+func scanLegacy(data *os.File, offset, size int64, f func(payload []byte, end int64) error) error {
+	decoder := json.NewDecoder(io.NewSectionReader(data, offset, size-offset))
+	for {
+		var payload json.RawMessage
+		err := decoder.Decode(&payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to decode event")
+		}
+		if err = f(payload, offset+decoder.InputOffset()); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	cases := []struct {
+		name        string
+		compression string
+		since       int64
+		expected    []int64
+	}{
+		{"framed", CompressionNone, 0, []int64{1, 2, 3, 4, 5, 6}},
+		{"compressed", CompressionZstd, 0, []int64{1, 2, 3, 4, 5, 6}},
+		{"since", CompressionNone, 4, []int64{4, 5, 6}},
+		{"since compressed", CompressionZstd, 2, []int64{2, 3, 4, 5, 6}},
+		{"since after all", CompressionNone, 7, []int64{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dataDir, err := ioutil.TempDir("", "eventagg-replay")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir)
+
+			// legacy segment is followed by segment of current format
+			dir := workerPath(dataDir, 0)
+			require.NoError(t, os.Mkdir(dir, 0777))
+			legacy := Segment{Dir: dir, Name: legacySegmentName}
+			require.NoError(t, ioutil.WriteFile(legacy.DataPath(), []byte(`{"ts":1}{"ts":2}`), 0666))
+			require.NoError(t, ioutil.WriteFile(legacy.IndexPath(), []byte("0,8,1\n8,16,2\n"), 0666))
+
+			p, err := New(Config{DataDir: dataDir, Count: 1, Compression: c.compression, BlockSize: 50}, log.NewNopLogger())
+			require.NoError(t, err)
+			for ts := int64(3); ts <= 6; ts++ {
+				require.NoError(t, p.Add(&eventagg.Event{Type: "click", Time: ts}))
+			}
+			require.NoError(t, p.Close())
+
+			replayed := []int64{}
+			count, err := Replay(dataDir, c.since, log.NewNopLogger(), func(ev *eventagg.Event) error {
+				replayed = append(replayed, ev.Time)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, c.expected, replayed)
+			require.EqualValues(t, len(c.expected), count)
+		})
+	}
+}
+
+func TestReplayFrom(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+	}{
+		{"framed", Config{}},
+		{"framed rotated", Config{SegmentMaxBytes: 60}},
+		{"compressed", Config{Compression: CompressionZstd, BlockSize: 1 << 20}},
+		{"compressed small blocks", Config{Compression: CompressionZstd, BlockSize: 50}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dataDir, err := ioutil.TempDir("", "eventagg-replay")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataDir)
+
+			// position is taken while events may wait in pending block
+			w, err := newWorker(workerPath(dataDir, 0), c.cfg, log.NewNopLogger())
+			require.NoError(t, err)
+			for ts := int64(1); ts <= 3; ts++ {
+				require.NoError(t, w.Add(&eventagg.Event{Type: "click", Time: ts}))
+			}
+			positions := Positions{"worker-000000": w.Position()}
+			for ts := int64(4); ts <= 5; ts++ {
+				require.NoError(t, w.Add(&eventagg.Event{Type: "click", Time: ts}))
+			}
+			require.NoError(t, w.Close())
+
+			// directory without position is replayed fully
+			other, err := newWorker(workerPath(dataDir, 1), c.cfg, log.NewNopLogger())
+			require.NoError(t, err)
+			require.NoError(t, other.Add(&eventagg.Event{Type: "click", Time: 10}))
+			require.NoError(t, other.Close())
+
+			// events written after reopening follow position
+			w, err = newWorker(workerPath(dataDir, 0), c.cfg, log.NewNopLogger())
+			require.NoError(t, err)
+			require.NoError(t, w.Add(&eventagg.Event{Type: "click", Time: 6}))
+			require.NoError(t, w.Close())
+
+			replayed := []int64{}
+			_, err = ReplayFrom(dataDir, positions, log.NewNopLogger(), func(ev *eventagg.Event) error {
+				replayed = append(replayed, ev.Time)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []int64{4, 5, 6, 10}, replayed)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Segment is pair of data and index files inside of worker directory:
+// - segment-<startts>.out - events
+// - segment-<startts>.idx - index of events
+// - segment-<startts>.sum - summary of events, written when segment is closed
+// - segment-<startts>.unsorted - marker of segment with events out of ts order
+// startts is creation time of segment in unix nanoseconds.
+// data.out/data.idx written by older versions are treated as the oldest segment
+type Segment struct {
+	Dir  string
+	Name string
+}
+
+const (
+	segmentPrefix     = "segment-"
+	dataExt           = ".out"
+	indexExt          = ".idx"
+	summaryExt        = ".sum"
+	unsortedExt       = ".unsorted"
+	legacySegmentName = "data"
+)
+
+func (s Segment) DataPath() string {
+	return filepath.Join(s.Dir, s.Name+dataExt)
+}
+
+func (s Segment) IndexPath() string {
+	return filepath.Join(s.Dir, s.Name+indexExt)
+}
+
+func (s Segment) SummaryPath() string {
+	return filepath.Join(s.Dir, s.Name+summaryExt)
+}
+
+func (s Segment) UnsortedPath() string {
+	return filepath.Join(s.Dir, s.Name+unsortedExt)
+}
+
+// Unsorted checks if events of segment are not ordered by ts, index
+// of such segment can't be binary searched and segment is fully scanned
+func (s Segment) Unsorted() bool {
+	_, err := os.Stat(s.UnsortedPath())
+	return err == nil
+}
+
+// markUnsorted creates unsorted marker of segment
+func (s Segment) markUnsorted() error {
+	fl, err := os.Create(s.UnsortedPath())
+	if err != nil {
+		return errors.Wrap(err, "failed to create unsorted marker")
+	}
+	return fl.Close()
+}
+
+// StartTime returns creation time of segment in unix nanoseconds,
+// legacy segment starts at 0
+func (s Segment) StartTime() int64 {
+	startTs, err := strconv.ParseInt(strings.TrimPrefix(s.Name, segmentPrefix), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return startTs
+}
+
+func newSegment(dir string, startTs int64) Segment {
+	return Segment{
+		Dir:  dir,
+		Name: fmt.Sprintf("%s%.20d", segmentPrefix, startTs),
+	}
+}
+
+// Segments lists segments of worker directory from oldest to newest
+func Segments(dir string) ([]Segment, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+dataExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list segments")
+	}
+
+	segments := make([]Segment, 0, len(names))
+	for _, name := range names {
+		base := strings.TrimSuffix(filepath.Base(name), dataExt)
+		if base != legacySegmentName && !strings.HasPrefix(base, segmentPrefix) {
+			continue
+		}
+		segments = append(segments, Segment{Dir: dir, Name: base})
+	}
+
+	// zero padded names are ordered by time, legacy segment goes first
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].Name == legacySegmentName {
+			return segments[j].Name != legacySegmentName
+		}
+		if segments[j].Name == legacySegmentName {
+			return false
+		}
+		return segments[i].Name < segments[j].Name
+	})
+	return segments, nil
+}
+
+// size returns size of data and index files of segment
+func (s Segment) size() (int64, error) {
+	var total int64
+	for _, path := range []string{s.DataPath(), s.IndexPath()} {
+		info, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, errors.Wrap(err, "failed to read segment file info")
+		}
+		if err == nil {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+func (s Segment) remove() error {
+	if err := os.Remove(s.UnsortedPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove unsorted marker")
+	}
+	if err := os.Remove(s.SummaryPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove summary file")
+	}
+	if err := os.Remove(s.IndexPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove index file")
+	}
+	if err := os.Remove(s.DataPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove data file")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package file
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/pkg/errors"
+)
+
+// Summary describes events of closed segment, it is written as json
+// into segment-<startts>.sum when segment is closed, so readers could
+// answer queries covering whole segment without reading its events
+type Summary struct {
+	MinTs int64            `json:"min_ts"`
+	MaxTs int64            `json:"max_ts"`
+	Count int64            `json:"count"`
+	Types map[string]int64 `json:"types"`
+}
+
+func newSummary() *Summary {
+	return &Summary{Types: map[string]int64{}}
+}
+
+func (s *Summary) add(ev *eventagg.Event) {
+	if s.Count == 0 || ev.Time < s.MinTs {
+		s.MinTs = ev.Time
+	}
+	if s.Count == 0 || ev.Time > s.MaxTs {
+		s.MaxTs = ev.Time
+	}
+	s.Count++
+	s.Types[ev.Type]++
+}
+
+// Covered checks if all events of segment are within [begin, end]
+func (s *Summary) Covered(begin, end int64) bool {
+	return begin <= s.MinTs && s.MaxTs <= end
+}
+
+// Overlaps checks if any event of segment could be within [begin, end]
+func (s *Summary) Overlaps(begin, end int64) bool {
+	return s.Count > 0 && s.MaxTs >= begin && s.MinTs <= end
+}
+
+// ReadSummary returns summary of segment, nil when segment has no summary
+func ReadSummary(segment Segment) (*Summary, error) {
+	content, err := ioutil.ReadFile(segment.SummaryPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read summary file")
+	}
+
+	summary := newSummary()
+	if err = json.Unmarshal(content, summary); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal summary")
+	}
+	return summary, nil
+}
+
+// writeSummary writes summary atomically, readers never see partial file
+func writeSummary(segment Segment, summary *Summary) error {
+	content, err := json.Marshal(summary)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal summary")
+	}
+
+	tmpPath := segment.SummaryPath() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, content, 0666); err != nil {
+		return errors.Wrap(err, "failed to write summary file")
+	}
+	if err = os.Rename(tmpPath, segment.SummaryPath()); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "failed to replace summary file")
+	}
+	return nil
+}
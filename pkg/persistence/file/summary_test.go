@@ -0,0 +1,63 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := newWorker(dir, Config{}, log.NewNopLogger())
+	require.NoError(t, err)
+	events := []*eventagg.Event{
+		{Type: "click", Time: 12},
+		{Type: "view", Time: 10},
+		{Type: "click", Time: 11},
+	}
+	for _, ev := range events {
+		require.NoError(t, w.Add(ev))
+	}
+	closed := w.segment
+	require.NoError(t, w.rotate())
+
+	summary, err := ReadSummary(closed)
+	require.NoError(t, err)
+	require.Equal(t, &Summary{
+		MinTs: 10,
+		MaxTs: 12,
+		Count: 3,
+		Types: map[string]int64{"click": 2, "view": 1},
+	}, summary)
+	require.True(t, summary.Covered(10, 12))
+	require.False(t, summary.Covered(11, 20))
+	require.True(t, summary.Overlaps(12, 20))
+	require.False(t, summary.Overlaps(13, 20))
+
+	// reopened segment continues summary
+	require.NoError(t, w.Add(&eventagg.Event{Type: "click", Time: 13}))
+	active := w.segment
+	require.NoError(t, w.Close())
+	w, err = newWorker(dir, Config{}, log.NewNopLogger())
+	require.NoError(t, err)
+	_, err = os.Stat(active.SummaryPath())
+	require.True(t, os.IsNotExist(err), "summary of active segment is removed")
+	require.NoError(t, w.Add(&eventagg.Event{Type: "click", Time: 14}))
+	require.NoError(t, w.Close())
+
+	summary, err = ReadSummary(active)
+	require.NoError(t, err)
+	require.Equal(t, &Summary{MinTs: 13, MaxTs: 14, Count: 2, Types: map[string]int64{"click": 2}}, summary)
+
+	require.NoError(t, closed.remove())
+	_, err = os.Stat(closed.SummaryPath())
+	require.True(t, os.IsNotExist(err))
+}
@@ -1,52 +1,90 @@
 package file
 
 import (
+	"bufio"
 	"encoding/json"
-	"fmt"
-	"io"
+	"math"
 	"os"
-	"path/filepath"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/record"
 
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
 type worker struct {
 	open int32
 
+	cfg       Config
 	seek      int64
 	filePath  string
+	segment   Segment
+	format    uint32
+	started   time.Time
 	out       *os.File
-	outWriter io.Writer
+	outWriter *bufio.Writer
 	idx       *os.File
-	idxWriter io.Writer
+	idxWriter *bufio.Writer
+	now       func() time.Time
+	logger    log.Logger
+
+	// sizes of files without buffered writes
+	outFlushed int64
+	idxFlushed int64
+	// index bytes and events written since last flush
+	idxBuffered int
+	unflushed   int
+	// events written since last sync
+	unsynced int
+
+	// summary of active segment, nil when it is unknown,
+	// such segment is left without summary
+	summary *Summary
+
+	// events of segment are written in ts order while it is sorted,
+	// maxTs is the biggest written ts
+	sorted bool
+	maxTs  int64
+
+	// events of compressed segment waiting for block to be sealed
+	block      []byte
+	blockIndex []IndexEntry
+
+	// position after the last written event, read by snapshots
+	positionMtx sync.Mutex
+	position    Position
+	// count of events taken from channel, updated atomically
+	written int64
+	// count of events dropped by failed writes, updated atomically
+	lost int64
 }
 
-// output format:
-// - data.out - [json] per line
-// - data.idx - [begin_pos,end_pos,ts] per line
+// writeBufferSize is size of data and index write buffers
+const writeBufferSize = 64 * 1024
+
+// output format, per segment:
+// - segment-<startts>.out - header and framed [json] records, see format.go
+// - segment-<startts>.idx - header and [begin_pos,end_pos,ts] entries, see index.go
 // 		- begin_pos - begin position of event data
 // 		- end_pos - end position of event data
 // 		- ts - event timestamp
-func DataFilePath(path string) string {
-	return filepath.Join(path, "data.out")
-}
-
-func IndexFilePath(path string) string {
-	return filepath.Join(path, "data.idx")
-}
-
-func newWorker(path string) (*worker, error) {
+// compressed segments are written in blocks, see block.go
+func newWorker(path string, cfg Config, logger log.Logger) (*worker, error) {
 	w := &worker{
 		open:      1,
+		cfg:       cfg.withDefaults(),
 		seek:      0,
 		filePath:  path,
 		out:       nil,
 		outWriter: nil,
 		idx:       nil,
 		idxWriter: nil,
+		now:       time.Now,
+		logger:    logger,
 	}
 
 	fileInfo, err := os.Stat(path)
@@ -63,26 +101,237 @@ func newWorker(path string) (*worker, error) {
 		}
 	}
 
-	fl, err := os.OpenFile(DataFilePath(path), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	segments, err := Segments(path)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to open file")
+		return nil, err
+	}
+	segment := newSegment(path, w.now().UnixNano())
+	if len(segments) > 0 {
+		segment = segments[len(segments)-1]
+	}
+	if err = w.openSegment(segment); err != nil {
+		return nil, err
 	}
-	fileInfo, err = fl.Stat()
+	return w, nil
+}
+
+func (w *worker) openSegment(segment Segment) error {
+	fl, err := os.OpenFile(segment.DataPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read file size")
+		return errors.Wrap(err, "failed to open file")
+	}
+	fileInfo, err := fl.Stat()
+	if err != nil {
+		fl.Close()
+		return errors.Wrap(err, "failed to read file size")
+	}
+
+	size := fileInfo.Size()
+	var format uint32
+	if size == 0 {
+		format = w.targetFormat()
+		if _, err = fl.Write(encodeDataHeader(format)); err != nil {
+			fl.Close()
+			return errors.Wrap(err, "failed to write data header")
+		}
+		size = DataHeaderSize
+	} else if format, err = ReadFormat(fl); err != nil {
+		fl.Close()
+		return err
+	}
+
+	if format == FormatFramed || format == FormatCompressed {
+		// text index written by older version is converted before recovery
+		if _, err = MigrateIndex(segment); err != nil {
+			fl.Close()
+			return errors.Wrap(err, "failed to migrate index")
+		}
 	}
-	w.seek = fileInfo.Size()
-	w.out = fl
-	w.outWriter = fl
 
-	idxFl, err := os.OpenFile(IndexFilePath(path), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	idxFl, err := os.OpenFile(segment.IndexPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to open index file")
+		fl.Close()
+		return errors.Wrap(err, "failed to open index file")
+	}
+
+	var report recoveryReport
+	if format == FormatFramed || format == FormatCompressed {
+		// reconcile files left inconsistent by crash
+		report, err = recoverSegment(fl, idxFl, format)
+		if err != nil {
+			fl.Close()
+			idxFl.Close()
+			return errors.Wrap(err, "failed to recover segment")
+		}
+		if !report.empty() {
+			w.logger.Log("event", "segment recovered", "segment", segment.DataPath(),
+				"data_truncated", report.DataTruncated,
+				"index_truncated", report.IndexTruncated,
+				"index_rebuilt", report.IndexRebuilt,
+				"data_corrupted", report.DataCorrupted)
+		}
+		size -= report.DataTruncated
+	}
+
+	idxInfo, err := idxFl.Stat()
+	if err != nil {
+		fl.Close()
+		idxFl.Close()
+		return errors.Wrap(err, "failed to read index file size")
+	}
+
+	w.summary = newSummary()
+	if idxInfo.Size() > IndexHeaderSize {
+		// cleanly closed segment continues its summary, it is removed
+		// while segment is active so readers never see stale one
+		w.summary, _ = ReadSummary(segment)
+		if !report.empty() {
+			w.summary = nil
+		}
+		os.Remove(segment.SummaryPath())
+	}
+	// ts of the last entry is the biggest one while segment is sorted
+	w.sorted, w.maxTs = !segment.Unsorted(), int64(math.MinInt64)
+	if index := NewIndex(idxFl, idxInfo.Size()); w.sorted && index.Len() > 0 && format != FormatLegacy {
+		last, err := index.Entry(index.Len() - 1)
+		if err != nil {
+			fl.Close()
+			idxFl.Close()
+			return err
+		}
+		w.maxTs = last.Ts
 	}
+
+	w.segment = segment
+	w.format = format
+	w.started = time.Unix(0, segment.StartTime())
+	w.seek = size
+	w.out = fl
+	w.outWriter = bufio.NewWriterSize(fl, writeBufferSize)
+	w.outFlushed = size
 	w.idx = idxFl
-	w.idxWriter = idxFl
+	w.idxWriter = bufio.NewWriterSize(idxFl, writeBufferSize)
+	w.idxFlushed = idxInfo.Size()
+	w.updatePosition()
+	return nil
+}
 
-	return w, nil
+func (w *worker) closeSegment() error {
+	err := w.sync()
+	if err == nil && w.summary != nil && w.summary.Count > 0 {
+		// segment without summary is still readable, just slower
+		if sumErr := writeSummary(w.segment, w.summary); sumErr != nil {
+			w.logger.Log("event", "failed to write segment summary",
+				"segment", w.segment.DataPath(), "error", sumErr)
+		}
+	}
+	w.idx.Close()
+	w.idxWriter = nil
+	w.outWriter = nil
+	if closeErr := w.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// flush writes buffered events to files, on failure both files are
+// truncated to the last flushed events so they stay consistent
+func (w *worker) flush() error {
+	err := w.outWriter.Flush()
+	if err == nil {
+		err = w.idxWriter.Flush()
+	}
+	if err != nil {
+		atomic.AddInt64(&w.lost, int64(w.unflushed))
+		w.out.Truncate(w.outFlushed)
+		w.idx.Truncate(w.idxFlushed)
+		w.outWriter.Reset(w.out)
+		w.idxWriter.Reset(w.idx)
+		w.unsynced -= w.unflushed
+		w.unflushed = 0
+		w.seek = w.outFlushed
+		// summary counts dropped events
+		w.summary = nil
+		w.updatePosition()
+		return errors.Wrap(err, "failed to flush events")
+	}
+
+	w.outFlushed = w.seek
+	w.idxFlushed += int64(w.idxBuffered)
+	w.idxBuffered = 0
+	w.unflushed = 0
+	return nil
+}
+
+// sync flushes and syncs written events to disk,
+// pending block of compressed segment is sealed
+func (w *worker) sync() error {
+	w.sealBlock()
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if w.unsynced == 0 {
+		return nil
+	}
+
+	if err := w.out.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync data file")
+	}
+	if err := w.idx.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync index file")
+	}
+	w.unsynced = 0
+	return nil
+}
+
+// commit writes group of buffered events and syncs them if policy requires,
+// pending block is sealed so committed events never stay in memory
+func (w *worker) commit() error {
+	if !w.isOpen() {
+		return errors.New("worker closed")
+	}
+
+	w.sealBlock()
+	switch {
+	case w.cfg.Sync == SyncAlways,
+		w.cfg.Sync == SyncEveryN && w.unsynced >= w.cfg.SyncEvery:
+		return w.sync()
+	}
+	return w.flush()
+}
+
+// targetFormat is format of new segments
+func (w *worker) targetFormat() uint32 {
+	if w.cfg.Compression == CompressionZstd {
+		return FormatCompressed
+	}
+	return FormatFramed
+}
+
+func (w *worker) shouldRotate() bool {
+	// never append to legacy segment or segment of other compression
+	if w.format != w.targetFormat() {
+		return true
+	}
+	if w.seek <= DataHeaderSize && len(w.blockIndex) == 0 {
+		return false
+	}
+
+	return (w.cfg.SegmentMaxBytes > 0 && w.seek >= w.cfg.SegmentMaxBytes) ||
+		(w.cfg.SegmentMaxAge > 0 && w.now().Sub(w.started) >= w.cfg.SegmentMaxAge)
+}
+
+// rotate closes current segment and starts new one
+func (w *worker) rotate() error {
+	startTs := w.now().UnixNano()
+	if prev := w.segment.StartTime(); startTs <= prev {
+		startTs = prev + 1
+	}
+
+	if err := w.closeSegment(); err != nil {
+		return errors.Wrap(err, "failed to close segment")
+	}
+	return w.openSegment(newSegment(w.filePath, startTs))
 }
 
 func (w *worker) Add(ev *eventagg.Event) error {
@@ -90,37 +339,163 @@ func (w *worker) Add(ev *eventagg.Event) error {
 		return errors.New("worker closed")
 	}
 
-	beginPos := w.seek
-	endPos := int64(0)
+	if w.shouldRotate() {
+		if err := w.rotate(); err != nil {
+			return errors.Wrap(err, "failed to rotate segment")
+		}
+	}
+
 	content, err := json.Marshal(ev)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal event")
 	}
 
-	_, err = w.outWriter.Write(content)
-	if err != nil {
-		return errors.Wrap(err, "failed to write to file")
+	// late event, marker is created before event is written
+	// so readers never binary search unsorted index
+	if w.sorted && ev.Time < w.maxTs {
+		if err = w.segment.markUnsorted(); err != nil {
+			return err
+		}
+		w.sorted = false
 	}
+	w.maxTs = max(w.maxTs, ev.Time)
 
-	endPos = beginPos + int64(len(content))
-	w.idxWriter.Write([]byte(fmt.Sprintf("%d,%d,%d\n", beginPos, endPos, ev.Time)))
-	w.seek = endPos
+	// writes are buffered, write errors are handled by flush
+	frame := record.Encode(content)
+	w.unsynced++
+	if w.summary != nil {
+		w.summary.add(ev)
+	}
+	if w.format == FormatCompressed {
+		w.blockIndex = append(w.blockIndex, IndexEntry{w.seek, int64(len(w.block)), ev.Time})
+		w.block = append(w.block, frame...)
+		if len(w.block) >= w.cfg.BlockSize {
+			w.sealBlock()
+		}
+		w.updatePosition()
+		return nil
+	}
 
+	w.outWriter.Write(frame)
+	w.writeIndex(IndexEntry{w.seek, w.seek + int64(len(frame)), ev.Time})
+	w.seek += int64(len(frame))
+	w.unflushed++
+	w.updatePosition()
 	return nil
 }
 
+// updatePosition publishes position after the last written event,
+// events of pending block are written at seek when block is sealed
+func (w *worker) updatePosition() {
+	w.positionMtx.Lock()
+	defer w.positionMtx.Unlock()
+	w.position = Position{Segment: w.segment.Name, Offset: w.seek, Skip: len(w.blockIndex)}
+}
+
+// Position returns position after the last written event
+func (w *worker) Position() Position {
+	w.positionMtx.Lock()
+	defer w.positionMtx.Unlock()
+	return w.position
+}
+
+// sealBlock compresses pending block of events and writes it
+func (w *worker) sealBlock() {
+	if len(w.blockIndex) == 0 {
+		return
+	}
+
+	frame := EncodeBlock(w.block)
+	w.outWriter.Write(frame)
+	for _, entry := range w.blockIndex {
+		w.writeIndex(entry)
+	}
+	w.seek += int64(len(frame))
+	w.unflushed += len(w.blockIndex)
+	w.block = w.block[:0]
+	w.blockIndex = w.blockIndex[:0]
+}
+
+func (w *worker) writeIndex(entry IndexEntry) {
+	n, _ := w.idxWriter.Write(entry.encode())
+	w.idxBuffered += n
+}
+
+// janitor rotates active segment exceeding max age and enforces retention,
+// so segment of idle worker expires as well
+func (w *worker) janitor() (int, error) {
+	if !w.isOpen() {
+		return 0, errors.New("worker closed")
+	}
+	if w.cfg.SegmentMaxAge > 0 && w.shouldRotate() {
+		if err := w.rotate(); err != nil {
+			return 0, errors.Wrap(err, "failed to rotate segment")
+		}
+	}
+	return w.enforceRetention()
+}
+
+// enforceRetention removes closed segments older than retention max age
+// and the oldest ones while worker data is bigger than retention max bytes
+func (w *worker) enforceRetention() (int, error) {
+	if !w.isOpen() {
+		return 0, errors.New("worker closed")
+	}
+	if w.cfg.RetentionMaxAge <= 0 && w.cfg.RetentionMaxBytes <= 0 {
+		return 0, nil
+	}
+
+	segments, err := Segments(w.filePath)
+	if err != nil {
+		return 0, err
+	}
+
+	total := int64(0)
+	sizes := make([]int64, len(segments))
+	for i := range segments {
+		if sizes[i], err = segments[i].size(); err != nil {
+			return 0, err
+		}
+		total += sizes[i]
+	}
+
+	removed := 0
+	for i, segment := range segments {
+		// active segment is never removed
+		if segment.Name == w.segment.Name {
+			break
+		}
+
+		expired := false
+		if w.cfg.RetentionMaxAge > 0 {
+			info, err := os.Stat(segment.DataPath())
+			if err != nil {
+				return removed, errors.Wrap(err, "failed to read segment file info")
+			}
+			expired = w.now().Sub(info.ModTime()) >= w.cfg.RetentionMaxAge
+		}
+		if !expired && (w.cfg.RetentionMaxBytes <= 0 || total <= w.cfg.RetentionMaxBytes) {
+			continue
+		}
+
+		if err := segment.remove(); err != nil {
+			return removed, err
+		}
+		total -= sizes[i]
+		removed++
+	}
+	return removed, nil
+}
+
 func (w *worker) Close() error {
 	if !atomic.CompareAndSwapInt32(&w.open, 1, 0) {
 		return errors.New("already closed")
 	}
 
-	w.idx.Sync()
-	w.idxWriter = nil
-	w.out.Sync()
+	err := w.closeSegment()
 	w.seek = 0
 	w.filePath = ""
-	w.outWriter = nil
-	return w.out.Close()
+	return err
 }
 
 func (w *worker) isOpen() bool {
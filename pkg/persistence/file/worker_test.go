@@ -1,21 +1,24 @@
 package file
 
 import (
-	// "io/ioutil"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/record"
 
+	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/require"
 )
 
 func TestWorker(t *testing.T) {
-	// fl, err := ioutil.TempFile("", "eventagg-worker")
-	// require.NoError(t, err)
-	// defer os.Remove(fl.Name())
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
 
-	w, err := newWorker(os.TempDir())
+	w, err := newWorker(dir, Config{}, log.NewNopLogger())
 	require.NoError(t, err)
 	defer w.Close()
 
@@ -25,3 +28,365 @@ func TestWorker(t *testing.T) {
 		}))
 	}
 }
+
+func TestSegmentRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now().Add(time.Second)
+	w, err := newWorker(dir, Config{SegmentMaxBytes: 150, SegmentMaxAge: time.Minute}, log.NewNopLogger())
+	require.NoError(t, err)
+	w.now = func() time.Time { return now }
+
+	// 38 bytes per event, rotated by size after 4 events
+	for i := 0; i < 6; i++ {
+		require.NoError(t, w.Add(&eventagg.Event{Time: int64(i)}))
+	}
+	segments, err := Segments(dir)
+	require.NoError(t, err)
+	require.Len(t, segments, 2)
+
+	// rotated by age
+	now = now.Add(time.Minute)
+	require.NoError(t, w.Add(&eventagg.Event{Time: 6}))
+	segments, err = Segments(dir)
+	require.NoError(t, err)
+	require.Len(t, segments, 3)
+	require.Equal(t, segments[2], w.segment)
+	require.Equal(t, now.UnixNano(), w.segment.StartTime())
+	require.NoError(t, w.Close())
+
+	// reopened worker continues the newest segment
+	w, err = newWorker(dir, Config{}, log.NewNopLogger())
+	require.NoError(t, err)
+	defer w.Close()
+	require.Equal(t, segments[2], w.segment)
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := newWorker(dir, Config{SegmentMaxBytes: 1}, log.NewNopLogger())
+	require.NoError(t, err)
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.Add(&eventagg.Event{Time: int64(i)}))
+	}
+	segments, err := Segments(dir)
+	require.NoError(t, err)
+	require.Len(t, segments, 5)
+	segmentSize, err := segments[0].size()
+	require.NoError(t, err)
+
+	// age older segments
+	old := time.Now().Add(-time.Hour * 2)
+	for _, segment := range segments[:2] {
+		require.NoError(t, os.Chtimes(segment.DataPath(), old, old))
+	}
+
+	w.cfg.RetentionMaxAge = time.Hour
+	removed, err := w.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+
+	// keep 2 segments by size, active one is never removed
+	w.cfg.RetentionMaxAge = 0
+	w.cfg.RetentionMaxBytes = segmentSize * 2
+	removed, err = w.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+
+	w.cfg.RetentionMaxBytes = 1
+	removed, err = w.enforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+
+	left, err := Segments(dir)
+	require.NoError(t, err)
+	require.Equal(t, segments[4:], left)
+}
+
+func TestIdleSegmentExpires(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now().Add(time.Second)
+	w, err := newWorker(dir, Config{SegmentMaxAge: time.Minute, RetentionMaxAge: time.Hour}, log.NewNopLogger())
+	require.NoError(t, err)
+	defer w.Close()
+	w.now = func() time.Time { return now }
+
+	require.NoError(t, w.Add(&eventagg.Event{Time: 1}))
+	idle := w.segment
+
+	// no events are added, janitor rotates segment by age
+	now = now.Add(time.Minute)
+	removed, err := w.janitor()
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+	require.NotEqual(t, idle, w.segment)
+	_, err = ReadSummary(idle)
+	require.NoError(t, err, "rotated segment is closed")
+
+	// empty active segment is not rotated again
+	active := w.segment
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, os.Chtimes(idle.DataPath(), now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+	removed, err = w.janitor()
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, active, w.segment)
+
+	left, err := Segments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []Segment{active}, left)
+}
+
+func TestLegacySegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(dir+"/data.out", nil, 0666))
+	require.NoError(t, ioutil.WriteFile(dir+"/segment-00000000000000000010.out", nil, 0666))
+	require.NoError(t, ioutil.WriteFile(dir+"/other.out", nil, 0666))
+
+	segments, err := Segments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []Segment{
+		{Dir: dir, Name: "data"},
+		{Dir: dir, Name: "segment-00000000000000000010"},
+	}, segments)
+	require.EqualValues(t, 0, segments[0].StartTime())
+	require.EqualValues(t, 10, segments[1].StartTime())
+}
+
+func TestTornTailTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := newWorker(dir, Config{}, log.NewNopLogger())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, w.Add(&eventagg.Event{Time: int64(i)}))
+	}
+	segment, validSize := w.segment, w.seek
+	require.NoError(t, w.Close())
+
+	// simulate crash in the middle of record
+	fl, err := os.OpenFile(segment.DataPath(), os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	fl.Write(record.Encode([]byte(`{"ts":3}`))[:10])
+	fl.Close()
+
+	w, err = newWorker(dir, Config{}, log.NewNopLogger())
+	require.NoError(t, err)
+	require.Equal(t, validSize, w.seek)
+	require.NoError(t, w.Add(&eventagg.Event{Time: 3}))
+	require.NoError(t, w.Close())
+
+	fl, err = os.Open(segment.DataPath())
+	require.NoError(t, err)
+	defer fl.Close()
+	info, err := fl.Stat()
+	require.NoError(t, err)
+
+	format, err := ReadFormat(fl)
+	require.NoError(t, err)
+	require.EqualValues(t, FormatFramed, format)
+
+	payloads := []string{}
+	end, err := record.Scan(fl, DataHeaderSize, info.Size(), func(payload []byte, begin, end int64) error {
+		payloads = append(payloads, string(payload))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), end)
+	require.Len(t, payloads, 4)
+	require.Contains(t, payloads[3], `"ts":3`)
+}
+
+func TestLegacySegmentRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	legacy := Segment{Dir: dir, Name: legacySegmentName}
+	require.NoError(t, ioutil.WriteFile(legacy.DataPath(), []byte(`{"ts":1}`), 0666))
+	require.NoError(t, ioutil.WriteFile(legacy.IndexPath(), []byte("0,8,1\n"), 0666))
+
+	w, err := newWorker(dir, Config{}, log.NewNopLogger())
+	require.NoError(t, err)
+	defer w.Close()
+	require.Equal(t, legacy, w.segment)
+
+	require.NoError(t, w.Add(&eventagg.Event{Time: 2}))
+	require.NotEqual(t, legacy, w.segment)
+
+	content, err := ioutil.ReadFile(legacy.DataPath())
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"ts":1}`), content)
+}
+
+func TestCommit(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		unsynced int
+	}{
+		{"none", Config{Sync: SyncNone}, 3},
+		{"interval", Config{Sync: SyncInterval}, 3},
+		{"every_n reached", Config{Sync: SyncEveryN, SyncEvery: 2}, 0},
+		{"every_n not reached", Config{Sync: SyncEveryN, SyncEvery: 5}, 3},
+		{"always", Config{Sync: SyncAlways}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "eventagg-worker")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			w, err := newWorker(dir, tt.cfg, log.NewNopLogger())
+			require.NoError(t, err)
+			defer w.Close()
+
+			for i := 0; i < 3; i++ {
+				require.NoError(t, w.Add(&eventagg.Event{Time: int64(i)}))
+			}
+			size, err := w.segment.size()
+			require.NoError(t, err)
+			require.EqualValues(t, DataHeaderSize+IndexHeaderSize, size, "events are buffered until commit")
+
+			require.NoError(t, w.commit())
+			require.Equal(t, tt.unsynced, w.unsynced)
+
+			data, err := os.Stat(w.segment.DataPath())
+			require.NoError(t, err)
+			require.Equal(t, w.seek, data.Size())
+			index, err := os.Stat(w.segment.IndexPath())
+			require.NoError(t, err)
+			require.EqualValues(t, IndexHeaderSize+3*IndexEntrySize, index.Size())
+		})
+	}
+}
+
+func BenchmarkWorkerSync(b *testing.B) {
+	// events are committed in groups as if they were waiting in worker channel
+	const groupSize = 32
+	policies := []SyncPolicy{SyncNone, SyncInterval, SyncEveryN, SyncAlways}
+
+	for _, policy := range policies {
+		b.Run(string(policy), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "eventagg-worker")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			w, err := newWorker(dir, Config{Sync: policy}, log.NewNopLogger())
+			require.NoError(b, err)
+			defer w.Close()
+
+			var syncTick <-chan time.Time
+			if policy == SyncInterval {
+				ticker := time.NewTicker(w.cfg.SyncInterval)
+				defer ticker.Stop()
+				syncTick = ticker.C
+			}
+
+			ev := &eventagg.Event{Type: "click", Params: map[string]interface{}{"page": "main"}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ev.Time = int64(i)
+				w.Add(ev)
+				if i%groupSize == groupSize-1 {
+					w.commit()
+				}
+				select {
+				case <-syncTick:
+					w.sync()
+				default:
+				}
+			}
+			w.commit()
+		})
+	}
+}
+
+func TestUnsortedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-worker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := newWorker(dir, Config{}, log.NewNopLogger())
+	require.NoError(t, err)
+	require.NoError(t, w.Add(&eventagg.Event{Time: 10}))
+	require.NoError(t, w.Add(&eventagg.Event{Time: 10}))
+	require.NoError(t, w.Add(&eventagg.Event{Time: 12}))
+	require.False(t, w.segment.Unsorted())
+	require.NoError(t, w.Close())
+
+	// order is kept after reopen
+	w, err = newWorker(dir, Config{}, log.NewNopLogger())
+	require.NoError(t, err)
+	require.EqualValues(t, 12, w.maxTs)
+	require.NoError(t, w.Add(&eventagg.Event{Time: 11}))
+	require.True(t, w.segment.Unsorted())
+
+	segment := w.segment
+	require.NoError(t, w.rotate())
+	require.False(t, w.segment.Unsorted())
+	require.NoError(t, w.Close())
+
+	require.NoError(t, segment.remove())
+	_, err = os.Stat(segment.UnsortedPath())
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCloseUnblocksAdd(t *testing.T) {
+	// no worker reads events, as if it was stuck on disk
+	f := &file{in: make(chan *eventagg.Event), closing: make(chan struct{})}
+	added := make(chan error, 1)
+	go func() {
+		added <- f.Add(&eventagg.Event{Type: "a"})
+	}()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- f.Close()
+	}()
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("close is blocked by add")
+	}
+	require.Error(t, <-added)
+	require.Error(t, f.Add(&eventagg.Event{Type: "a"}))
+}
+
+func TestFailedWriteCounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-persistence")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := New(Config{DataDir: dir, Count: 1}, log.NewNopLogger())
+	require.NoError(t, err)
+	// data file fails every write, as if disk was broken
+	require.NoError(t, f.workers[0].out.Close())
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, f.Add(&eventagg.Event{Type: "a"}))
+	}
+	deadline := time.Now().Add(time.Second)
+	for f.Lost() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.EqualValues(t, 3, f.Lost())
+	f.Close()
+}
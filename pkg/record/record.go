@@ -0,0 +1,149 @@
+package record
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// record format:
+// - [4 bytes] payload length, big endian
+// - [4 bytes] crc32 (castagnoli) of payload, big endian
+// - [length bytes] payload, never empty
+//
+// zero filled data left by power loss looks like empty record with valid
+// checksum, so empty records are reported as corrupted
+const HeaderSize = 8
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrTorn is returned when record is not fully written
+	ErrTorn = errors.New("torn record")
+	// ErrChecksum is returned when payload does not match its checksum
+	ErrChecksum = errors.New("record checksum mismatch")
+)
+
+func Encode(payload []byte) []byte {
+	buf := make([]byte, HeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[HeaderSize:], payload)
+	return buf
+}
+
+// Read reads record at offset of data ending at size, returns payload and
+// size of whole record. Size is returned with ErrChecksum as well, so
+// corrupted record can be skipped. Record longer than the rest of data is torn
+func Read(r io.ReaderAt, offset, size int64) ([]byte, int64, error) {
+	var header [HeaderSize]byte
+	if offset+HeaderSize > size {
+		return nil, 0, ErrTorn
+	}
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		if err == io.EOF {
+			return nil, 0, ErrTorn
+		}
+		return nil, 0, errors.Wrap(err, "failed to read record header")
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length == 0 {
+		return nil, HeaderSize, ErrChecksum
+	}
+	// corrupted length should not cause huge allocation
+	if length > size-offset-HeaderSize {
+		return nil, 0, ErrTorn
+	}
+	payload := make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+HeaderSize); err != nil {
+		if err == io.EOF {
+			return nil, 0, ErrTorn
+		}
+		return nil, 0, errors.Wrap(err, "failed to read record payload")
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, HeaderSize + int64(len(payload)), ErrChecksum
+	}
+	return payload, HeaderSize + int64(len(payload)), nil
+}
+
+// Scan reads records starting from offset until end of reader or first
+// torn record, returns offset where valid records end. Record with checksum
+// mismatch followed by valid record is corrupted in place and skipped,
+// the last one is treated as torn
+func Scan(r io.ReaderAt, offset, size int64, f func(payload []byte, begin, end int64) error) (int64, error) {
+	end, _, err := ScanCorrupted(r, offset, size, f)
+	return end, err
+}
+
+// ScanCorrupted is Scan which returns count of skipped corrupted records too
+func ScanCorrupted(r io.ReaderAt, offset, size int64, f func(payload []byte, begin, end int64) error) (int64, int, error) {
+	corrupted := 0
+	for offset < size {
+		payload, n, err := Read(r, offset, size)
+		if err == ErrChecksum && validAt(r, offset+n, size) {
+			corrupted++
+			offset += n
+			continue
+		}
+		if err == ErrTorn || err == ErrChecksum {
+			// length could be corrupted as well, record is torn
+			// only when there are no valid records after it
+			next, ok, resyncErr := resync(r, offset+1, size)
+			if resyncErr != nil {
+				return offset, corrupted, resyncErr
+			}
+			if !ok {
+				break
+			}
+			corrupted++
+			offset = next
+			continue
+		}
+		if err != nil {
+			return offset, corrupted, err
+		}
+		if f != nil {
+			if err = f(payload, offset, offset+n); err != nil {
+				return offset, corrupted, err
+			}
+		}
+		offset += n
+	}
+	return offset, corrupted, nil
+}
+
+// resyncChunkSize is how much data is read at once while searching
+// for valid record
+const resyncChunkSize = 64 * 1024
+
+// resync searches for the first valid record starting at or after offset
+func resync(r io.ReaderAt, offset, size int64) (int64, bool, error) {
+	buf := make([]byte, resyncChunkSize+HeaderSize)
+	for chunk := offset; chunk+HeaderSize <= size; chunk += resyncChunkSize {
+		n, err := r.ReadAt(buf[:min(int64(len(buf)), size-chunk)], chunk)
+		if err != nil && err != io.EOF {
+			return 0, false, errors.Wrap(err, "failed to read data")
+		}
+		for i := 0; i+HeaderSize <= n && i < resyncChunkSize; i++ {
+			pos := chunk + int64(i)
+			// cheap length check first, most positions fail it
+			if pos+HeaderSize+int64(binary.BigEndian.Uint32(buf[i:])) > size {
+				continue
+			}
+			if validAt(r, pos, size) {
+				return pos, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// validAt checks that valid record starts at offset and ends before size
+func validAt(r io.ReaderAt, offset, size int64) bool {
+	_, _, err := Read(r, offset, size)
+	return err == nil
+}
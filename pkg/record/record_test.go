@@ -0,0 +1,124 @@
+package record
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRecords(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(Encode([]byte("first")))
+	buf.Write(Encode([]byte("second")))
+
+	data := buf.Bytes()
+	payload, n, err := Read(bytes.NewReader(data), 0, int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), payload)
+	require.EqualValues(t, HeaderSize+5, n)
+
+	payload, _, err = Read(bytes.NewReader(data), n, int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), payload)
+
+	// torn
+	_, _, err = Read(bytes.NewReader(data), n, int64(len(data)-1))
+	require.Equal(t, ErrTorn, err)
+	_, _, err = Read(bytes.NewReader(data), n, n+3)
+	require.Equal(t, ErrTorn, err)
+
+	// corrupted
+	corrupted := append([]byte{}, data...)
+	corrupted[HeaderSize] = 'F'
+	_, _, err = Read(bytes.NewReader(corrupted), 0, int64(len(corrupted)))
+	require.Equal(t, ErrChecksum, err)
+
+	// zero filled data is not empty record
+	zeros := make([]byte, 64)
+	_, size, err := Read(bytes.NewReader(zeros), 0, int64(len(zeros)))
+	require.Equal(t, ErrChecksum, err)
+	require.EqualValues(t, HeaderSize, size)
+
+	// length beyond the end of data is not allocated
+	huge := Encode([]byte("x"))
+	huge[0], huge[1], huge[2], huge[3] = 0xff, 0xff, 0xff, 0xff
+	_, _, err = Read(bytes.NewReader(huge), 0, int64(len(huge)))
+	require.Equal(t, ErrTorn, err)
+}
+
+func TestScan(t *testing.T) {
+	var buf bytes.Buffer
+	for _, p := range []string{"a", "bb", "ccc"} {
+		buf.Write(Encode([]byte(p)))
+	}
+	validEnd := int64(buf.Len())
+	buf.Write(Encode([]byte("torn"))[:6])
+
+	payloads := []string{}
+	end, err := Scan(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()), func(payload []byte, begin, end int64) error {
+		payloads = append(payloads, string(payload))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, validEnd, end)
+	require.Equal(t, []string{"a", "bb", "ccc"}, payloads)
+	// zero filled tail left by power loss is torn
+	zeroed := append(buf.Bytes()[:validEnd:validEnd], make([]byte, 32)...)
+	end, err = Scan(bytes.NewReader(zeroed), 0, int64(len(zeroed)), nil)
+	require.NoError(t, err)
+	require.Equal(t, validEnd, end)
+}
+
+func TestScanCorrupted(t *testing.T) {
+	var buf bytes.Buffer
+	offsets := []int64{}
+	for _, p := range []string{"a", "bb", "ccc", "dddd"} {
+		offsets = append(offsets, int64(buf.Len()))
+		buf.Write(Encode([]byte(p)))
+	}
+	content := buf.Bytes()
+
+	scan := func(content []byte) ([]string, int64, int) {
+		payloads := []string{}
+		end, corrupted, err := ScanCorrupted(bytes.NewReader(content), 0, int64(len(content)), func(payload []byte, begin, end int64) error {
+			payloads = append(payloads, string(payload))
+			return nil
+		})
+		require.NoError(t, err)
+		return payloads, end, corrupted
+	}
+
+	// record in the middle is skipped
+	middle := append([]byte{}, content...)
+	middle[offsets[1]+HeaderSize] = 'X'
+	payloads, end, corrupted := scan(middle)
+	require.Equal(t, []string{"a", "ccc", "dddd"}, payloads)
+	require.EqualValues(t, len(content), end)
+	require.Equal(t, 1, corrupted)
+
+	// the last record is torn
+	last := append([]byte{}, content...)
+	last[offsets[3]+HeaderSize] = 'X'
+	payloads, end, corrupted = scan(last)
+	require.Equal(t, []string{"a", "bb", "ccc"}, payloads)
+	require.Equal(t, offsets[3], end)
+	require.Equal(t, 0, corrupted)
+
+	// corrupted length, the next valid record is searched
+	for _, delta := range []byte{1, 0x80} {
+		length := append([]byte{}, content...)
+		length[offsets[1]+3] += delta
+		payloads, end, corrupted = scan(length)
+		require.Equal(t, []string{"a", "ccc", "dddd"}, payloads)
+		require.EqualValues(t, len(content), end)
+		require.Equal(t, 1, corrupted)
+	}
+
+	// torn tail after corrupted record
+	torn := append(append([]byte{}, middle...), Encode([]byte("torn"))[:10]...)
+	payloads, end, corrupted = scan(torn)
+	require.Equal(t, []string{"a", "ccc", "dddd"}, payloads)
+	require.EqualValues(t, len(content), end)
+	require.Equal(t, 1, corrupted)
+}
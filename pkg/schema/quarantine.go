@@ -0,0 +1,73 @@
+package schema
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/pkg/errors"
+)
+
+// Quarantine keeps events rejected by validation
+type Quarantine interface {
+	Add(ev *eventagg.Event, errs []*FieldError) error
+	Close() error
+}
+
+type quarantineRecord struct {
+	ReceivedAt int64           `json:"received_at"`
+	Event      *eventagg.Event `json:"event"`
+	Errors     []*FieldError   `json:"errors"`
+}
+
+// fileQuarantine appends rejected events as json lines to single file
+type fileQuarantine struct {
+	mtx sync.Mutex
+	out *os.File
+	enc *json.Encoder
+}
+
+func NewFileQuarantine(path string) (Quarantine, error) {
+	fl, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open quarantine file")
+	}
+
+	return &fileQuarantine{
+		out: fl,
+		enc: json.NewEncoder(fl),
+	}, nil
+}
+
+func (q *fileQuarantine) Add(ev *eventagg.Event, errs []*FieldError) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.out == nil {
+		return errors.New("quarantine closed")
+	}
+
+	err := q.enc.Encode(&quarantineRecord{
+		ReceivedAt: time.Now().Unix(),
+		Event:      ev,
+		Errors:     errs,
+	})
+	return errors.Wrap(err, "failed to write quarantined event")
+}
+
+func (q *fileQuarantine) Close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.out == nil {
+		return errors.New("already closed")
+	}
+	q.out.Sync()
+	err := q.out.Close()
+	q.out = nil
+	q.enc = nil
+	return err
+}
@@ -0,0 +1,226 @@
+package schema
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	ParamType string
+
+	// Param describes single key of eventagg.Event.Params
+	Param struct {
+		Name     string
+		Type     ParamType
+		Required bool
+		Enum     []string
+		Min, Max *float64
+	}
+
+	// Event describes params of events with given event type
+	Event struct {
+		Type               string
+		Params             []Param
+		AllowUnknownParams bool
+	}
+
+	Config struct {
+		Events []Event
+		// RejectUnknownTypes rejects events without registered schema
+		RejectUnknownTypes bool
+	}
+
+	// FieldError describes why single field of event failed validation
+	FieldError struct {
+		Field, Reason string
+	}
+
+	Registry struct {
+		rejectUnknownTypes bool
+		events             map[string]*eventSchema
+	}
+
+	eventSchema struct {
+		allowUnknownParams bool
+		params             map[string]*paramSchema
+		names              []string
+	}
+
+	paramSchema struct {
+		Param
+		enum map[string]struct{}
+	}
+)
+
+const (
+	TypeAny     ParamType = ""
+	TypeString  ParamType = "string"
+	TypeNumber  ParamType = "number"
+	TypeInteger ParamType = "integer"
+	TypeBoolean ParamType = "boolean"
+	TypeObject  ParamType = "object"
+	TypeArray   ParamType = "array"
+
+	FieldEventType = "event_type"
+	fieldParams    = "params"
+)
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+func New(cfg Config) (*Registry, error) {
+	r := &Registry{
+		rejectUnknownTypes: cfg.RejectUnknownTypes,
+		events:             make(map[string]*eventSchema, len(cfg.Events)),
+	}
+
+	for _, ev := range cfg.Events {
+		if _, ok := r.events[ev.Type]; ok {
+			return nil, errors.Errorf("schema for event type %s already exist", ev.Type)
+		}
+
+		es := &eventSchema{
+			allowUnknownParams: ev.AllowUnknownParams,
+			params:             make(map[string]*paramSchema, len(ev.Params)),
+			names:              make([]string, 0, len(ev.Params)),
+		}
+		for _, p := range ev.Params {
+			if _, ok := es.params[p.Name]; ok {
+				return nil, errors.Errorf("param %s of event type %s declared twice", p.Name, ev.Type)
+			}
+			switch p.Type {
+			case TypeAny, TypeString, TypeNumber, TypeInteger, TypeBoolean, TypeObject, TypeArray:
+			default:
+				return nil, errors.Errorf("unknown type %s of param %s", p.Type, p.Name)
+			}
+			if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+				return nil, errors.Errorf("min is bigger than max for param %s", p.Name)
+			}
+
+			ps := &paramSchema{Param: p}
+			if len(p.Enum) > 0 {
+				ps.enum = make(map[string]struct{}, len(p.Enum))
+				for _, v := range p.Enum {
+					ps.enum[v] = struct{}{}
+				}
+			}
+			es.params[p.Name] = ps
+			es.names = append(es.names, p.Name)
+		}
+		r.events[ev.Type] = es
+	}
+
+	return r, nil
+}
+
+// Validate checks event against registered schema of its type,
+// returns nil when event is valid
+func (r *Registry) Validate(ev *eventagg.Event) []*FieldError {
+	es, ok := r.events[ev.Type]
+	if !ok {
+		if r.rejectUnknownTypes {
+			return []*FieldError{{
+				Field:  FieldEventType,
+				Reason: fmt.Sprintf("unknown event type: %s", ev.Type),
+			}}
+		}
+		return nil
+	}
+
+	var errs []*FieldError
+	for _, name := range es.names {
+		p := es.params[name]
+		v, ok := ev.Params[name]
+		if !ok {
+			if p.Required {
+				errs = append(errs, newFieldError(name, "required param is missing"))
+			}
+			continue
+		}
+		if reason := p.check(v); reason != "" {
+			errs = append(errs, newFieldError(name, reason))
+		}
+	}
+
+	if !es.allowUnknownParams {
+		unknown := make([]string, 0)
+		for name := range ev.Params {
+			if _, ok := es.params[name]; !ok {
+				unknown = append(unknown, name)
+			}
+		}
+		sort.Strings(unknown)
+		for _, name := range unknown {
+			errs = append(errs, newFieldError(name, "unknown param"))
+		}
+	}
+	return errs
+}
+
+func newFieldError(name, reason string) *FieldError {
+	return &FieldError{
+		Field:  fieldParams + "." + name,
+		Reason: reason,
+	}
+}
+
+// check returns reason of failure or empty string if value is valid
+func (p *paramSchema) check(v interface{}) string {
+	switch p.Type {
+	case TypeString:
+		if _, ok := v.(string); !ok {
+			return "expected string"
+		}
+	case TypeNumber, TypeInteger:
+		f, ok := v.(float64)
+		if !ok {
+			return fmt.Sprintf("expected %s", p.Type)
+		}
+		if p.Type == TypeInteger && f != math.Trunc(f) {
+			return "expected integer"
+		}
+		if p.Min != nil && f < *p.Min {
+			return fmt.Sprintf("should be greater than or equal to %v", *p.Min)
+		}
+		if p.Max != nil && f > *p.Max {
+			return fmt.Sprintf("should be less than or equal to %v", *p.Max)
+		}
+	case TypeBoolean:
+		if _, ok := v.(bool); !ok {
+			return "expected boolean"
+		}
+	case TypeObject:
+		if _, ok := v.(map[string]interface{}); !ok {
+			return "expected object"
+		}
+	case TypeArray:
+		if _, ok := v.([]interface{}); !ok {
+			return "expected array"
+		}
+	}
+
+	if p.enum != nil {
+		if _, ok := p.enum[enumValue(v)]; !ok {
+			return fmt.Sprintf("value is not one of %v", p.Enum)
+		}
+	}
+	return ""
+}
+
+func enumValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+}
@@ -0,0 +1,157 @@
+package schema
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+
+	"github.com/stretchr/testify/require"
+)
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func testRegistry(t *testing.T, rejectUnknownTypes bool) *Registry {
+	r, err := New(Config{
+		RejectUnknownTypes: rejectUnknownTypes,
+		Events: []Event{
+			{
+				Type: "purchase",
+				Params: []Param{
+					{Name: "country", Type: TypeString, Required: true, Enum: []string{"DE", "US"}},
+					{Name: "amount", Type: TypeNumber, Required: true, Min: floatPtr(0)},
+					{Name: "items", Type: TypeInteger, Min: floatPtr(1), Max: floatPtr(10)},
+					{Name: "gift", Type: TypeBoolean},
+				},
+			},
+			{
+				Type:               "open",
+				AllowUnknownParams: true,
+				Params: []Param{
+					{Name: "version", Enum: []string{"1", "2"}},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	return r
+}
+
+func TestValidate(t *testing.T) {
+	r := testRegistry(t, false)
+
+	cases := []struct {
+		name   string
+		ev     eventagg.Event
+		fields []string
+	}{
+		{
+			name: "valid",
+			ev: eventagg.Event{Type: "purchase", Params: map[string]interface{}{
+				"country": "DE", "amount": 9.99, "items": float64(2), "gift": true,
+			}},
+		},
+		{
+			name: "missing required",
+			ev: eventagg.Event{Type: "purchase", Params: map[string]interface{}{
+				"amount": float64(1),
+			}},
+			fields: []string{"params.country"},
+		},
+		{
+			name: "wrong types and ranges",
+			ev: eventagg.Event{Type: "purchase", Params: map[string]interface{}{
+				"country": "FR", "amount": float64(-1), "items": 1.5, "gift": "yes",
+			}},
+			fields: []string{"params.country", "params.amount", "params.items", "params.gift"},
+		},
+		{
+			name: "unknown params",
+			ev: eventagg.Event{Type: "purchase", Params: map[string]interface{}{
+				"country": "US", "amount": float64(1), "cuntry": "US", "ammount": float64(1),
+			}},
+			fields: []string{"params.ammount", "params.cuntry"},
+		},
+		{
+			name: "allowed unknown params and numeric enum",
+			ev: eventagg.Event{Type: "open", Params: map[string]interface{}{
+				"version": float64(2), "anything": "else",
+			}},
+		},
+		{
+			name: "numeric enum mismatch",
+			ev: eventagg.Event{Type: "open", Params: map[string]interface{}{
+				"version": float64(3),
+			}},
+			fields: []string{"params.version"},
+		},
+		{
+			name: "unknown type",
+			ev:   eventagg.Event{Type: "unknown"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := r.Validate(&c.ev)
+			fields := make([]string, 0, len(errs))
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			require.ElementsMatch(t, c.fields, fields)
+		})
+	}
+}
+
+func TestRejectUnknownTypes(t *testing.T) {
+	r := testRegistry(t, true)
+
+	errs := r.Validate(&eventagg.Event{Type: "unknown"})
+	require.Len(t, errs, 1)
+	require.Equal(t, FieldEventType, errs[0].Field)
+}
+
+func TestInvalidSchema(t *testing.T) {
+	_, err := New(Config{Events: []Event{{Type: "a"}, {Type: "a"}}})
+	require.Error(t, err)
+
+	_, err = New(Config{Events: []Event{{Type: "a", Params: []Param{{Name: "p", Type: "date"}}}}})
+	require.Error(t, err)
+
+	_, err = New(Config{Events: []Event{{Type: "a", Params: []Param{{Name: "p", Min: floatPtr(2), Max: floatPtr(1)}}}}})
+	require.Error(t, err)
+}
+
+func TestFileQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-quarantine")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "quarantine.jsonl")
+	q, err := NewFileQuarantine(path)
+	require.NoError(t, err)
+
+	ev := &eventagg.Event{Type: "purchase", Time: 10}
+	require.NoError(t, q.Add(ev, []*FieldError{{Field: "params.country", Reason: "required param is missing"}}))
+	require.NoError(t, q.Close())
+	require.Error(t, q.Add(ev, nil))
+
+	fl, err := os.Open(path)
+	require.NoError(t, err)
+	defer fl.Close()
+
+	scanner := bufio.NewScanner(fl)
+	require.True(t, scanner.Scan())
+	var rec quarantineRecord
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+	require.Equal(t, ev, rec.Event)
+	require.Len(t, rec.Errors, 1)
+	require.Equal(t, "params.country", rec.Errors[0].Field)
+	require.False(t, scanner.Scan())
+}
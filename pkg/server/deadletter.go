@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/iahmedov/eventagg/pkg/mq"
+	"github.com/iahmedov/eventagg/pkg/mq/deadletter"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type replayResult struct {
+	Replayed []string `json:"replayed"`
+	Errors   []*Error `json:"errors,omitempty"`
+}
+
+func (s *apiServer) deadLetters(w http.ResponseWriter) (*deadletter.Store, bool) {
+	if s.conf.DeadLetters == nil {
+		respondError(w, http.StatusNotImplemented, newError("dead_letter", "dead letter store is not configured"))
+		return nil, false
+	}
+	return s.conf.DeadLetters, true
+}
+
+// ListDeadLetterSubscribers lists subscribers having dead letters
+func (s *apiServer) ListDeadLetterSubscribers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	store, ok := s.deadLetters(w)
+	if !ok {
+		return
+	}
+
+	names, err := store.Subscribers()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, newError("dead_letter", err.Error()))
+		return
+	}
+	respondJSON(w, http.StatusOK, names)
+}
+
+// ListDeadLetters lists dead letters of subscriber
+func (s *apiServer) ListDeadLetters(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	store, ok := s.deadLetters(w)
+	if !ok {
+		return
+	}
+
+	entries, err := store.List(params.ByName("subscriber"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, newError("dead_letter", err.Error()))
+		return
+	}
+	respondJSON(w, http.StatusOK, entries)
+}
+
+// ViewDeadLetter returns single dead letter with event and failure cause
+func (s *apiServer) ViewDeadLetter(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	store, ok := s.deadLetters(w)
+	if !ok {
+		return
+	}
+
+	entry, err := store.Get(params.ByName("subscriber"), params.ByName("id"))
+	switch {
+	case err == deadletter.ErrNotFound:
+		respondError(w, http.StatusNotFound, newError("dead_letter", err.Error()))
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, newError("dead_letter", err.Error()))
+	default:
+		respondJSON(w, http.StatusOK, entry)
+	}
+}
+
+// ReplayDeadLetters delivers dead letters to subscriber again and removes
+// them from store, replays only given ids if `id` query params are given
+func (s *apiServer) ReplayDeadLetters(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if !s.ingestReady(w) {
+		return
+	}
+	store, ok := s.deadLetters(w)
+	if !ok {
+		return
+	}
+	replayer, ok := s.conf.Queue.(mq.Replayer)
+	if !ok {
+		respondError(w, http.StatusNotImplemented, newError("queue", "queue does not support replay"))
+		return
+	}
+
+	subscriber := params.ByName("subscriber")
+	var entries []*deadletter.Entry
+	if ids := r.URL.Query()["id"]; len(ids) > 0 {
+		for _, id := range ids {
+			entry, err := store.Get(subscriber, id)
+			if err != nil {
+				respondError(w, http.StatusNotFound, newError(id, err.Error()))
+				return
+			}
+			entries = append(entries, entry)
+		}
+	} else {
+		var err error
+		if entries, err = store.List(subscriber); err != nil {
+			respondError(w, http.StatusInternalServerError, newError("dead_letter", err.Error()))
+			return
+		}
+	}
+
+	res := replayResult{Replayed: make([]string, 0, len(entries))}
+	for _, entry := range entries {
+		if err := replayer.Replay(subscriber, entry.Event); err != nil {
+			res.Errors = append(res.Errors, newError(entry.ID, err.Error()))
+			continue
+		}
+		if err := store.Remove(subscriber, entry.ID); err != nil {
+			res.Errors = append(res.Errors, newError(entry.ID, err.Error()))
+			continue
+		}
+		res.Replayed = append(res.Replayed, entry.ID)
+	}
+	respondJSON(w, http.StatusOK, res)
+}
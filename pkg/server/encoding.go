@@ -0,0 +1,117 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxBodySize limits decompressed request body when not configured
+	DefaultMaxBodySize int64 = 10 << 20
+
+	errKeyEncoding            = "encoding"
+	errKeyUnsupportedEncoding = "content_encoding"
+	errKeyBodySize            = "body_size"
+)
+
+// decoders are applied to request body in reverse order of Content-Encoding
+// header, see RFC 7231 section 3.1.2.2. Memory of decoder is bounded by limit
+// of decompressed content
+var decoders = map[string]func(r io.Reader, limit int64) (io.ReadCloser, error){
+	"gzip": func(r io.Reader, _ int64) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"zstd": func(r io.Reader, limit int64) (io.ReadCloser, error) {
+		// window bigger than content is never needed
+		window := uint64(max(limit, zstd.MinWindowSize))
+		d, err := zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(window),
+			zstd.WithDecoderMaxMemory(window))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+}
+
+// bodyReader remembers error of reading request body, so it is
+// distinguished from errors of decoding corrupt content
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// readBody reads request body honoring Content-Encoding header and
+// fails if decompressed content is bigger than limit
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+
+	raw := &bodyReader{r: r.Body}
+	var body io.Reader = raw
+	encodings := strings.Split(r.Header.Get("Content-Encoding"), ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+
+		newDecoder, ok := decoders[encoding]
+		if !ok {
+			return nil, newError(errKeyUnsupportedEncoding, fmt.Sprintf("unsupported content encoding: %s", encoding))
+		}
+		decoder, err := newDecoder(body, limit)
+		if err != nil {
+			return nil, decodeError(raw, errors.Wrapf(err, "failed to decode %s content", encoding))
+		}
+		defer decoder.Close()
+		body = decoder
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, decodeError(raw, errors.Wrap(err, "failed to read content"))
+	}
+	if int64(len(content)) > limit {
+		return nil, newError(errKeyBodySize, fmt.Sprintf("content is bigger than %d bytes", limit))
+	}
+	return content, nil
+}
+
+// decodeError blames corrupt content unless request body failed to be read
+func decodeError(raw *bodyReader, err error) error {
+	if raw.err != nil {
+		return newError("network", err.Error())
+	}
+	return newError(errKeyEncoding, err.Error())
+}
+
+// requestErrorStatus maps decoding error to http status code
+func requestErrorStatus(err error) int {
+	if e, ok := err.(*Error); ok {
+		switch e.Key {
+		case errKeyUnsupportedEncoding:
+			return http.StatusUnsupportedMediaType
+		case errKeyBodySize:
+			return http.StatusRequestEntityTooLarge
+		}
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	cold "github.com/iahmedov/eventagg/pkg/aggregator/lazy"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// DefaultExportLimit is page size of export when limit is not given
+	DefaultExportLimit = 1000
+	MaxExportLimit     = 10000
+
+	exportFormatNDJSON = "ndjson"
+	exportFormatCSV    = "csv"
+
+	headerNextCursor = "X-Next-Cursor"
+	contentTypeCSV   = "text/csv"
+)
+
+// Exporter calls f for page of persisted events matching query and
+// returns cursor of the next page, see cold.Exporter
+type Exporter interface {
+	Export(q cold.ExportQuery, f func(ev *eventagg.Event) error) (string, error)
+}
+
+func (s *apiServer) decodeExportEvents(r *http.Request) (*cold.ExportQuery, string, error) {
+	query := r.URL.Query()
+	q := cold.ExportQuery{
+		Before:    time.Now(),
+		EventType: query.Get("event_type"),
+		Cursor:    query.Get("cursor"),
+		Limit:     DefaultExportLimit,
+	}
+
+	var err error
+	if after := query.Get("after"); after != "" {
+		if q.After, err = time.Parse(cold.TimeFormat, after); err != nil {
+			return nil, "", newError("after", fmt.Sprintf("expected format: %s", cold.TimeFormat))
+		}
+	}
+	if before := query.Get("before"); before != "" {
+		if q.Before, err = time.Parse(cold.TimeFormat, before); err != nil {
+			return nil, "", newError("before", fmt.Sprintf("expected format: %s", cold.TimeFormat))
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit <= 0 || q.Limit > MaxExportLimit {
+			return nil, "", newError("limit", fmt.Sprintf("expected number in range [1, %d]", MaxExportLimit))
+		}
+	}
+
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = exportFormatNDJSON
+	case exportFormatNDJSON, exportFormatCSV:
+	default:
+		return nil, "", newError("format", fmt.Sprintf("unsupported format: %s", format))
+	}
+	return &q, format, nil
+}
+
+// ExportEvents returns page of persisted events within time range ordered by ts,
+// cursor of the next page is returned in X-Next-Cursor header
+func (s *apiServer) ExportEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.conf.Events == nil {
+		respondError(w, http.StatusNotImplemented, newError("export", "event export is not configured"))
+		return
+	}
+
+	q, format, err := s.decodeExportEvents(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// page is collected before writing to return cursor in header
+	// and to know csv columns, its size is limited by MaxExportLimit
+	events := make([]*eventagg.Event, 0)
+	next, err := s.conf.Events.Export(*q, func(ev *eventagg.Event) error {
+		events = append(events, ev)
+		return nil
+	})
+	if err == cold.ErrInvalidCursor {
+		respondError(w, http.StatusBadRequest, newError("cursor", err.Error()))
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, newError("export", err.Error()))
+		return
+	}
+
+	if next != "" {
+		w.Header().Set(headerNextCursor, next)
+	}
+	if format == exportFormatCSV {
+		err = writeEventsCSV(w, events)
+	} else {
+		err = writeEventsNDJSON(w, events)
+	}
+	if err != nil {
+		s.logger.Log("event", "failed to write exported events", "error", err)
+	}
+}
+
+func writeEventsNDJSON(w http.ResponseWriter, events []*eventagg.Event) error {
+	w.Header().Set("Content-Type", contentTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	for _, ev := range events {
+		if err := encoder.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEventsCSV writes events with id, event_type and ts columns followed
+// by params.<name> column for every param found in events, nested params
+// are flattened with dot separated names
+func writeEventsCSV(w http.ResponseWriter, events []*eventagg.Event) error {
+	rows := make([]map[string]string, len(events))
+	columns := map[string]bool{}
+	for i, ev := range events {
+		rows[i] = map[string]string{}
+		flattenParams("params", ev.Params, rows[i])
+		for column := range rows[i] {
+			columns[column] = true
+		}
+	}
+
+	paramColumns := make([]string, 0, len(columns))
+	for column := range columns {
+		paramColumns = append(paramColumns, column)
+	}
+	sort.Strings(paramColumns)
+
+	w.Header().Set("Content-Type", contentTypeCSV)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(append([]string{"id", "event_type", "ts"}, paramColumns...)); err != nil {
+		return err
+	}
+	for i, ev := range events {
+		record := []string{ev.ID, ev.Type, strconv.FormatInt(ev.Time, 10)}
+		for _, column := range paramColumns {
+			record = append(record, rows[i][column])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func flattenParams(prefix string, params map[string]interface{}, out map[string]string) {
+	for k, v := range params {
+		key := prefix + "." + k
+		switch value := v.(type) {
+		case map[string]interface{}:
+			flattenParams(key, value, out)
+		case string:
+			out[key] = value
+		case nil:
+			out[key] = ""
+		default:
+			content, _ := json.Marshal(value)
+			out[key] = string(content)
+		}
+	}
+}
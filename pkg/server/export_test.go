@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/iahmedov/eventagg"
+	cold "github.com/iahmedov/eventagg/pkg/aggregator/lazy"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportEvents(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	srv, _ := newTestServer(t, ctx)
+
+	dataDir, err := ioutil.TempDir("", "eventagg-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	persistence, err := pfile.New(pfile.Config{DataDir: dataDir, Count: 2}, log.NewNopLogger())
+	require.NoError(t, err)
+	for i := int64(0); i < 5; i++ {
+		require.NoError(t, persistence.Add(&eventagg.Event{
+			ID:     string(rune('a' + i)),
+			Type:   "click",
+			Time:   100 + i,
+			Params: map[string]interface{}{"page": "home", "pos": map[string]interface{}{"x": float64(i)}},
+		}))
+	}
+	require.NoError(t, persistence.Add(&eventagg.Event{ID: "f", Type: "view", Time: 102}))
+	require.NoError(t, persistence.Close())
+	srv.conf.Events = cold.NewExporter(dataDir)
+
+	serve := func(query url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/events?"+query.Encode(), nil))
+		return rec
+	}
+
+	query := url.Values{
+		"after":      []string{"1970-01-01T00:01:41"},
+		"before":     []string{"1970-01-01T00:02:00"},
+		"event_type": []string{"click"},
+		"limit":      []string{"2"},
+	}
+	ids := []string{}
+	pages := 0
+	for {
+		rec := serve(query)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, contentTypeNDJSON, rec.Header().Get("Content-Type"))
+		scanner := bufio.NewScanner(rec.Body)
+		for scanner.Scan() {
+			var ev eventagg.Event
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &ev))
+			ids = append(ids, ev.ID)
+		}
+		pages++
+
+		cursor := rec.Header().Get(headerNextCursor)
+		if cursor == "" {
+			break
+		}
+		query.Set("cursor", cursor)
+	}
+	require.Equal(t, []string{"b", "c", "d", "e"}, ids)
+	require.Equal(t, 2, pages)
+
+	rec := serve(url.Values{"format": []string{"csv"}, "before": []string{"1970-01-01T00:01:42"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"id", "event_type", "ts", "params.page", "params.pos.x"},
+		{"a", "click", "100", "home", "0"},
+		{"b", "click", "101", "home", "1"},
+		{"c", "click", "102", "home", "2"},
+		{"f", "view", "102", "", ""},
+	}, records)
+
+	for _, query := range []url.Values{
+		{"cursor": []string{"invalid"}},
+		{"after": []string{"yesterday"}},
+		{"limit": []string{"0"}},
+		{"format": []string{"xml"}},
+	} {
+		require.Equal(t, http.StatusBadRequest, serve(query).Code, query.Encode())
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+const (
+	// DefaultDedupWindow is used when deduplication window is not configured
+	DefaultDedupWindow = time.Minute * 10
+	// DefaultDedupSize is used when number of remembered ids is not configured
+	DefaultDedupSize = 1 << 20
+
+	headerIdempotencyKey = "Idempotency-Key"
+)
+
+// idGenerator produces monotonically increasing ulids
+type idGenerator struct {
+	mtx     sync.Mutex
+	entropy io.Reader
+}
+
+func newIDGenerator() *idGenerator {
+	return &idGenerator{
+		entropy: ulid.Monotonic(rand.Reader, 0),
+	}
+}
+
+func (g *idGenerator) New() string {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return ulid.MustNew(ulid.Now(), g.entropy).String()
+}
+
+// seenID is id accepted or being inserted, done is closed when insert
+// of the first event with id is finished
+type seenID struct {
+	id       string
+	at       time.Time
+	done     chan struct{}
+	accepted bool
+}
+
+// dedupWindow remembers ids seen during last window, at most size ids
+// are kept, the oldest ones are forgotten first
+type dedupWindow struct {
+	mtx    sync.Mutex
+	window time.Duration
+	size   int
+	seen   map[string]*seenID
+	order  []*seenID
+	now    func() time.Time
+}
+
+func newDedupWindow(window time.Duration, size int) *dedupWindow {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+
+	return &dedupWindow{
+		window: window,
+		size:   size,
+		seen:   map[string]*seenID{},
+		order:  make([]*seenID, 0),
+		now:    time.Now,
+	}
+}
+
+// Add marks id as seen, returns true if id was not seen within window and
+// caller has to report result of insert with Done. Otherwise id of earlier
+// event is returned, its result is known once done is closed
+func (d *dedupWindow) Add(id string) (*seenID, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := d.now()
+	d.expire(now)
+	if seen, ok := d.seen[id]; ok {
+		return seen, false
+	}
+
+	seen := &seenID{id: id, at: now, done: make(chan struct{})}
+	d.seen[id] = seen
+	d.order = append(d.order, seen)
+	return seen, true
+}
+
+// Done records result of insert, not accepted id is forgotten so client
+// is able to retry with the same id
+func (d *dedupWindow) Done(seen *seenID, accepted bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	seen.accepted = accepted
+	if !accepted && d.seen[seen.id] == seen {
+		delete(d.seen, seen.id)
+	}
+	close(seen.done)
+}
+
+func (d *dedupWindow) expire(now time.Time) {
+	expired := 0
+	for ; expired < len(d.order); expired++ {
+		item := d.order[expired]
+		if now.Sub(item.at) < d.window && len(d.order)-expired < d.size {
+			break
+		}
+		// id could be removed and added again later
+		if d.seen[item.id] == item {
+			delete(d.seen, item.id)
+		}
+		d.order[expired] = nil
+	}
+	// append reallocates order once its capacity is used, so expired
+	// items are not copied
+	d.order = d.order[expired:]
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	d := newDedupWindow(time.Minute, 0)
+	d.now = func() time.Time { return now }
+
+	a, ok := d.Add("a")
+	require.True(t, ok)
+	d.Done(a, true)
+	seen, ok := d.Add("a")
+	require.False(t, ok)
+	require.True(t, seen.accepted)
+
+	now = now.Add(time.Second * 30)
+	b, ok := d.Add("b")
+	require.True(t, ok)
+	_, ok = d.Add("a")
+	require.False(t, ok)
+
+	// duplicate waits for the first insert, not accepted ids could be
+	// added again
+	seen, ok = d.Add("b")
+	require.False(t, ok)
+	d.Done(b, false)
+	<-seen.done
+	require.False(t, seen.accepted)
+	b, ok = d.Add("b")
+	require.True(t, ok)
+	d.Done(b, true)
+
+	// "a" expired, "b" is still in window
+	now = now.Add(time.Second * 31)
+	_, ok = d.Add("a")
+	require.True(t, ok)
+	_, ok = d.Add("b")
+	require.False(t, ok)
+	require.Len(t, d.seen, 2)
+}
+
+func TestDedupWindowSize(t *testing.T) {
+	d := newDedupWindow(time.Minute, 3)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		seen, ok := d.Add(id)
+		require.True(t, ok)
+		d.Done(seen, true)
+	}
+	require.Len(t, d.seen, 3)
+	require.Len(t, d.order, 3)
+
+	// the oldest id is forgotten
+	_, ok := d.Add("a")
+	require.True(t, ok)
+	_, ok = d.Add("d")
+	require.False(t, ok)
+}
+
+func TestIDGenerator(t *testing.T) {
+	g := newIDGenerator()
+	prev := g.New()
+	require.Len(t, prev, 26)
+	for i := 0; i < 100; i++ {
+		id := g.New()
+		require.True(t, id > prev)
+		prev = id
+	}
+}
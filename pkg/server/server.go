@@ -1,17 +1,21 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/iahmedov/eventagg"
 	"github.com/iahmedov/eventagg/pkg/aggregator"
-	localmq "github.com/iahmedov/eventagg/pkg/mq/local"
+	"github.com/iahmedov/eventagg/pkg/mq"
+	"github.com/iahmedov/eventagg/pkg/mq/deadletter"
+	"github.com/iahmedov/eventagg/pkg/schema"
 
 	"github.com/go-kit/kit/log"
 	"github.com/julienschmidt/httprouter"
@@ -20,14 +24,31 @@ import (
 
 type Config struct {
 	Port        int
-	Queue       *localmq.Queue
+	MaxBodySize int64
+	// DedupWindow is how long event ids are remembered to drop retries
+	DedupWindow time.Duration
+	// DedupSize limits number of remembered event ids
+	DedupSize   int
+	Queue       mq.Queue
 	Aggregators map[string]aggregator.View
+	// Schemas validates incoming events, validation is skipped when nil
+	Schemas *schema.Registry
+	// Quarantine stores events failed validation, they are dropped when nil
+	Quarantine schema.Quarantine
+	// DeadLetters is exposed through admin endpoints when given
+	DeadLetters *deadletter.Store
+	// Events exports persisted events, export endpoint is disabled when nil
+	Events Exporter
 }
 
 type apiServer struct {
 	*http.Server
 	conf   Config
 	logger log.Logger
+	ids    *idGenerator
+	dedup  *dedupWindow
+	// ready is set when aggregators are backfilled from persistence
+	ready int32
 }
 
 type aggregateViewRequest struct {
@@ -35,6 +56,22 @@ type aggregateViewRequest struct {
 	Params     []aggregator.Param
 }
 
+type insertEventResult struct {
+	ID        string   `json:"id,omitempty"`
+	Status    string   `json:"status"`
+	Duplicate bool     `json:"duplicate,omitempty"`
+	Errors    []*Error `json:"errors,omitempty"`
+
+	statusCode int
+}
+
+const (
+	insertStatusAccepted = "accepted"
+	insertStatusRejected = "rejected"
+
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
 var emptyData = struct{}{}
 
 func New(cfg Config, logger log.Logger) *apiServer {
@@ -42,10 +79,20 @@ func New(cfg Config, logger log.Logger) *apiServer {
 	srv := &apiServer{
 		conf:   cfg,
 		logger: logger,
+		ids:    newIDGenerator(),
+		dedup:  newDedupWindow(cfg.DedupWindow, cfg.DedupSize),
 	}
 
 	router.POST("/api/v1/event", srv.InsertEvent)
+	router.POST("/api/v1/events", srv.InsertEvents)
+	router.GET("/api/v1/events", srv.ExportEvents)
 	router.GET("/api/v1/aggregator/:name", srv.ViewAggregate)
+	router.GET("/api/v1/queue/subscribers", srv.ViewQueueSubscribers)
+	router.GET("/api/v1/deadletter", srv.ListDeadLetterSubscribers)
+	router.GET("/api/v1/deadletter/:subscriber", srv.ListDeadLetters)
+	router.GET("/api/v1/deadletter/:subscriber/:id", srv.ViewDeadLetter)
+	router.POST("/api/v1/deadletter/:subscriber/replay", srv.ReplayDeadLetters)
+	router.GET("/api/v1/ready", srv.Ready)
 
 	srv.Server = &http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.Port),
@@ -55,9 +102,9 @@ func New(cfg Config, logger log.Logger) *apiServer {
 }
 
 func (s *apiServer) decodeInsertEvent(r *http.Request) (*eventagg.Event, error) {
-	raw, err := ioutil.ReadAll(r.Body)
+	raw, err := readBody(r, s.conf.MaxBodySize)
 	if err != nil {
-		return nil, newError("network", errors.Wrap(err, "failed to read content").Error())
+		return nil, err
 	}
 
 	var ev eventagg.Event
@@ -68,19 +115,180 @@ func (s *apiServer) decodeInsertEvent(r *http.Request) (*eventagg.Event, error)
 }
 
 func (s *apiServer) InsertEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !s.ingestReady(w) {
+		return
+	}
 	ev, err := s.decodeInsertEvent(r)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		respondError(w, requestErrorStatus(err), err)
 		return
 	}
 
+	if ev.ID == "" {
+		ev.ID = r.Header.Get(headerIdempotencyKey)
+	}
+
 	s.logger.Log("event", "incoming event", "data", ev)
-	err = s.conf.Queue.Insert(ev)
+	res := s.insertEvent(ev)
+	if res.Status != insertStatusAccepted {
+		respondErrors(w, res.statusCode, res.Errors)
+		return
+	}
+	respondJSON(w, http.StatusAccepted, res)
+}
+
+// decodeInsertEvents splits request body into raw events, body could be
+// either json array of events or newline delimited json (one event per line)
+func (s *apiServer) decodeInsertEvents(r *http.Request) ([]json.RawMessage, error) {
+	raw, err := readBody(r, s.conf.MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' && !strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeNDJSON) {
+		var items []json.RawMessage
+		if err = json.Unmarshal(raw, &items); err != nil {
+			return nil, newError("data", errors.Wrap(err, "failed to parse content").Error())
+		}
+		return items, nil
+	}
+
+	items := make([]json.RawMessage, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(raw)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, json.RawMessage(line))
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, newError("data", errors.Wrap(err, "failed to split content").Error())
+	}
+	return items, nil
+}
+
+// validateEvent checks event against schema registry, invalid events
+// are moved to quarantine if it is configured
+func (s *apiServer) validateEvent(ev *eventagg.Event) []*Error {
+	if s.conf.Schemas == nil {
+		return nil
+	}
+
+	fieldErrs := s.conf.Schemas.Validate(ev)
+	if len(fieldErrs) == 0 {
+		return nil
+	}
+
+	errs := make([]*Error, len(fieldErrs))
+	for i := range fieldErrs {
+		errs[i] = newError(fieldErrs[i].Field, fieldErrs[i].Reason)
+	}
+
+	if s.conf.Quarantine != nil {
+		if err := s.conf.Quarantine.Add(ev, fieldErrs); err != nil {
+			s.logger.Log("event", "failed to quarantine event", "error", err)
+		}
+	}
+	return errs
+}
+
+// insertEvent validates event, assigns id if it is not given and puts event
+// into queue unless the same id was already accepted within dedup window
+func (s *apiServer) insertEvent(ev *eventagg.Event) insertEventResult {
+	if ev.ID == "" {
+		ev.ID = s.ids.New()
+	}
+
+	if errs := s.validateEvent(ev); len(errs) > 0 {
+		return insertEventResult{
+			ID:         ev.ID,
+			Status:     insertStatusRejected,
+			Errors:     errs,
+			statusCode: http.StatusBadRequest,
+		}
+	}
+
+	seen, first := s.dedup.Add(ev.ID)
+	for !first {
+		// wait for the earlier event with the same id, it is inserted
+		// again if the earlier one was not accepted
+		<-seen.done
+		if seen.accepted {
+			return insertEventResult{
+				ID:        ev.ID,
+				Status:    insertStatusAccepted,
+				Duplicate: true,
+			}
+		}
+		seen, first = s.dedup.Add(ev.ID)
+	}
+
+	err := s.conf.Queue.Insert(ev)
+	s.dedup.Done(seen, err == nil)
+	if err != nil {
+		return insertEventResult{
+			ID:         ev.ID,
+			Status:     insertStatusRejected,
+			Errors:     []*Error{newError("queue", err.Error())},
+			statusCode: http.StatusInternalServerError,
+		}
+	}
+	return insertEventResult{ID: ev.ID, Status: insertStatusAccepted}
+}
+
+// insertRawEvent decodes and inserts single item of batch, idempotencyKey
+// is used to derive id of event when it is not given
+func (s *apiServer) insertRawEvent(raw json.RawMessage, idempotencyKey string) insertEventResult {
+	var ev eventagg.Event
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return insertEventResult{
+			Status:     insertStatusRejected,
+			Errors:     []*Error{newError("data", errors.Wrap(err, "failed to parse event").Error())},
+			statusCode: http.StatusBadRequest,
+		}
+	}
+
+	if ev.ID == "" && idempotencyKey != "" {
+		ev.ID = idempotencyKey
+	}
+	return s.insertEvent(&ev)
+}
+
+// InsertEvents accepts batch of events, every event is inserted independently
+// and result for each of them returned in the same order as in request
+func (s *apiServer) InsertEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !s.ingestReady(w) {
+		return
+	}
+	items, err := s.decodeInsertEvents(r)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		respondError(w, requestErrorStatus(err), err)
 		return
 	}
-	respondJSON(w, http.StatusAccepted, emptyData)
+
+	idempotencyKey := r.Header.Get(headerIdempotencyKey)
+	results := make([]insertEventResult, len(items))
+	accepted := 0
+	for i := range items {
+		itemKey := ""
+		if idempotencyKey != "" {
+			itemKey = fmt.Sprintf("%s-%d", idempotencyKey, i)
+		}
+		results[i] = s.insertRawEvent(items[i], itemKey)
+		if results[i].Status == insertStatusAccepted {
+			accepted++
+		}
+	}
+
+	s.logger.Log("event", "incoming events", "count", len(items), "accepted", accepted)
+	respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"accepted": accepted,
+		"rejected": len(items) - accepted,
+		"results":  results,
+	})
 }
 
 func (s *apiServer) decodeViewAggregate(r *http.Request, params httprouter.Params) (*aggregateViewRequest, error) {
@@ -123,6 +331,41 @@ func (s *apiServer) ViewAggregate(w http.ResponseWriter, r *http.Request, params
 	respondJSON(w, http.StatusOK, res)
 }
 
+// ViewQueueSubscribers reports lag and delivery counters of queue subscribers
+func (s *apiServer) ViewQueueSubscribers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	stats, ok := s.conf.Queue.(mq.StatsProvider)
+	if !ok {
+		respondError(w, http.StatusNotImplemented, newError("queue", "queue does not provide subscriber stats"))
+		return
+	}
+	respondJSON(w, http.StatusOK, stats.Stats())
+}
+
+// SetReady marks server as ready, it is done once startup replay is completed
+func (s *apiServer) SetReady() {
+	atomic.StoreInt32(&s.ready, 1)
+}
+
+// ingestReady rejects events with 503 until server is marked as ready,
+// so events are not queued before aggregators are backfilled
+func (s *apiServer) ingestReady(w http.ResponseWriter) bool {
+	if atomic.LoadInt32(&s.ready) == 1 {
+		return true
+	}
+	respondError(w, http.StatusServiceUnavailable, newError("ready", "service is replaying persisted events"))
+	return false
+}
+
+// Ready responds with 503 until server is marked as ready
+func (s *apiServer) Ready(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ready := atomic.LoadInt32(&s.ready) == 1
+	statusCode := http.StatusOK
+	if !ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+	respondJSON(w, statusCode, map[string]bool{"ready": ready})
+}
+
 func respondError(w http.ResponseWriter, statusCode int, errs ...error) error {
 	if len(errs) == 0 {
 		return respondJSON(w, statusCode, emptyData)
@@ -133,6 +376,14 @@ func respondError(w http.ResponseWriter, statusCode int, errs ...error) error {
 	})
 }
 
+func respondErrors(w http.ResponseWriter, statusCode int, errs []*Error) error {
+	converted := make([]error, len(errs))
+	for i := range errs {
+		converted[i] = errs[i]
+	}
+	return respondError(w, statusCode, converted...)
+}
+
 func respondJSON(w http.ResponseWriter, statusCode int, data interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -0,0 +1,447 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/mq"
+	"github.com/iahmedov/eventagg/pkg/mq/deadletter"
+	localmq "github.com/iahmedov/eventagg/pkg/mq/local"
+	"github.com/iahmedov/eventagg/pkg/schema"
+
+	"github.com/go-kit/kit/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+type insertEventsResponse struct {
+	Accepted int                 `json:"accepted"`
+	Rejected int                 `json:"rejected"`
+	Results  []insertEventResult `json:"results"`
+}
+
+func newTestServer(t *testing.T, ctx context.Context) (*apiServer, chan *eventagg.Event) {
+	received := make(chan *eventagg.Event, 100)
+	queue := localmq.New()
+	queue.Subscribe(func(ev *eventagg.Event) error {
+		received <- ev
+		return nil
+	})
+	go queue.Start(ctx)
+	deadline := time.Now().Add(time.Second)
+	for queue.Insert(nil) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("queue did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	srv := New(Config{Queue: queue}, log.NewNopLogger())
+	srv.SetReady()
+	return srv, received
+}
+
+func TestInsertEvents(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	srv, received := newTestServer(t, ctx)
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		statuses    []string
+	}{
+		{
+			name:        "json array",
+			contentType: "application/json",
+			body:        `[{"event_type":"a","ts":1}, {"event_type":"b","ts":2}, "broken"]`,
+			statuses:    []string{insertStatusAccepted, insertStatusAccepted, insertStatusRejected},
+		},
+		{
+			name:        "ndjson",
+			contentType: contentTypeNDJSON,
+			body:        "{\"event_type\":\"a\",\"ts\":1}\n{broken\n\n{\"event_type\":\"c\",\"ts\":3}\n",
+			statuses:    []string{insertStatusAccepted, insertStatusRejected, insertStatusAccepted},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader(c.body))
+			req.Header.Set("Content-Type", c.contentType)
+			rec := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusAccepted, rec.Code)
+
+			var resp insertEventsResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			require.Len(t, resp.Results, len(c.statuses))
+			accepted := 0
+			for i, status := range c.statuses {
+				require.Equal(t, status, resp.Results[i].Status)
+				if status == insertStatusAccepted {
+					require.Empty(t, resp.Results[i].Errors)
+					accepted++
+				} else {
+					require.Len(t, resp.Results[i].Errors, 1)
+					require.Equal(t, "data", resp.Results[i].Errors[0].Key)
+				}
+			}
+			require.Equal(t, accepted, resp.Accepted)
+			require.Equal(t, len(c.statuses)-accepted, resp.Rejected)
+
+			for i := 0; i < accepted; i++ {
+				select {
+				case <-received:
+				case <-time.After(time.Second):
+					t.Fatal("event was not delivered to queue subscriber")
+				}
+			}
+		})
+	}
+}
+
+func TestInsertEventsMalformedArray(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	srv, _ := newTestServer(t, ctx)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader(`[{"event_type":"a"`))
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestInsertCompressedEvent(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	srv, received := newTestServer(t, ctx)
+	srv.conf.MaxBodySize = 64
+
+	event := []byte(`{"event_type":"compressed","ts":1}`)
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(event)
+	gw.Close()
+
+	zw, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zstded := zw.EncodeAll(event, nil)
+	zw.Close()
+
+	// frame with 1MB window descriptor and single raw block, window is
+	// much bigger than body size limit
+	size := len(event)<<3 | 1
+	windowed := append([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x50, byte(size), byte(size >> 8), byte(size >> 16)}, event...)
+
+	cases := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"gzip", "gzip", gzipped.Bytes(), http.StatusAccepted},
+		{"zstd", "zstd", zstded, http.StatusAccepted},
+		{"identity", "identity", event, http.StatusAccepted},
+		{"unsupported encoding", "br", event, http.StatusUnsupportedMediaType},
+		{"broken gzip", "gzip", event, http.StatusBadRequest},
+		{"broken zstd", "zstd", event, http.StatusBadRequest},
+		{"zstd window too large", "zstd", windowed, http.StatusBadRequest},
+		{"too large", "", bytes.Repeat([]byte(" "), 65), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/event", bytes.NewReader(c.body))
+			req.Header.Set("Content-Encoding", c.encoding)
+			rec := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rec, req)
+			require.Equal(t, c.status, rec.Code)
+			if c.status == http.StatusBadRequest {
+				require.Contains(t, rec.Body.String(), `"encoding"`)
+			}
+			if c.status != http.StatusAccepted {
+				return
+			}
+
+			select {
+			case ev := <-received:
+				require.Equal(t, "compressed", ev.Type)
+			case <-time.After(time.Second):
+				t.Fatal("event was not delivered to queue subscriber")
+			}
+		})
+	}
+}
+
+type memoryQuarantine struct {
+	events []*eventagg.Event
+}
+
+func (q *memoryQuarantine) Add(ev *eventagg.Event, errs []*schema.FieldError) error {
+	q.events = append(q.events, ev)
+	return nil
+}
+
+func (q *memoryQuarantine) Close() error {
+	return nil
+}
+
+func TestInsertInvalidEvent(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	srv, _ := newTestServer(t, ctx)
+
+	registry, err := schema.New(schema.Config{
+		Events: []schema.Event{{
+			Type:   "signup",
+			Params: []schema.Param{{Name: "country", Type: schema.TypeString, Required: true}},
+		}},
+	})
+	require.NoError(t, err)
+	quarantine := &memoryQuarantine{}
+	srv.conf.Schemas = registry
+	srv.conf.Quarantine = quarantine
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/event",
+		strings.NewReader(`{"event_type":"signup","params":{"contry":"DE"}}`))
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	var resp struct {
+		Errors []*Error `json:"errors"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.ElementsMatch(t, []*Error{
+		{Key: "params.country", Value: "required param is missing"},
+		{Key: "params.contry", Value: "unknown param"},
+	}, resp.Errors)
+	require.Len(t, quarantine.events, 1)
+}
+
+func TestIdempotentInsert(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	srv, received := newTestServer(t, ctx)
+
+	post := func(path, body, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(headerIdempotencyKey, key)
+		}
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// generated ids are unique
+	var first, second insertEventResult
+	require.NoError(t, json.NewDecoder(post("/api/v1/event", `{"event_type":"a"}`, "").Body).Decode(&first))
+	require.NoError(t, json.NewDecoder(post("/api/v1/event", `{"event_type":"a"}`, "").Body).Decode(&second))
+	require.NotEmpty(t, first.ID)
+	require.NotEqual(t, first.ID, second.ID)
+	require.False(t, first.Duplicate)
+
+	// retries with the same idempotency key or id are not queued
+	for i := 0; i < 3; i++ {
+		var res insertEventResult
+		rec := post("/api/v1/event", `{"event_type":"a"}`, "retry-key")
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		require.Equal(t, "retry-key", res.ID)
+		require.Equal(t, i > 0, res.Duplicate)
+	}
+	for i := 0; i < 2; i++ {
+		var res insertEventResult
+		require.NoError(t, json.NewDecoder(post("/api/v1/event", `{"id":"client-id","event_type":"a"}`, "").Body).Decode(&res))
+		require.Equal(t, i > 0, res.Duplicate)
+	}
+
+	// batch retry
+	for i := 0; i < 2; i++ {
+		var resp insertEventsResponse
+		rec := post("/api/v1/events", `[{"event_type":"b"},{"id":"x","event_type":"b"}]`, "batch-key")
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.Len(t, resp.Results, 2)
+		require.Equal(t, "batch-key-0", resp.Results[0].ID)
+		require.Equal(t, "x", resp.Results[1].ID)
+		require.Equal(t, i > 0, resp.Results[0].Duplicate)
+		require.Equal(t, i > 0, resp.Results[1].Duplicate)
+	}
+
+	// 2 generated + 1 keyed + 1 client id + 2 batch items
+	for i := 0; i < 6; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("event was not delivered to queue subscriber")
+		}
+	}
+	select {
+	case ev := <-received:
+		t.Fatalf("duplicate event %s delivered", ev.ID)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+// failingQueue blocks every insert until it is released and fails the first one
+type failingQueue struct {
+	mq.Queue
+	release  chan struct{}
+	inserted chan *eventagg.Event
+	calls    int32
+}
+
+func (q *failingQueue) Insert(ev *eventagg.Event) error {
+	<-q.release
+	if atomic.AddInt32(&q.calls, 1) == 1 {
+		return errors.New("queue is full")
+	}
+	q.inserted <- ev
+	return nil
+}
+
+func TestDuplicateWaitsForInsert(t *testing.T) {
+	queue := &failingQueue{release: make(chan struct{}), inserted: make(chan *eventagg.Event, 2)}
+	srv := New(Config{Queue: queue}, log.NewNopLogger())
+	srv.SetReady()
+
+	post := func(codes chan<- int) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/event", strings.NewReader(`{"id":"x","event_type":"a"}`))
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		codes <- rec.Code
+	}
+
+	first, retry := make(chan int, 1), make(chan int, 1)
+	go post(first)
+	// let the first request hold the id
+	deadline := time.Now().Add(time.Second)
+	for {
+		srv.dedup.mtx.Lock()
+		_, ok := srv.dedup.seen["x"]
+		srv.dedup.mtx.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first request did not start insert")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go post(retry)
+
+	select {
+	case code := <-retry:
+		t.Fatalf("retry returned %d before the first insert finished", code)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// the first insert fails, so the retry is inserted instead of being
+	// reported as duplicate
+	close(queue.release)
+	require.Equal(t, http.StatusInternalServerError, <-first)
+	require.Equal(t, http.StatusAccepted, <-retry)
+	require.Equal(t, "x", (<-queue.inserted).ID)
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	srv, received := newTestServer(t, ctx)
+
+	dir, err := ioutil.TempDir("", "eventagg-deadletter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := deadletter.New(dir)
+	require.NoError(t, err)
+	srv.conf.DeadLetters = store
+
+	subscriber := "subscriber-0"
+	require.NoError(t, store.Add(subscriber, &eventagg.Event{Type: "a"}, errors.New("failed"), 1))
+	require.NoError(t, store.Add(subscriber, &eventagg.Event{Type: "b"}, errors.New("failed"), 1))
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "/api/v1/deadletter/"+subscriber)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var entries []*deadletter.Entry
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&entries))
+	require.Len(t, entries, 2)
+
+	rec = serve(http.MethodGet, "/api/v1/deadletter/"+subscriber+"/"+entries[0].ID)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/api/v1/deadletter/"+subscriber+"/unknown").Code)
+
+	// replay single entry and then the rest
+	rec = serve(http.MethodPost, "/api/v1/deadletter/"+subscriber+"/replay?id="+entries[1].ID)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res replayResult
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Equal(t, []string{entries[1].ID}, res.Replayed)
+
+	rec = serve(http.MethodPost, "/api/v1/deadletter/"+subscriber+"/replay")
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Equal(t, []string{entries[0].ID}, res.Replayed)
+
+	types := []string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-received:
+			types = append(types, ev.Type)
+		case <-time.After(time.Second):
+			t.Fatal("event was not replayed")
+		}
+	}
+	require.Equal(t, []string{"b", "a"}, types)
+
+	left, err := store.List(subscriber)
+	require.NoError(t, err)
+	require.Empty(t, left)
+}
+
+func TestReady(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	srv, received := newTestServer(t, ctx)
+	srv = New(srv.conf, log.NewNopLogger())
+
+	serve := func(method, path, body string) int {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec.Code
+	}
+
+	// events are rejected while aggregators are backfilled
+	require.Equal(t, http.StatusServiceUnavailable, serve(http.MethodGet, "/api/v1/ready", ""))
+	require.Equal(t, http.StatusServiceUnavailable, serve(http.MethodPost, "/api/v1/event", `{"event_type":"a"}`))
+	require.Equal(t, http.StatusServiceUnavailable, serve(http.MethodPost, "/api/v1/events", `[{"event_type":"a"}]`))
+
+	srv.SetReady()
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/api/v1/ready", ""))
+	require.Equal(t, http.StatusAccepted, serve(http.MethodPost, "/api/v1/event", `{"event_type":"a"}`))
+	select {
+	case ev := <-received:
+		require.Equal(t, "a", ev.Type)
+	case <-time.After(time.Second):
+		t.Fatal("event was not delivered to queue subscriber")
+	}
+}
@@ -0,0 +1,276 @@
+package sketch
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DDSketch estimates quantiles of values with relative accuracy, value v
+// is counted in bucket i covering (gamma^(i-1), gamma^i] of |v|, where
+// gamma = (1+accuracy)/(1-accuracy). Estimated quantile is within
+// accuracy*|actual| of actual one while count of buckets is below maxBins,
+// otherwise buckets of values closest to zero are collapsed
+type DDSketch struct {
+	accuracy float64
+	maxBins  int
+	gamma    float64
+	logGamma float64
+
+	positive map[int32]uint64
+	negative map[int32]uint64
+	zero     uint64
+	count    uint64
+	min, max float64
+}
+
+const (
+	DefaultRelativeAccuracy = 0.01
+	DefaultMaxBins          = 2048
+
+	// values closer to zero are counted as zeros
+	minIndexable = 1e-9
+
+	ddVersion = 1
+)
+
+var ErrAccuracyMismatch = errors.New("sketches have different accuracy")
+
+func NewDDSketch(accuracy float64, maxBins int) (*DDSketch, error) {
+	if !(accuracy > 0 && accuracy < 1) {
+		return nil, errors.New("relative accuracy should be in range (0, 1)")
+	}
+	if maxBins <= 0 {
+		return nil, errors.New("max bins should be positive")
+	}
+
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &DDSketch{
+		accuracy: accuracy,
+		maxBins:  maxBins,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		positive: map[int32]uint64{},
+		negative: map[int32]uint64{},
+	}, nil
+}
+
+func (s *DDSketch) RelativeAccuracy() float64 {
+	return s.accuracy
+}
+
+func (s *DDSketch) Count() uint64 {
+	return s.count
+}
+
+func (s *DDSketch) index(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value is the middle of bucket in terms of relative error
+func (s *DDSketch) value(index int32) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
+
+// Add counts value, NaN and infinite values are ignored
+func (s *DDSketch) Add(v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+
+	switch {
+	case v > minIndexable:
+		s.positive[s.index(v)]++
+		s.collapse(s.positive)
+	case v < -minIndexable:
+		s.negative[s.index(-v)]++
+		s.collapse(s.negative)
+	default:
+		s.zero++
+	}
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+}
+
+// collapse merges buckets of the smallest magnitudes while there are too many
+func (s *DDSketch) collapse(bins map[int32]uint64) {
+	if len(bins) <= s.maxBins {
+		return
+	}
+
+	indexes := sortedIndexes(bins)
+	target := indexes[len(indexes)-s.maxBins]
+	for _, idx := range indexes[:len(indexes)-s.maxBins] {
+		bins[target] += bins[idx]
+		delete(bins, idx)
+	}
+}
+
+func sortedIndexes(bins map[int32]uint64) []int32 {
+	indexes := make([]int32, 0, len(bins))
+	for idx := range bins {
+		indexes = append(indexes, idx)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes
+}
+
+// Merge adds values of other sketch, result is the same as
+// if values of both were added into one
+func (s *DDSketch) Merge(o *DDSketch) error {
+	if s.accuracy != o.accuracy {
+		return ErrAccuracyMismatch
+	}
+	if o.count == 0 {
+		return nil
+	}
+
+	for idx, c := range o.positive {
+		s.positive[idx] += c
+	}
+	for idx, c := range o.negative {
+		s.negative[idx] += c
+	}
+	s.collapse(s.positive)
+	s.collapse(s.negative)
+	s.zero += o.zero
+	if s.count == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.count == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	s.count += o.count
+	return nil
+}
+
+// Quantile returns estimated value of q-quantile, q should be in [0, 1].
+// Quantile of empty sketch is NaN
+func (s *DDSketch) Quantile(q float64) float64 {
+	if s.count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	if q == 0 {
+		return s.min
+	}
+	if q == 1 {
+		return s.max
+	}
+
+	rank := uint64(q * float64(s.count-1))
+	var seen uint64
+
+	negative := sortedIndexes(s.negative)
+	for i := len(negative) - 1; i >= 0; i-- {
+		seen += s.negative[negative[i]]
+		if seen > rank {
+			return s.clamp(-s.value(negative[i]))
+		}
+	}
+	seen += s.zero
+	if seen > rank {
+		return s.clamp(0)
+	}
+	for _, idx := range sortedIndexes(s.positive) {
+		seen += s.positive[idx]
+		if seen > rank {
+			return s.clamp(s.value(idx))
+		}
+	}
+	return s.max
+}
+
+// clamp keeps estimate within seen values
+func (s *DDSketch) clamp(v float64) float64 {
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+// MarshalBinary encodes sketch as [version][accuracy][max bins][count]
+// [zero][min][max] followed by positive and negative buckets, every bucket
+// set is [count of buckets]([index][count])...
+func (s *DDSketch) MarshalBinary() ([]byte, error) {
+	content := []byte{ddVersion}
+	content = binary.BigEndian.AppendUint64(content, math.Float64bits(s.accuracy))
+	content = binary.AppendUvarint(content, uint64(s.maxBins))
+	content = binary.AppendUvarint(content, s.count)
+	content = binary.AppendUvarint(content, s.zero)
+	content = binary.BigEndian.AppendUint64(content, math.Float64bits(s.min))
+	content = binary.BigEndian.AppendUint64(content, math.Float64bits(s.max))
+	for _, bins := range []map[int32]uint64{s.positive, s.negative} {
+		content = binary.AppendUvarint(content, uint64(len(bins)))
+		for _, idx := range sortedIndexes(bins) {
+			content = binary.AppendVarint(content, int64(idx))
+			content = binary.AppendUvarint(content, bins[idx])
+		}
+	}
+	return content, nil
+}
+
+func (s *DDSketch) UnmarshalBinary(content []byte) error {
+	invalid := errors.New("invalid ddsketch encoding")
+	if len(content) < 9 || content[0] != ddVersion {
+		return invalid
+	}
+	accuracy := math.Float64frombits(binary.BigEndian.Uint64(content[1:]))
+	content = content[9:]
+
+	failed := false
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(content)
+		if n <= 0 {
+			failed = true
+			return 0
+		}
+		content = content[n:]
+		return v
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(content)
+		if n <= 0 {
+			failed = true
+			return 0
+		}
+		content = content[n:]
+		return v
+	}
+	float := func() float64 {
+		if len(content) < 8 {
+			failed = true
+			return 0
+		}
+		v := math.Float64frombits(binary.BigEndian.Uint64(content))
+		content = content[8:]
+		return v
+	}
+
+	maxBins := uvarint()
+	if failed || maxBins > math.MaxInt32 {
+		return invalid
+	}
+	decoded, err := NewDDSketch(accuracy, int(maxBins))
+	if err != nil {
+		return errors.Wrap(err, "invalid ddsketch encoding")
+	}
+	decoded.count, decoded.zero = uvarint(), uvarint()
+	decoded.min, decoded.max = float(), float()
+	for _, bins := range []map[int32]uint64{decoded.positive, decoded.negative} {
+		n := uvarint()
+		for i := uint64(0); i < n && !failed; i++ {
+			idx := varint()
+			bins[int32(idx)] = uvarint()
+		}
+	}
+	if failed || len(content) != 0 {
+		return invalid
+	}
+
+	*s = *decoded
+	return nil
+}
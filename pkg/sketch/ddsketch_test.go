@@ -0,0 +1,100 @@
+package sketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestDDSketchQuantiles(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	cases := map[string]func() float64{
+		"uniform":     func() float64 { return rnd.Float64() * 1000 },
+		"exponential": func() float64 { return rnd.ExpFloat64() * 50 },
+		"mixed_sign":  func() float64 { return rnd.NormFloat64() * 100 },
+		"with_zeros":  func() float64 { return float64(rnd.Intn(3)) },
+	}
+
+	for name, gen := range cases {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewDDSketch(DefaultRelativeAccuracy, DefaultMaxBins)
+			require.NoError(t, err)
+			values := make([]float64, 10000)
+			for i := range values {
+				values[i] = gen()
+				s.Add(values[i])
+			}
+			sort.Float64s(values)
+
+			require.Equal(t, uint64(len(values)), s.Count())
+			for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.75, 0.95, 0.99, 1} {
+				expected := exactQuantile(values, q)
+				require.InDelta(t, expected, s.Quantile(q), DefaultRelativeAccuracy*math.Abs(expected)+1e-9, "q=%v", q)
+			}
+		})
+	}
+
+	empty, _ := NewDDSketch(DefaultRelativeAccuracy, DefaultMaxBins)
+	require.True(t, math.IsNaN(empty.Quantile(0.5)))
+}
+
+func TestDDSketchMerge(t *testing.T) {
+	a, _ := NewDDSketch(0.02, DefaultMaxBins)
+	b, _ := NewDDSketch(0.02, DefaultMaxBins)
+	all, _ := NewDDSketch(0.02, DefaultMaxBins)
+	for i := 1; i <= 1000; i++ {
+		v := float64(i)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(-v)
+			v = -v
+		}
+		all.Add(v)
+	}
+
+	require.NoError(t, a.Merge(b))
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		require.Equal(t, all.Quantile(q), a.Quantile(q))
+	}
+	require.Equal(t, all.Count(), a.Count())
+
+	other, _ := NewDDSketch(0.01, DefaultMaxBins)
+	require.Equal(t, ErrAccuracyMismatch, a.Merge(other))
+}
+
+func TestDDSketchCollapse(t *testing.T) {
+	s, _ := NewDDSketch(0.01, 10)
+	for i := 0; i < 1000; i++ {
+		s.Add(math.Pow(1.1, float64(i%100)))
+	}
+	require.Len(t, s.positive, 10)
+	// upper quantiles keep accuracy
+	require.InDelta(t, math.Pow(1.1, 98), s.Quantile(0.99), 0.01*math.Pow(1.1, 98))
+}
+
+func TestDDSketchEncoding(t *testing.T) {
+	s, _ := NewDDSketch(0.05, 100)
+	for _, v := range []float64{-3, 0, 0, 1.5, 42, 1e6} {
+		s.Add(v)
+	}
+	content, err := s.MarshalBinary()
+	require.NoError(t, err)
+
+	decoded := &DDSketch{}
+	require.NoError(t, decoded.UnmarshalBinary(content))
+	require.Equal(t, s, decoded)
+
+	require.Error(t, decoded.UnmarshalBinary(content[:len(content)-1]))
+	require.Error(t, decoded.UnmarshalBinary(nil))
+
+	_, err = NewDDSketch(1, 100)
+	require.Error(t, err)
+}
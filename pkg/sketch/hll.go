@@ -0,0 +1,134 @@
+package sketch
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// HyperLogLog estimates count of distinct values with 2^precision
+// registers, standard error of estimate is 1.04/sqrt(2^precision)
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+const (
+	MinPrecision     = 4
+	MaxPrecision     = 18
+	DefaultPrecision = 12
+
+	hllVersion = 1
+)
+
+var ErrPrecisionMismatch = errors.New("sketches have different precision")
+
+func NewHyperLogLog(precision uint8) (*HyperLogLog, error) {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, errors.Errorf("precision should be in range [%d, %d]", MinPrecision, MaxPrecision)
+	}
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}, nil
+}
+
+// hash64 is fnv-1a finalized by murmur3 mix, so every bit is well distributed
+func hash64(value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(value)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *HyperLogLog) Add(value []byte) {
+	x := hash64(value)
+	idx := x >> (64 - h.precision)
+	// position of the first set bit in the rest of hash
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *HyperLogLog) Precision() uint8 {
+	return h.precision
+}
+
+// Merge adds values of other sketch, result is the same as
+// if values of both were added into one
+func (h *HyperLogLog) Merge(o *HyperLogLog) error {
+	if h.precision != o.precision {
+		return ErrPrecisionMismatch
+	}
+	for i, r := range o.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+
+	// linear counting is more precise for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// RelativeError is standard error of estimate
+func (h *HyperLogLog) RelativeError() float64 {
+	return 1.04 / math.Sqrt(float64(len(h.registers)))
+}
+
+// MarshalBinary encodes sketch as [version][precision][registers]
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	content := make([]byte, 2+len(h.registers))
+	content[0], content[1] = hllVersion, h.precision
+	copy(content[2:], h.registers)
+	return content, nil
+}
+
+func (h *HyperLogLog) UnmarshalBinary(content []byte) error {
+	if len(content) < 2 || content[0] != hllVersion {
+		return errors.New("invalid hyperloglog encoding")
+	}
+	precision := content[1]
+	if precision < MinPrecision || precision > MaxPrecision || len(content)-2 != 1<<precision {
+		return errors.New("invalid hyperloglog encoding")
+	}
+
+	h.precision = precision
+	h.registers = append([]uint8(nil), content[2:]...)
+	return nil
+}
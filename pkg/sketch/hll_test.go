@@ -0,0 +1,69 @@
+package sketch
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			h, err := NewHyperLogLog(DefaultPrecision)
+			require.NoError(t, err)
+			for i := 0; i < n; i++ {
+				// duplicates do not change estimate
+				h.Add([]byte(strconv.Itoa(i)))
+				h.Add([]byte(strconv.Itoa(i)))
+			}
+
+			// 4 standard errors
+			bound := math.Max(1, 4*h.RelativeError()*float64(n))
+			require.InDelta(t, n, h.Estimate(), bound)
+		})
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, _ := NewHyperLogLog(10)
+	b, _ := NewHyperLogLog(10)
+	all, _ := NewHyperLogLog(10)
+	for i := 0; i < 5000; i++ {
+		v := []byte("user-" + strconv.Itoa(i))
+		if i < 3000 {
+			a.Add(v)
+		}
+		if i >= 2000 {
+			b.Add(v)
+		}
+		all.Add(v)
+	}
+
+	require.NoError(t, a.Merge(b))
+	require.Equal(t, all.Estimate(), a.Estimate())
+	require.Equal(t, all.registers, a.registers)
+
+	other, _ := NewHyperLogLog(11)
+	require.Equal(t, ErrPrecisionMismatch, a.Merge(other))
+}
+
+func TestHyperLogLogEncoding(t *testing.T) {
+	h, _ := NewHyperLogLog(8)
+	for i := 0; i < 300; i++ {
+		h.Add([]byte(strconv.Itoa(i)))
+	}
+	content, err := h.MarshalBinary()
+	require.NoError(t, err)
+
+	decoded := &HyperLogLog{}
+	require.NoError(t, decoded.UnmarshalBinary(content))
+	require.Equal(t, h.Estimate(), decoded.Estimate())
+
+	require.Error(t, decoded.UnmarshalBinary(content[:10]))
+	require.Error(t, decoded.UnmarshalBinary(nil))
+
+	_, err = NewHyperLogLog(MaxPrecision + 1)
+	require.Error(t, err)
+}
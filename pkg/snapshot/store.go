@@ -0,0 +1,192 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot is state of aggregators and positions of persistence workers
+// taken at the same time, events after positions are replayed on restore
+type Snapshot struct {
+	CreatedAt   int64             `json:"created_at"`
+	Positions   pfile.Positions   `json:"positions"`
+	Aggregators map[string][]byte `json:"aggregators"`
+}
+
+// ErrIncomplete is returned when snapshot misses state of aggregator
+// or state does not match config of aggregator
+var ErrIncomplete = errors.New("snapshot misses aggregator state")
+
+// Store keeps every snapshot as separate file, only the newest ones are kept:
+// - <dir>/snapshot-<created_at>.json
+type Store struct {
+	dir  string
+	keep int
+}
+
+const (
+	// DefaultKeep is how many snapshots are kept when not configured
+	DefaultKeep = 2
+
+	snapshotPrefix = "snapshot-"
+	snapshotExt    = ".json"
+)
+
+func New(dir string, keep int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "failed to create snapshot dir")
+	}
+	if keep <= 0 {
+		keep = DefaultKeep
+	}
+
+	return &Store{dir: dir, keep: keep}, nil
+}
+
+// Take captures positions and state of every snapshotter, delivery of events
+// should be paused meanwhile (see mq.Pauser) for them to be consistent.
+// Aggregators without snapshot support are skipped
+func Take(positions pfile.Positions, aggregators map[string]aggregator.Aggregator) (*Snapshot, error) {
+	s := &Snapshot{
+		CreatedAt:   time.Now().UnixNano(),
+		Positions:   positions,
+		Aggregators: map[string][]byte{},
+	}
+	for alias, agg := range aggregators {
+		snapshotter, ok := agg.(aggregator.Snapshotter)
+		if !ok {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := snapshotter.Snapshot(&buf); err != nil {
+			return nil, errors.Wrapf(err, "failed to snapshot aggregator %s", alias)
+		}
+		s.Aggregators[alias] = buf.Bytes()
+	}
+	return s, nil
+}
+
+// Restore restores every snapshotter, nothing is restored when state
+// of any of them is missing or was taken with different config
+func (s *Snapshot) Restore(aggregators map[string]aggregator.Aggregator) error {
+	snapshotters := map[string]aggregator.Snapshotter{}
+	for alias, agg := range aggregators {
+		snapshotter, ok := agg.(aggregator.Snapshotter)
+		if !ok {
+			continue
+		}
+		state, ok := s.Aggregators[alias]
+		if !ok {
+			return ErrIncomplete
+		}
+		err := snapshotter.CheckState(bytes.NewReader(state))
+		if errors.Cause(err) == aggregator.ErrStateMismatch {
+			return ErrIncomplete
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to check state of aggregator %s", alias)
+		}
+		snapshotters[alias] = snapshotter
+	}
+
+	for alias, snapshotter := range snapshotters {
+		if err := snapshotter.Restore(bytes.NewReader(s.Aggregators[alias])); err != nil {
+			return errors.Wrapf(err, "failed to restore aggregator %s", alias)
+		}
+	}
+	return nil
+}
+
+func (st *Store) path(createdAt int64) string {
+	return filepath.Join(st.dir, fmt.Sprintf("%s%.20d%s", snapshotPrefix, createdAt, snapshotExt))
+}
+
+// Write stores snapshot atomically and removes the oldest ones
+func (st *Store) Write(s *Snapshot) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal snapshot")
+	}
+
+	path := st.path(s.CreatedAt)
+	tmp, err := ioutil.TempFile(st.dir, "tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create snapshot file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write snapshot")
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "failed to rename snapshot")
+	}
+
+	names, err := st.list()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(names)-st.keep; i++ {
+		if err = os.Remove(filepath.Join(st.dir, names[i])); err != nil {
+			return errors.Wrap(err, "failed to remove old snapshot")
+		}
+	}
+	return nil
+}
+
+// Latest returns the newest readable snapshot, nil when there is none
+func (st *Store) Latest() (*Snapshot, error) {
+	names, err := st.list()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(names) - 1; i >= 0; i-- {
+		content, err := ioutil.ReadFile(filepath.Join(st.dir, names[i]))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read snapshot")
+		}
+
+		var s Snapshot
+		// unreadable snapshot is skipped for the previous one
+		if err = json.Unmarshal(content, &s); err == nil {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+// list returns names of snapshot files from oldest to newest
+func (st *Store) list() ([]string, error) {
+	infos, err := ioutil.ReadDir(st.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list snapshots")
+	}
+
+	names := []string{}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), snapshotPrefix) && strings.HasSuffix(info.Name(), snapshotExt) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
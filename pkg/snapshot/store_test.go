@@ -0,0 +1,170 @@
+package snapshot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iahmedov/eventagg"
+	"github.com/iahmedov/eventagg/pkg/aggregator"
+	"github.com/iahmedov/eventagg/pkg/aggregator/realtime"
+	"github.com/iahmedov/eventagg/pkg/mq/local"
+	pfile "github.com/iahmedov/eventagg/pkg/persistence/file"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := New(dir, 2)
+	require.NoError(t, err)
+	latest, err := store.Latest()
+	require.NoError(t, err)
+	require.Nil(t, latest)
+
+	for i := int64(1); i <= 3; i++ {
+		require.NoError(t, store.Write(&Snapshot{
+			CreatedAt: i,
+			Positions: pfile.Positions{"worker-000000": {Segment: "segment-1", Offset: i}},
+		}))
+	}
+	names, err := store.list()
+	require.NoError(t, err)
+	require.Len(t, names, 2, "only the newest are kept")
+
+	latest, err = store.Latest()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, latest.CreatedAt)
+	require.EqualValues(t, 3, latest.Positions["worker-000000"].Offset)
+
+	// corrupted snapshot falls back to the previous one
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, names[1]), []byte("{"), 0666))
+	latest, err = store.Latest()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, latest.CreatedAt)
+}
+
+func TestTakeRestore(t *testing.T) {
+	newAggregators := func() map[string]aggregator.Aggregator {
+		count, err := realtime.NewCountAggregator(aggregator.Config{})
+		require.NoError(t, err)
+		return map[string]aggregator.Aggregator{"count": count}
+	}
+
+	aggregators := newAggregators()
+	require.NoError(t, aggregators["count"].Add(&eventagg.Event{Type: "a"}))
+	positions := pfile.Positions{"worker-000000": {Segment: "segment-1", Offset: 8}}
+	s, err := Take(positions, aggregators)
+	require.NoError(t, err)
+	require.Equal(t, positions, s.Positions)
+
+	restored := newAggregators()
+	require.NoError(t, s.Restore(restored))
+	res, err := restored["count"].View()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"a": 1}, res)
+
+	// new aggregator is not covered by snapshot
+	restored["other"] = newAggregators()["count"]
+	require.Equal(t, ErrIncomplete, s.Restore(restored))
+}
+
+func TestRestoreChangedGroupBy(t *testing.T) {
+	newAggregators := func(groupBy ...string) map[string]aggregator.Aggregator {
+		count, err := realtime.NewCountAggregator(aggregator.Config{})
+		require.NoError(t, err)
+		grouped, err := realtime.NewCountAggregator(aggregator.Config{realtime.KeyGroupBy: groupBy})
+		require.NoError(t, err)
+		return map[string]aggregator.Aggregator{"count": count, "grouped": grouped}
+	}
+
+	aggregators := newAggregators("country")
+	ev := &eventagg.Event{Type: "a", Params: map[string]interface{}{"country": "NL"}}
+	for _, agg := range aggregators {
+		require.NoError(t, agg.Add(ev))
+	}
+	s, err := Take(pfile.Positions{}, aggregators)
+	require.NoError(t, err)
+
+	// no aggregator is restored, so all of them could be replayed
+	restored := newAggregators("platform")
+	require.Equal(t, ErrIncomplete, s.Restore(restored))
+	res, err := restored["count"].View()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{}, res)
+}
+
+func TestTakeWhilePaused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventagg-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newCount := func() aggregator.Aggregator {
+		count, err := realtime.NewCountAggregator(aggregator.Config{})
+		require.NoError(t, err)
+		return count
+	}
+	persistence, err := pfile.New(pfile.Config{DataDir: dir, Count: 2, SegmentMaxBytes: 4096}, log.NewNopLogger())
+	require.NoError(t, err)
+	aggregators := map[string]aggregator.Aggregator{"count": newCount()}
+
+	queue := local.New()
+	require.NoError(t, queue.Subscribe(persistence.Add))
+	require.NoError(t, queue.Subscribe(aggregators["count"].Add))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- queue.Start(ctx) }()
+	for queue.Insert(nil) != nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	const inserters, events = 4, 500
+	var wg sync.WaitGroup
+	for i := 0; i < inserters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < events; j++ {
+				require.NoError(t, queue.Insert(&eventagg.Event{Type: "a"}))
+			}
+		}()
+	}
+
+	// snapshots are taken while events are inserted
+	snapshots := []*Snapshot{}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, queue.WhilePaused(ctx, func() error {
+			if err := persistence.WaitWritten(ctx); err != nil {
+				return err
+			}
+			s, err := Take(persistence.Positions(), aggregators)
+			snapshots = append(snapshots, s)
+			return err
+		}))
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	cancel()
+	require.NoError(t, <-stopped)
+	require.NoError(t, persistence.Close())
+
+	// restored state with events replayed after positions has every event once
+	for i, s := range snapshots {
+		restored := map[string]aggregator.Aggregator{"count": newCount()}
+		require.NoError(t, s.Restore(restored))
+		_, err := pfile.ReplayFrom(dir, s.Positions, log.NewNopLogger(), restored["count"].Add)
+		require.NoError(t, err)
+
+		res, err := restored["count"].View()
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{"a": inserters * events}, res, "snapshot %d", i)
+	}
+}